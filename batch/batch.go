@@ -0,0 +1,265 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	prompts "github.com/WillChangeThisLater/lm/prompts"
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+// the batch package runs a JSONL file of requests, one per line, and
+// writes one result line per request as it finishes. the results file
+// doubles as a checkpoint: ids that already succeeded are skipped, so an
+// interrupted batch picks up where it left off
+
+const defaultConcurrency = 4
+
+// Request is one line of the input file
+type Request struct {
+	// defaults to the line number
+	ID string `json:"id"`
+	// the prompt, or the template's text
+	Prompt string `json:"prompt"`
+	// a prompt from the prompt library
+	Template  string         `json:"template"`
+	Variables map[string]any `json:"variables"`
+	// URLs, or files relative to the input file
+	Images []string `json:"images"`
+	// overrides the template's model or the batch's default
+	Model string `json:"model"`
+}
+
+// Result is one line of the output file
+type Result struct {
+	ID       string        `json:"id"`
+	Model    string        `json:"model,omitempty"`
+	Response string        `json:"response,omitempty"`
+	Usage    models.Usage  `json:"usage"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type Options struct {
+	// for requests that don't set a model or use a template
+	Model *models.Model
+	// how many requests run at once. defaults to 4
+	Concurrency int
+	// shared by every worker. nil doesn't limit anything
+	Limiter *utils.RateLimiter
+	// ids to skip, usually from Completed
+	Skip map[string]bool
+	// where relative image paths are read from
+	Dir string
+	// lets templates run commands with shell()
+	AllowShell bool
+	// lets templates fetch pages with url()
+	AllowURL bool
+	// sends each request's query. defaults to running it against its
+	// model
+	Send models.Sender
+}
+
+type Summary struct {
+	Succeeded int
+	Failed    int
+	Skipped   int
+	Usage     models.Usage
+}
+
+// ParseRequests reads one request per line. blank lines and lines
+// starting with # are skipped
+func ParseRequests(r io.Reader) ([]Request, error) {
+	requests := make([]Request, 0)
+	ids := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var request Request
+		decoder := json.NewDecoder(bytes.NewReader([]byte(text)))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %v", line, err))
+		}
+		if request.ID == "" {
+			request.ID = fmt.Sprintf("%d", line)
+		}
+		if previous, ok := ids[request.ID]; ok {
+			return nil, errors.New(fmt.Sprintf("line %d: id %q is already used on line %d", line, request.ID, previous))
+		}
+		ids[request.ID] = line
+		if request.Prompt == "" && request.Template == "" {
+			return nil, errors.New(fmt.Sprintf("line %d: request %q needs a prompt or a template", line, request.ID))
+		}
+		if request.Template == "" && len(request.Variables) > 0 {
+			return nil, errors.New(fmt.Sprintf("line %d: request %q has variables but no template", line, request.ID))
+		}
+		requests = append(requests, request)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// Completed returns the ids in a results file that succeeded. failed
+// requests are run again, and a line cut off by an interruption is
+// ignored
+func Completed(r io.Reader) (map[string]bool, error) {
+	completed := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var result Result
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			continue
+		}
+		if result.Error == "" {
+			completed[result.ID] = true
+		}
+	}
+	return completed, scanner.Err()
+}
+
+// Run runs every request that isn't skipped and writes each result to w
+// as a JSON line as soon as it's done. requests interrupted by ctx aren't
+// written, so they run again next time
+func Run(ctx context.Context, requests []Request, options Options, w io.Writer) (*Summary, error) {
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	summary := &Summary{}
+	var mutex sync.Mutex
+	var writeErr error
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, request := range requests {
+		if options.Skip[request.ID] {
+			summary.Skipped++
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(request Request) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := options.Limiter.Wait(ctx); err != nil {
+				return
+			}
+			result := runRequest(ctx, request, options)
+			if ctx.Err() != nil && result.Error != "" {
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if writeErr != nil {
+				return
+			}
+			if writeErr = encoder.Encode(result); writeErr != nil {
+				return
+			}
+			summary.Usage.Add(result.Usage)
+			if result.Error != "" {
+				summary.Failed++
+			} else {
+				summary.Succeeded++
+			}
+		}(request)
+	}
+	wg.Wait()
+
+	if writeErr != nil {
+		return summary, writeErr
+	}
+	return summary, ctx.Err()
+}
+
+func runRequest(ctx context.Context, request Request, options Options) (result Result) {
+	result = Result{ID: request.ID}
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+
+	query, err := makeQuery(request, options)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Model = query.Model().ModelId
+
+	result.Response, result.Usage, err = options.Send.Run(ctx, query)
+	if err != nil {
+		// keep what the model said when its JSON was wrong
+		var validationErr *models.ValidationError
+		if errors.As(err, &validationErr) {
+			result.Response = validationErr.Response
+		}
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func makeQuery(request Request, options Options) (*models.Query, error) {
+	images, err := utils.LoadImages(request.Images, func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(options.Dir, name)
+		}
+		return os.ReadFile(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var model *models.Model
+	if request.Model != "" {
+		if model, err = models.GetModel(request.Model); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.Template != "" {
+		prompt, err := prompts.GetPrompt(request.Template)
+		if err != nil {
+			return nil, err
+		}
+		prompt.AllowShell = options.AllowShell
+		prompt.AllowURL = options.AllowURL
+		// a nil model is the template's own
+		return prompt.MakeQuery(model, request.Prompt, request.Variables, images...)
+	}
+
+	if model == nil {
+		model = options.Model
+	}
+	if model == nil {
+		return nil, errors.New("no model given")
+	}
+	if len(images) > 0 && !model.SupportsImageOutput {
+		return nil, errors.New(fmt.Sprintf("model %s does not support images", model.ModelId))
+	}
+	return model.MakeQuery(request.Prompt, images...)
+}
@@ -0,0 +1,334 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	models "github.com/WillChangeThisLater/lm/models"
+)
+
+func TestParseRequests(t *testing.T) {
+	requests, err := ParseRequests(strings.NewReader(`
+{"id": "a", "prompt": "hello"}
+# comments are skipped
+{"template": "sentiment-single", "prompt": "great food", "model": "gpt-4o"}
+`))
+	if err != nil {
+		t.Fatalf("Could not parse requests: %v", err)
+	}
+	if len(requests) != 2 || requests[0].ID != "a" || requests[1].ID != "4" {
+		t.Errorf("Expected ids a and 4 (the line number), got %+v", requests)
+	}
+
+	bad := map[string]string{
+		"duplicate id":       `{"id": "a", "prompt": "x"}` + "\n" + `{"id": "a", "prompt": "y"}`,
+		"no prompt":          `{"id": "a"}`,
+		"unknown field":      `{"id": "a", "prompt": "x", "temperature": 0}`,
+		"variables, no tmpl": `{"id": "a", "prompt": "x", "variables": {"tone": "terse"}}`,
+		"not json":           `hello`,
+	}
+	for reason, input := range bad {
+		if _, err := ParseRequests(strings.NewReader(input)); err == nil {
+			t.Errorf("%s: expected an error", reason)
+		}
+	}
+}
+
+func TestCompleted(t *testing.T) {
+	results := `{"id": "a", "response": "ok"}
+{"id": "b", "error": "rate limited"}
+{"id": "c", "response": "ok"}
+{"id": "d", "respon`
+	completed, err := Completed(strings.NewReader(results))
+	if err != nil {
+		t.Fatalf("Could not read results: %v", err)
+	}
+	if !completed["a"] || completed["b"] || !completed["c"] || completed["d"] || len(completed) != 2 {
+		t.Errorf("Expected only a and c to be done, got %v", completed)
+	}
+}
+
+func TestRun(t *testing.T) {
+	requests, err := ParseRequests(strings.NewReader(`
+{"id": "done", "prompt": "already ran"}
+{"id": "fail", "prompt": "fail"}
+{"id": "review", "template": "sentiment-single", "prompt": "great food"}
+{"id": "override", "prompt": "hello", "model": "gpt-4o"}
+{"id": "p1", "prompt": "hello"}
+{"id": "p2", "prompt": "hello"}
+{"id": "p3", "prompt": "hello"}
+`))
+	if err != nil {
+		t.Fatalf("Could not parse requests: %v", err)
+	}
+
+	var mutex sync.Mutex
+	var running, maxRunning int
+	send := func(ctx context.Context, query *models.Query) (string, models.Usage, error) {
+		mutex.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		if query.Prompt() == "fail" {
+			return "", models.Usage{}, errors.New("rate limited")
+		}
+		return query.Model().ModelId, models.Usage{InputTokens: 10, OutputTokens: 2}, nil
+	}
+
+	mini, _ := models.GetModel("gpt-4o-mini")
+	var out bytes.Buffer
+	options := Options{Model: mini, Concurrency: 2, Skip: map[string]bool{"done": true}, Send: send}
+	summary, err := Run(context.Background(), requests, options, &out)
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	if summary.Succeeded != 5 || summary.Failed != 1 || summary.Skipped != 1 || summary.Usage.InputTokens != 50 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+	if maxRunning > 2 {
+		t.Errorf("Expected at most 2 requests at once, got %d", maxRunning)
+	}
+
+	results := make(map[string]Result)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var result Result
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("Could not parse result line %q: %v", line, err)
+		}
+		results[result.ID] = result
+	}
+	if len(results) != 6 {
+		t.Errorf("Expected 6 result lines, got %d", len(results))
+	}
+	if results["fail"].Error != "rate limited" {
+		t.Errorf("Expected the error to be written, got %+v", results["fail"])
+	}
+	if results["p1"].Model != "gpt-4o-mini" || results["override"].Model != "gpt-4o" || results["p1"].Usage.OutputTokens != 2 {
+		t.Errorf("Expected the default model, overrides and usage, got %+v and %+v", results["p1"], results["override"])
+	}
+	if results["review"].Model != "gpt-4o-mini" || results["review"].Response != "gpt-4o-mini" {
+		t.Errorf("Templates should use their own model, got %+v", results["review"])
+	}
+
+	// resuming only reruns the failure
+	completed, _ := Completed(&out)
+	completed["done"] = true
+	options.Skip = completed
+	summary, _ = Run(context.Background(), requests, options, &bytes.Buffer{})
+	if summary.Skipped != 6 || summary.Failed != 1 {
+		t.Errorf("Expected everything but the failure to be skipped, got %+v", summary)
+	}
+}
+
+// a fake of OpenAI's files and batches endpoints
+func fakeOpenAI(t *testing.T) *httptest.Server {
+	var mutex sync.Mutex
+	polls := 0
+	var uploaded []openAIInputLine
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /files", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": {"message": "bad key"}}`)
+			return
+		}
+		if r.FormValue("purpose") != "batch" {
+			t.Errorf("Expected purpose=batch, got %q", r.FormValue("purpose"))
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			t.Fatalf("No file uploaded: %v", err)
+		}
+		decoder := json.NewDecoder(file)
+		mutex.Lock()
+		defer mutex.Unlock()
+		for decoder.More() {
+			var line openAIInputLine
+			if err := decoder.Decode(&line); err != nil {
+				t.Fatalf("Bad input line: %v", err)
+			}
+			uploaded = append(uploaded, line)
+		}
+		fmt.Fprint(w, `{"id": "file-in"}`)
+	})
+	mux.HandleFunc("POST /batches", func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		if request["input_file_id"] != "file-in" || request["endpoint"] != "/v1/chat/completions" {
+			t.Errorf("Unexpected batch request %v", request)
+		}
+		fmt.Fprint(w, `{"id": "batch_123", "status": "validating"}`)
+	})
+	mux.HandleFunc("GET /batches/batch_123", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		polls++
+		if polls == 1 {
+			fmt.Fprint(w, `{"id": "batch_123", "status": "in_progress", "request_counts": {"total": 2, "completed": 1, "failed": 0}}`)
+			return
+		}
+		fmt.Fprint(w, `{"id": "batch_123", "status": "completed", "output_file_id": "file-out", "error_file_id": "file-err", "request_counts": {"total": 2, "completed": 1, "failed": 1}}`)
+	})
+	mux.HandleFunc("POST /batches/batch_123/cancel", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": "batch_123", "status": "cancelling"}`)
+	})
+	mux.HandleFunc("GET /files/file-out/content", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, line := range uploaded {
+			if line.CustomID == "bad" {
+				continue
+			}
+			var body struct {
+				Model string `json:"model"`
+			}
+			json.Unmarshal(line.Body, &body)
+			response := fmt.Sprintf(`{"choices": [{"message": {"role": "assistant", "content": "answer from %s"}}], "usage": {"prompt_tokens": 7, "completion_tokens": 3}}`, body.Model)
+			fmt.Fprintf(w, `{"custom_id": %q, "response": {"status_code": 200, "body": %s}, "error": null}`+"\n", line.CustomID, response)
+		}
+	})
+	mux.HandleFunc("GET /files/file-err/content", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"custom_id": "bad", "response": {"status_code": 400, "body": {"error": {"message": "context too long"}}}, "error": null}`+"\n")
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestOpenAIBatch(t *testing.T) {
+	server := fakeOpenAI(t)
+	defer server.Close()
+	t.Setenv("OPENAI_API_KEY", "test-key")
+
+	mini, _ := models.GetModel("gpt-4o-mini")
+	requests, _ := ParseRequests(strings.NewReader(`
+{"id": "good", "prompt": "hello"}
+{"id": "bad", "template": "sentiment-single", "prompt": "great food"}
+`))
+	ctx := context.Background()
+	job, err := Submit(ctx, requests, "requests.jsonl", SubmitOptions{Model: mini, OpenAIURL: server.URL})
+	if err != nil {
+		t.Fatalf("Could not submit: %v", err)
+	}
+	if job.ID != "batch_123" || job.Provider != "openai" || job.BaseURL != server.URL || job.Model != "gpt-4o-mini" || job.Requests != 2 || job.Finished() {
+		t.Errorf("Unexpected job %+v", job)
+	}
+
+	dir := t.TempDir()
+	if err := SaveJob(dir, job); err != nil {
+		t.Fatalf("Could not save job: %v", err)
+	}
+	job, err = LoadJob(dir, "batch_1")
+	if err != nil || job.InputFileID != "file-in" {
+		t.Fatalf("Could not load the job by prefix: %v", err)
+	}
+
+	if _, err := Fetch(ctx, job, &bytes.Buffer{}, nil); err == nil {
+		t.Errorf("Fetching an unfinished job should fail")
+	}
+	Refresh(ctx, job)
+	if job.Status != "in_progress" || job.Completed != 1 {
+		t.Errorf("Expected the job to be in progress, got %+v", job)
+	}
+	Refresh(ctx, job)
+	if !job.Finished() || !job.Succeeded() || job.OutputFileID != "file-out" {
+		t.Errorf("Expected the job to be completed, got %+v", job)
+	}
+
+	var out bytes.Buffer
+	summary, err := Fetch(ctx, job, &out, nil)
+	if err != nil {
+		t.Fatalf("Could not fetch results: %v", err)
+	}
+	if summary.Succeeded != 1 || summary.Failed != 1 || summary.Usage.InputTokens != 7 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+	if !strings.Contains(out.String(), "answer from gpt-4o-mini") || !strings.Contains(out.String(), "context too long") {
+		t.Errorf("Unexpected results %s", out.String())
+	}
+	completed, _ := Completed(&out)
+	if !completed["good"] || completed["bad"] {
+		t.Errorf("Expected good to succeed and bad to fail, got %v", completed)
+	}
+
+	// fetching again skips what's already in the results file
+	summary, _ = Fetch(ctx, job, &bytes.Buffer{}, completed)
+	if summary.Skipped != 1 || summary.Succeeded != 0 {
+		t.Errorf("Expected good to be skipped, got %+v", summary)
+	}
+
+	running := &Job{ID: "batch_123", Provider: "openai", BaseURL: server.URL}
+	if err := Cancel(ctx, running); err != nil || running.Status != "cancelling" {
+		t.Errorf("Expected the job to be cancelling, got %+v (%v)", running, err)
+	}
+
+	// one model per batch, and only providers with a batch API
+	mixed, _ := ParseRequests(strings.NewReader(`{"prompt": "a"}` + "\n" + `{"prompt": "b", "model": "gpt-4o"}`))
+	if _, err := Submit(ctx, mixed, "mixed.jsonl", SubmitOptions{Model: mini}); err == nil || !strings.Contains(err.Error(), "one model") {
+		t.Errorf("Expected an error for a batch with two models, got %v", err)
+	}
+	local, _ := ParseRequests(strings.NewReader(`{"prompt": "a", "model": "local-deepseek-7b"}`))
+	if _, err := Submit(ctx, local, "local.jsonl", SubmitOptions{}); err == nil {
+		t.Errorf("Local models have no batch API")
+	}
+}
+
+func TestBedrockBatch(t *testing.T) {
+	nova, _ := models.GetModel("aws-nova-lite")
+	requests, _ := ParseRequests(strings.NewReader(`{"id": "r1", "template": "sentiment-single", "prompt": "great food", "model": "aws-nova-lite"}`))
+	query, err := makeQuery(requests[0], Options{Model: nova})
+	if err != nil {
+		t.Fatalf("Could not make query: %v", err)
+	}
+	body, err := query.BedrockRequestBody()
+	if err != nil {
+		t.Fatalf("Could not make the bedrock body: %v", err)
+	}
+	var parsed map[string]any
+	json.Unmarshal(body, &parsed)
+	if parsed["schemaVersion"] != "messages-v1" || parsed["toolConfig"] == nil {
+		t.Errorf("Expected a nova body that forces the response tool, got %s", body)
+	}
+	if _, err := Submit(context.Background(), requests, "in.jsonl", SubmitOptions{}); err == nil || !strings.Contains(err.Error(), "S3") {
+		t.Errorf("Bedrock jobs should need an S3 location and role, got %v", err)
+	}
+	// too few records fails before anything is uploaded
+	located := SubmitOptions{S3URI: "s3://bucket/batches", RoleARN: "arn:aws:iam::123456789012:role/batch"}
+	if _, err := Submit(context.Background(), requests, "in.jsonl", located); err == nil || !strings.Contains(err.Error(), "at least 100") {
+		t.Errorf("Bedrock jobs with fewer than 100 requests should be refused, got %v", err)
+	}
+	first, _ := bedrockJobName()
+	second, _ := bedrockJobName()
+	if first == second || !strings.HasPrefix(first, "lm-") {
+		t.Errorf("Job names submitted together should differ, got %s and %s", first, second)
+	}
+
+	output := `{"recordId": "r1", "modelInput": {}, "modelOutput": {"output": {"message": {"role": "assistant", "content": [{"toolUse": {"name": "json_schema", "input": {"sentiment": "good"}}}]}}, "usage": {"inputTokens": 12, "outputTokens": 4}}}
+{"recordId": "r2", "modelInput": {}, "error": {"errorCode": 400, "errorMessage": "bad image"}}
+`
+	results := make([]Result, 0)
+	err = readBedrockOutput(&Job{Model: nova.ModelId}, strings.NewReader(output), func(result Result) error {
+		results = append(results, result)
+		return nil
+	})
+	if err != nil || len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d (%v)", len(results), err)
+	}
+	if results[0].Response != `{"sentiment": "good"}` || results[0].Usage.OutputTokens != 4 || results[1].Error != "bad image" {
+		t.Errorf("Unexpected results %+v", results)
+	}
+}
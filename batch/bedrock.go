@@ -0,0 +1,229 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	models "github.com/WillChangeThisLater/lm/models"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrock"
+	"github.com/aws/aws-sdk-go-v2/service/bedrock/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// bedrock batch inference: the requests go to S3, a model invocation job
+// reads them with a role that can access the bucket, and writes the
+// results next to them. see
+// https://docs.aws.amazon.com/bedrock/latest/userguide/batch-inference.html
+
+// bedrock rejects jobs with fewer records than this, but only once the job
+// is created, after the upload
+const bedrockMinRecords = 100
+
+type bedrockInputLine struct {
+	RecordID   string          `json:"recordId"`
+	ModelInput json.RawMessage `json:"modelInput"`
+}
+
+type bedrockOutputLine struct {
+	RecordID    string          `json:"recordId"`
+	ModelOutput json.RawMessage `json:"modelOutput"`
+	Error       *struct {
+		ErrorMessage string `json:"errorMessage"`
+	} `json:"error"`
+}
+
+func awsConfig(ctx context.Context) (aws.Config, error) {
+	return models.AWSConfig(ctx)
+}
+
+// splitS3URI turns s3://bucket/some/prefix into bucket and some/prefix
+func splitS3URI(uri string) (string, string, error) {
+	if !strings.HasPrefix(uri, "s3://") {
+		return "", "", errors.New(fmt.Sprintf("%q is not an s3:// URI", uri))
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	if bucket == "" {
+		return "", "", errors.New(fmt.Sprintf("%q has no bucket", uri))
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+func submitBedrock(ctx context.Context, job *Job, queries []namedQuery, options SubmitOptions) error {
+	if options.S3URI == "" || options.RoleARN == "" {
+		return errors.New("bedrock batch jobs need an S3 location and a role that can read and write it")
+	}
+	if len(queries) < bedrockMinRecords {
+		return errors.New(fmt.Sprintf("bedrock batch jobs need at least %d requests, got %d (run them directly with `lm batch --in` instead)", bedrockMinRecords, len(queries)))
+	}
+	bucket, prefix, err := splitS3URI(options.S3URI)
+	if err != nil {
+		return err
+	}
+
+	var input bytes.Buffer
+	encoder := json.NewEncoder(&input)
+	for _, query := range queries {
+		body, err := query.BedrockRequestBody()
+		if err != nil {
+			return errors.New(fmt.Sprintf("request %s: %v", query.id, err))
+		}
+		if err := encoder.Encode(bedrockInputLine{RecordID: query.id, ModelInput: body}); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	name, err := bedrockJobName()
+	if err != nil {
+		return err
+	}
+	inputKey := path.Join(prefix, name, "input.jsonl")
+	outputKey := path.Join(prefix, name, "output") + "/"
+	_, err = s3.NewFromConfig(cfg).PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(inputKey),
+		Body:   bytes.NewReader(input.Bytes()),
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not upload the requests: %v", err))
+	}
+	job.InputURI = fmt.Sprintf("s3://%s/%s", bucket, inputKey)
+	job.OutputURI = fmt.Sprintf("s3://%s/%s", bucket, outputKey)
+
+	created, err := bedrock.NewFromConfig(cfg).CreateModelInvocationJob(ctx, &bedrock.CreateModelInvocationJobInput{
+		JobName: aws.String(name),
+		ModelId: aws.String(job.Model),
+		RoleArn: aws.String(options.RoleARN),
+		InputDataConfig: &types.ModelInvocationJobInputDataConfigMemberS3InputDataConfig{Value: types.ModelInvocationJobS3InputDataConfig{
+			S3Uri:         aws.String(job.InputURI),
+			S3InputFormat: types.S3InputFormatJsonl,
+		}},
+		OutputDataConfig: &types.ModelInvocationJobOutputDataConfigMemberS3OutputDataConfig{Value: types.ModelInvocationJobS3OutputDataConfig{
+			S3Uri: aws.String(job.OutputURI),
+		}},
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not create the batch job: %v", err))
+	}
+	job.JobARN = aws.ToString(created.JobArn)
+	job.ID = path.Base(job.JobARN)
+	job.Status = string(types.ModelInvocationJobStatusSubmitted)
+	return nil
+}
+
+// bedrockJobName names the job (and its S3 folder) after when it was
+// submitted. the random suffix keeps jobs submitted in the same second apart
+func bedrockJobName() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("lm-%s-%x", time.Now().UTC().Format("20060102-150405"), suffix), nil
+}
+
+func refreshBedrock(ctx context.Context, job *Job) error {
+	cfg, err := awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := bedrock.NewFromConfig(cfg).GetModelInvocationJob(ctx, &bedrock.GetModelInvocationJobInput{
+		JobIdentifier: aws.String(job.JobARN),
+	})
+	if err != nil {
+		return err
+	}
+	job.Status = string(status.Status)
+	job.Message = aws.ToString(status.Message)
+	return nil
+}
+
+func cancelBedrock(ctx context.Context, job *Job) error {
+	cfg, err := awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = bedrock.NewFromConfig(cfg).StopModelInvocationJob(ctx, &bedrock.StopModelInvocationJobInput{
+		JobIdentifier: aws.String(job.JobARN),
+	})
+	if err != nil {
+		return err
+	}
+	job.Status = string(types.ModelInvocationJobStatusStopping)
+	return nil
+}
+
+// fetchBedrock reads every .jsonl.out file the job wrote
+func fetchBedrock(ctx context.Context, job *Job, emit func(Result) error) error {
+	bucket, prefix, err := splitS3URI(job.OutputURI)
+	if err != nil {
+		return err
+	}
+	cfg, err := awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := s3.NewFromConfig(cfg)
+	pages := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix + "/")})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			if !strings.HasSuffix(aws.ToString(object.Key), ".jsonl.out") {
+				continue
+			}
+			output, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: object.Key})
+			if err != nil {
+				return err
+			}
+			err = readBedrockOutput(job, output.Body, emit)
+			output.Body.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readBedrockOutput(job *Job, r io.Reader, emit func(Result) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var line bedrockOutputLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return errors.New(fmt.Sprintf("could not read batch output: %v", err))
+		}
+		result := Result{ID: line.RecordID, Model: job.Model}
+		if line.Error != nil {
+			result.Error = line.Error.ErrorMessage
+		} else {
+			var err error
+			if result.Response, result.Usage, err = models.ParseBedrockResponse(line.ModelOutput); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		if err := emit(result); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
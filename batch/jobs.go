@@ -0,0 +1,247 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	models "github.com/WillChangeThisLater/lm/models"
+)
+
+// Job is a batch handed to a provider's batch API. it's kept locally so
+// `lm batch status|fetch|cancel` can find it again
+type Job struct {
+	// the provider's batch id (openai), or the end of the job ARN (bedrock)
+	ID        string    `json:"id"`
+	Provider  string    `json:"provider"`
+	Model     string    `json:"model"`
+	Input     string    `json:"input"`
+	Requests  int       `json:"requests"`
+	Submitted time.Time `json:"submitted"`
+	// as the provider reports it
+	Status string `json:"status"`
+	// why the job failed, if it did
+	Message   string `json:"message,omitempty"`
+	Completed int    `json:"completed,omitempty"`
+	Failed    int    `json:"failed,omitempty"`
+	Fetched   bool   `json:"fetched,omitempty"`
+
+	// openai. BaseURL is empty for api.openai.com
+	BaseURL      string `json:"base_url,omitempty"`
+	InputFileID  string `json:"input_file_id,omitempty"`
+	OutputFileID string `json:"output_file_id,omitempty"`
+	ErrorFileID  string `json:"error_file_id,omitempty"`
+
+	// bedrock
+	JobARN    string `json:"job_arn,omitempty"`
+	InputURI  string `json:"input_uri,omitempty"`
+	OutputURI string `json:"output_uri,omitempty"`
+}
+
+type SubmitOptions struct {
+	// for requests that don't set a model or use a template
+	Model *models.Model
+	// where relative image paths are read from
+	Dir string
+	// lets templates run commands with shell()
+	AllowShell bool
+	// lets templates fetch pages with url()
+	AllowURL bool
+
+	// openai only: where the batch API is, if not api.openai.com
+	OpenAIURL string
+
+	// bedrock only: where the requests and results go, and the role the
+	// job uses to read and write them
+	S3URI   string
+	RoleARN string
+}
+
+type namedQuery struct {
+	id string
+	*models.Query
+}
+
+// statuses after which a job won't change (openai's are lowercase,
+// bedrock's are capitalized)
+var finishedStatuses = map[string]bool{
+	"completed": true, "failed": true, "expired": true, "cancelled": true,
+	"Completed": true, "PartiallyCompleted": true, "Failed": true, "Stopped": true, "Expired": true,
+}
+
+// Finished is true once the job is done, one way or another
+func (j *Job) Finished() bool {
+	return finishedStatuses[j.Status]
+}
+
+// Succeeded is true if the job has results to fetch
+func (j *Job) Succeeded() bool {
+	return j.Status == "completed" || j.Status == "Completed" || j.Status == "PartiallyCompleted"
+}
+
+// Submit sends the requests to the batch API of the provider of their
+// model. every request in a batch has to use the same model
+func Submit(ctx context.Context, requests []Request, input string, options SubmitOptions) (*Job, error) {
+	if len(requests) == 0 {
+		return nil, errors.New("there are no requests to submit")
+	}
+	queries := make([]namedQuery, 0, len(requests))
+	var model *models.Model
+	for _, request := range requests {
+		query, err := makeQuery(request, Options{Model: options.Model, Dir: options.Dir, AllowShell: options.AllowShell, AllowURL: options.AllowURL})
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("request %s: %v", request.ID, err))
+		}
+		if model == nil {
+			model = query.Model()
+		} else if query.Model().ModelId != model.ModelId {
+			return nil, errors.New(fmt.Sprintf("request %s uses %s but earlier requests use %s; a batch can only use one model, so split the file by model", request.ID, query.Model().ModelId, model.ModelId))
+		}
+		queries = append(queries, namedQuery{id: request.ID, Query: query})
+	}
+
+	job := &Job{Provider: model.Provider, Model: model.ModelId, Input: input, Requests: len(requests), Submitted: time.Now()}
+	var err error
+	switch model.Provider {
+	case "openai":
+		job.BaseURL = options.OpenAIURL
+		err = submitOpenAI(ctx, job, queries)
+	case "aws":
+		err = submitBedrock(ctx, job, queries, options)
+	default:
+		err = errors.New(fmt.Sprintf("%s models have no batch API; use `lm batch --in ... --out ...` instead", model.Provider))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Refresh asks the provider how the job is doing
+func Refresh(ctx context.Context, job *Job) error {
+	switch job.Provider {
+	case "openai":
+		return refreshOpenAI(ctx, job)
+	case "aws":
+		return refreshBedrock(ctx, job)
+	}
+	return errors.New(fmt.Sprintf("unknown batch provider %s", job.Provider))
+}
+
+// Cancel stops the job. whatever finished before it stopped can still be
+// fetched
+func Cancel(ctx context.Context, job *Job) error {
+	switch job.Provider {
+	case "openai":
+		return cancelOpenAI(ctx, job)
+	case "aws":
+		return cancelBedrock(ctx, job)
+	}
+	return errors.New(fmt.Sprintf("unknown batch provider %s", job.Provider))
+}
+
+// Fetch downloads a finished job's results and writes them to w in the
+// same format as Run, skipping ids in skip
+func Fetch(ctx context.Context, job *Job, w io.Writer, skip map[string]bool) (*Summary, error) {
+	if !job.Finished() {
+		return nil, errors.New(fmt.Sprintf("batch %s is still %s", job.ID, job.Status))
+	}
+	summary := &Summary{}
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	emit := func(result Result) error {
+		if skip[result.ID] {
+			summary.Skipped++
+			return nil
+		}
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+		summary.Usage.Add(result.Usage)
+		if result.Error != "" {
+			summary.Failed++
+		} else {
+			summary.Succeeded++
+		}
+		return nil
+	}
+
+	var err error
+	switch job.Provider {
+	case "openai":
+		err = fetchOpenAI(ctx, job, emit)
+	case "aws":
+		err = fetchBedrock(ctx, job, emit)
+	default:
+		err = errors.New(fmt.Sprintf("unknown batch provider %s", job.Provider))
+	}
+	return summary, err
+}
+
+func jobFile(dir string, id string) string {
+	return filepath.Join(dir, id+".json")
+}
+
+func SaveJob(dir string, job *Job) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(jobFile(dir, job.ID), contents, 0644)
+}
+
+// LoadJob finds a job by id, or any unique prefix of one
+func LoadJob(dir string, id string) (*Job, error) {
+	jobs, err := ListJobs(dir)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]*Job, 0)
+	for _, job := range jobs {
+		if job.ID == id {
+			return job, nil
+		}
+		if strings.HasPrefix(job.ID, id) {
+			matches = append(matches, job)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, errors.New(fmt.Sprintf("no batch job %s (see `lm batch status`)", id))
+	case 1:
+		return matches[0], nil
+	}
+	return nil, errors.New(fmt.Sprintf("%s matches %d batch jobs", id, len(matches)))
+}
+
+// ListJobs returns every saved job, oldest first
+func ListJobs(dir string) ([]*Job, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(files))
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var job Job
+		if err := json.Unmarshal(contents, &job); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %v", file, err))
+		}
+		jobs = append(jobs, &job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Submitted.Before(jobs[j].Submitted) })
+	return jobs, nil
+}
@@ -0,0 +1,251 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+
+	models "github.com/WillChangeThisLater/lm/models"
+)
+
+// OpenAI's batch API: upload the requests as a file, create a batch from
+// it, and download the output file once it's done (within 24 hours, at
+// half the price). see https://platform.openai.com/docs/guides/batch
+
+const defaultOpenAIURL = "https://api.openai.com/v1"
+
+const openAIEndpoint = "/v1/chat/completions"
+
+type openAIInputLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+type openAIOutputLine struct {
+	CustomID string `json:"custom_id"`
+	Response *struct {
+		StatusCode int             `json:"status_code"`
+		Body       json.RawMessage `json:"body"`
+	} `json:"response"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type openAIBatch struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	OutputFileID string `json:"output_file_id"`
+	ErrorFileID  string `json:"error_file_id"`
+	Errors       *struct {
+		Data []struct {
+			Message string `json:"message"`
+		} `json:"data"`
+	} `json:"errors"`
+	RequestCounts struct {
+		Total     int `json:"total"`
+		Completed int `json:"completed"`
+		Failed    int `json:"failed"`
+	} `json:"request_counts"`
+}
+
+type openAIError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (j *Job) openAIURL() string {
+	if j.BaseURL != "" {
+		return j.BaseURL
+	}
+	return defaultOpenAIURL
+}
+
+func openAIRequest(ctx context.Context, job *Job, method string, path string, contentType string, body io.Reader) ([]byte, error) {
+	apiKey, set := os.LookupEnv("OPENAI_API_KEY")
+	if !set {
+		return nil, errors.New("OPENAI_API_KEY not set")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, job.openAIURL()+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+	rep, err := models.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rep.Body.Close()
+	contents, err := io.ReadAll(rep.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rep.StatusCode >= 300 {
+		var apiErr openAIError
+		if json.Unmarshal(contents, &apiErr) == nil && apiErr.Error.Message != "" {
+			return nil, errors.New(fmt.Sprintf("%s %s: %s", method, path, apiErr.Error.Message))
+		}
+		return nil, errors.New(fmt.Sprintf("%s %s: %s", method, path, rep.Status))
+	}
+	return contents, nil
+}
+
+func openAIJSON(ctx context.Context, job *Job, method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	contents, err := openAIRequest(ctx, job, method, path, "application/json", reader)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, result)
+}
+
+func submitOpenAI(ctx context.Context, job *Job, queries []namedQuery) error {
+	var input bytes.Buffer
+	encoder := json.NewEncoder(&input)
+	for _, query := range queries {
+		body, err := query.ChatRequestBody()
+		if err != nil {
+			return errors.New(fmt.Sprintf("request %s: %v", query.id, err))
+		}
+		line := openAIInputLine{CustomID: query.id, Method: "POST", URL: openAIEndpoint, Body: body}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	// upload the requests
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	writer.WriteField("purpose", "batch")
+	file, err := writer.CreateFormFile("file", "requests.jsonl")
+	if err != nil {
+		return err
+	}
+	file.Write(input.Bytes())
+	writer.Close()
+	contents, err := openAIRequest(ctx, job, "POST", "/files", writer.FormDataContentType(), &form)
+	if err != nil {
+		return err
+	}
+	var uploaded struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(contents, &uploaded); err != nil {
+		return err
+	}
+	job.InputFileID = uploaded.ID
+
+	var created openAIBatch
+	request := map[string]any{
+		"input_file_id":     uploaded.ID,
+		"endpoint":          openAIEndpoint,
+		"completion_window": "24h",
+	}
+	if err := openAIJSON(ctx, job, "POST", "/batches", request, &created); err != nil {
+		return err
+	}
+	job.ID = created.ID
+	job.updateOpenAI(&created)
+	return nil
+}
+
+func (j *Job) updateOpenAI(batch *openAIBatch) {
+	j.Status = batch.Status
+	j.OutputFileID = batch.OutputFileID
+	j.ErrorFileID = batch.ErrorFileID
+	j.Completed = batch.RequestCounts.Completed
+	j.Failed = batch.RequestCounts.Failed
+	if batch.Errors != nil && len(batch.Errors.Data) > 0 {
+		j.Message = batch.Errors.Data[0].Message
+	}
+}
+
+func refreshOpenAI(ctx context.Context, job *Job) error {
+	var batch openAIBatch
+	if err := openAIJSON(ctx, job, "GET", "/batches/"+job.ID, nil, &batch); err != nil {
+		return err
+	}
+	job.updateOpenAI(&batch)
+	return nil
+}
+
+func cancelOpenAI(ctx context.Context, job *Job) error {
+	var batch openAIBatch
+	if err := openAIJSON(ctx, job, "POST", "/batches/"+job.ID+"/cancel", nil, &batch); err != nil {
+		return err
+	}
+	job.updateOpenAI(&batch)
+	return nil
+}
+
+// fetchOpenAI reads the output file, then the error file (requests that
+// failed outright)
+func fetchOpenAI(ctx context.Context, job *Job, emit func(Result) error) error {
+	for _, fileID := range []string{job.OutputFileID, job.ErrorFileID} {
+		if fileID == "" {
+			continue
+		}
+		contents, err := openAIRequest(ctx, job, "GET", "/files/"+fileID+"/content", "", nil)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(contents))
+		scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var line openAIOutputLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				return errors.New(fmt.Sprintf("could not read batch output: %v", err))
+			}
+			if err := emit(openAIResult(job, &line)); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openAIResult(job *Job, line *openAIOutputLine) Result {
+	result := Result{ID: line.CustomID, Model: job.Model}
+	switch {
+	case line.Error != nil:
+		result.Error = line.Error.Message
+	case line.Response == nil:
+		result.Error = "no response"
+	default:
+		var err error
+		result.Response, result.Usage, err = models.ParseChatResponse(line.Response.Body)
+		if err != nil {
+			result.Error = err.Error()
+		} else if line.Response.StatusCode >= 300 {
+			result.Error = fmt.Sprintf("status %d", line.Response.StatusCode)
+		}
+	}
+	return result
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	models "github.com/WillChangeThisLater/lm/models"
+	prompts "github.com/WillChangeThisLater/lm/prompts"
 	utils "github.com/WillChangeThisLater/lm/utils"
 )
 
@@ -35,47 +37,179 @@ func readStdinWithTimeout(timeout int) (string, error) {
 	}
 }
 
+// subcommands get their own flag sets, e.g. `lm index add docs/`.
+// anything else falls through to the default stdin -> model behavior
+var subcommands = map[string]func(args []string){
+	"index":     indexCommand,
+	"ask":       askCommand,
+	"cache":     cacheCommand,
+	"templates": templatesCommand,
+	"schema":    schemaCommand,
+	"eval":      evalCommand,
+	"fewshot":   fewshotCommand,
+	"pipeline":  pipelineCommand,
+	"batch":     batchCommand,
+	"compare":   compareCommand,
+}
+
+func defaultCacheDir() string {
+	if dir, set := os.LookupEnv("LM_CACHE_DIR"); set {
+		return dir
+	}
+	usr, err := user.Current()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error fetching user details:", err)
+		os.Exit(1)
+	}
+	return filepath.Join(usr.HomeDir, ".cache", "lm")
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := subcommands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	// `lm run <name> ...` is shorthand for `lm --template <name> ...`
+	if len(os.Args) > 2 && os.Args[1] == "run" {
+		os.Args = append([]string{os.Args[0], "--template", os.Args[2]}, os.Args[3:]...)
+	}
+
 	// Define flags
 	modelPtr := flag.String("model", "gpt-4o", "model to use")
 	listModelsPtr := flag.Bool("list-models", false, "List all available models")
 	timeoutPtr := flag.Int("timeout", 60, "Timeout for reading stdin")
 	promptPtr := flag.String("prompt", "", "Append prompt to stdin")
+	templatePtr := flag.String("template", "", "Render stdin through a prompt from the prompt library (see `lm templates list`)")
 	imageURLsPtr := flag.String("imageURLs", "", "Define one or more image URLs. Usage: --imageURLS \"url1,url2,url3\"")
 	imageFilesPtr := flag.String("imageFiles", "", "Define one or more image files. Usage: --imageFiles \"file1,file2,file3\"")
 	screenshotPtr := flag.Bool("screenshot", false, "If set, screenshots of all monitors will be taken and used as image file input")
 	sitesPtr := flag.String("sites", "", "Define one or more sites to scrape")
 	cachePtr := flag.Bool("cache", false, "Enable persistent cache")
+	cacheTTLPtr := flag.String("cache-ttl", "", "Expire cached responses after this long, e.g. 12h or 7d (implies --cache)")
+	refreshPtr := flag.Bool("refresh", false, "Ignore any cached response, query the model and overwrite the cache (implies --cache)")
+	cacheOnlyPtr := flag.Bool("cache-only", false, "Fail instead of querying the model if the response is not cached (implies --cache)")
+	cacheDirPtr := flag.String("cache-dir", defaultCacheDir(), "Directory the cache is stored in (or set LM_CACHE_DIR)")
+	semanticCachePtr := flag.Bool("semantic-cache", false, "Also match cached prompts by meaning, not just exact text (implies --cache)")
+	similarityPtr := flag.Float64("similarity", 0.95, "Minimum cosine similarity for a semantic cache hit")
+	embeddingModelPtr := flag.String("embedding-model", "text-embedding-3-small", "Embedding model used by --semantic-cache")
+	verbosePtr := flag.Bool("verbose", false, "Print extra information (like semantic cache matches) to stderr")
+	temperaturePtr := flag.Float64("temperature", 1, "Sampling temperature (provider default if unset)")
+	topPPtr := flag.Float64("top-p", 1, "Nucleus sampling probability (provider default if unset)")
+	maxTokensPtr := flag.Int("max-tokens", 0, "Maximum number of tokens to generate (provider default if unset)")
+	seedPtr := flag.Int("seed", 0, "Sampling seed, for providers that support one")
+	var vars, varFiles keyValueFlag
+	flag.Var(&vars, "var", "Set a template variable (repeatable). Usage: --var name=value")
+	flag.Var(&varFiles, "var-file", "Set a template variable to the contents of a file (repeatable). Usage: --var-file name=path")
+	varsFilePtr := flag.String("vars", "", "JSON file with an object of template variables")
+	allowShellPtr := flag.Bool("allow-shell", false, "Let the template run commands with shell()")
+	allowURLPtr := flag.Bool("allow-url", false, "Let the template fetch pages with url()")
+	jsonPtr := flag.Bool("json", false, "Ask for a JSON object (unstructured JSON mode)")
+	schemaPtr := flag.String("schema", "", "JSON schema the response must match: a file, or the schema itself. Usage: --schema schema.json or --schema '{\"type\": \"object\", ...}'")
+	schemaNamePtr := flag.String("schema-name", "json_schema", "Name sent along with the schema (from --schema or the template)")
+	strictPtr := flag.Bool("strict", true, "Use the provider's strict structured output mode for the schema (from --schema or the template)")
+	jqPtr := flag.String("jq", "", "Print only part of a JSON response, e.g. .items[].name (implies --json)")
+	prettyPtr := flag.Bool("pretty", false, "Pretty-print JSON responses (implies --json)")
+	compactPtr := flag.Bool("compact", false, "Print JSON responses on one line (implies --json)")
+	ensemblePtr := flag.String("ensemble", "", "Ask several times and combine the answers: vote (most common answer) or judge (a model picks the best)")
+	samplesPtr := flag.Int("samples", 5, "How many answers --ensemble asks for")
+	judgeModelPtr := flag.String("judge-model", "gpt-4o", "Model that picks the best answer with --ensemble judge")
 
 	// Parse flags
 	flag.Parse()
 
+	if *semanticCachePtr || *cacheTTLPtr != "" || *refreshPtr || *cacheOnlyPtr {
+		*cachePtr = true
+	}
+	if *refreshPtr && *cacheOnlyPtr {
+		fmt.Fprintln(os.Stderr, "--refresh and --cache-only cannot be used together")
+		os.Exit(1)
+	}
+	if *prettyPtr && *compactPtr {
+		fmt.Fprintln(os.Stderr, "--pretty and --compact cannot be used together")
+		os.Exit(1)
+	}
+	if *ensemblePtr != "" && *ensemblePtr != "vote" && *ensemblePtr != "judge" {
+		fmt.Fprintf(os.Stderr, "Unknown --ensemble %s (use vote or judge)\n", *ensemblePtr)
+		os.Exit(1)
+	}
+	// the cache holds single answers
+	if *ensemblePtr != "" && *cachePtr {
+		fmt.Fprintln(os.Stderr, "--ensemble cannot be used with the cache")
+		os.Exit(1)
+	}
+	output := jsonOutput{path: *jqPtr, pretty: *prettyPtr, compact: *compactPtr}
+	if output.enabled() {
+		*jsonPtr = true
+	}
+
+	var cacheTTL time.Duration
+	if *cacheTTLPtr != "" {
+		var err error
+		cacheTTL, err = utils.ParseDuration(*cacheTTLPtr)
+		if err != nil || cacheTTL <= 0 {
+			fmt.Fprintf(os.Stderr, "Invalid --cache-ttl %q\n", *cacheTTLPtr)
+			os.Exit(1)
+		}
+	}
+
 	// If --list-models is set, just list the models and exit
 	if *listModelsPtr {
 		fmt.Println(models.ModelInfoString())
 		os.Exit(0)
 	}
 
-	// Create model
-	model, err := models.GetModel(*modelPtr)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not get model %s: %v\n", *modelPtr, err)
+	// Load the prompt template, if any. templates bring their own
+	// model, which --model overrides
+	var prompt *prompts.Prompt
+	var templateVars map[string]any
+	modelName := *modelPtr
+	if *templatePtr == "" && (flagWasSet("var") || flagWasSet("var-file") || flagWasSet("vars")) {
+		fmt.Fprintln(os.Stderr, "--var, --var-file and --vars can only be used with a template")
 		os.Exit(1)
 	}
+	if *templatePtr != "" {
+		var err error
+		prompt, err = prompts.GetPrompt(*templatePtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not get template %s: %v\n", *templatePtr, err)
+			os.Exit(1)
+		}
+		warnPromptProblems()
+		prompt.AllowShell = *allowShellPtr
+		prompt.AllowURL = *allowURLPtr
+		// check variables now rather than after waiting on stdin
+		templateVars, err = templateVariables(*varsFilePtr, varFiles, vars)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if _, err := prompt.ResolveVariables(templateVars); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !flagWasSet("model") {
+			modelName = prompt.ModelName
+		}
+		if *cacheTTLPtr == "" {
+			cacheTTL = prompt.CacheTTL
+		}
+	}
 
-	// figure out the location of the cache
-	usr, err := user.Current()
+	// Create model
+	model, err := models.GetModel(modelName)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error fetching user details:", err)
+		fmt.Fprintf(os.Stderr, "Could not get model %s: %v\n", modelName, err)
 		os.Exit(1)
 	}
-	defaultCachePath := filepath.Join(usr.HomeDir, ".cache", "your_program_name")
 
 	// get the cache
 	var cache *utils.Cache
 	if *cachePtr {
 		var err error
-		cache, err = utils.NewCache(defaultCachePath)
+		cache, err = utils.NewCache(*cacheDirPtr)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Error initializing cache:", err)
 			os.Exit(1)
@@ -88,8 +222,7 @@ func main() {
 	for _, url := range strings.Split(*imageURLsPtr, ",") {
 		url = strings.TrimSpace(url)
 		if url != "" {
-			imageContent := models.ImageContent{Type: "image_url", ImageURL: models.ImageURL{URL: url}}
-			images = append(images, imageContent)
+			images = append(images, models.ImageFromURL(url))
 		}
 	}
 
@@ -160,18 +293,42 @@ func main() {
 		queryString += *promptPtr
 	}
 
-	// Look in cache if specified
-	if *cachePtr {
-		if cachedResponse, err := cache.Get(queryString); err == nil {
-			fmt.Println(cachedResponse)
-			os.Exit(0)
+	// stdin (+ --prompt) becomes the template's `text`
+	var schema *models.JSONSchema
+	if prompt != nil {
+		queryString, err = prompt.RenderWithVariables(queryString, templateVars)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not render template %s: %v\n", prompt.Name, err)
+			os.Exit(1)
+		}
+		rawSchema, err := prompt.Schema()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read schema for template %s: %v\n", prompt.Name, err)
+			os.Exit(1)
+		}
+		if rawSchema != nil {
+			schema = &models.JSONSchema{Name: *schemaNamePtr, Schema: rawSchema, Strict: *strictPtr}
 		}
 	}
+	// --schema replaces the template's schema, if it has one
+	if *schemaPtr != "" {
+		rawSchema, err := readSchema(*schemaPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		schema = &models.JSONSchema{Name: *schemaNamePtr, Schema: rawSchema, Strict: *strictPtr}
+	}
+	needsJSON := *jsonPtr || schema != nil || (prompt != nil && prompt.ForceJSON)
 
 	// flight check!
 	// this makes sure the model that we are using can produce the output we want
 	needsImageOutput := len(images) > 0
-	validModel, reason := model.FlightCheck(needsImageOutput, false, false)
+	validModel, reason := model.FlightCheck(needsImageOutput, needsJSON && schema == nil, schema != nil)
+	if validModel && prompt != nil {
+		// templates can also require capabilities in settings.json
+		validModel, reason = prompt.FlightCheck(model, needsImageOutput)
+	}
 	if !validModel {
 		fmt.Fprintf(os.Stderr, "Model %s cannot be used for your query: %s\n", model.ModelId, reason)
 		os.Exit(1)
@@ -186,26 +343,152 @@ func main() {
 
 	// create the query object
 	var query *models.Query
-	query, err = model.MakeQuery(queryString, images...)
+	if needsJSON {
+		query, err = model.MakeJSONQuery(queryString, schema, images...)
+	} else {
+		query, err = model.MakeQuery(queryString, images...)
+	}
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not create query: %v\n", err)
 		os.Exit(1)
 	}
+	var baseOptions models.GenerationOptions
+	if prompt != nil {
+		baseOptions = prompt.Options
+	}
+	query.SetOptions(generationOptions(baseOptions, temperaturePtr, topPPtr, maxTokensPtr, seedPtr))
+
+	// the cache key covers the whole request, not just the prompt text,
+	// so switching models/images/options never returns a stale answer
+	var cacheKey, scope string
+	if *cachePtr {
+		if cacheKey, err = query.CacheKey(); err == nil {
+			scope, err = query.ScopeKey()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not compute cache key: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Look in cache if specified
+	if *cachePtr && !*refreshPtr {
+		if entry, err := cache.Get(cacheKey); err == nil {
+			printResponse(entry.Response, output)
+			os.Exit(0)
+		}
+	}
+
+	// Fall back to a semantic lookup. the embedding is kept around
+	// so we can store it alongside the response on a miss
+	var queryEmbedding []float64
+	if *semanticCachePtr {
+		embeddingModel, err := models.GetEmbeddingModel(*embeddingModelPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		embeddings, err := embeddingModel.Embed([]string{queryString})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not embed query for semantic cache: %v\n", err)
+		} else {
+			queryEmbedding = embeddings[0]
+		}
+		if queryEmbedding != nil && !*refreshPtr {
+			if match, err := cache.GetSemantic(scope, queryEmbedding, *similarityPtr); err == nil {
+				if *verbosePtr {
+					fmt.Fprintf(os.Stderr, "Semantic cache hit (similarity %.3f) for prompt:\n%s\n", match.Score, match.Entry.Prompt)
+				}
+				printResponse(match.Entry.Response, output)
+				os.Exit(0)
+			}
+		}
+	}
+
+	if *cacheOnlyPtr {
+		fmt.Fprintln(os.Stderr, "No cached response for this query (--cache-only)")
+		os.Exit(1)
+	}
 
-	response, err := query.Run()
+	var response string
+	switch *ensemblePtr {
+	case "vote":
+		var vote *models.VoteResult
+		vote, err = query.Vote(context.Background(), *samplesPtr)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "%d of %d answers agreed\n", vote.Votes, len(vote.Samples))
+			response = vote.Answer
+		}
+	case "judge":
+		var judgeModel *models.Model
+		var judgement *models.Judgement
+		if judgeModel, err = models.GetModel(*judgeModelPtr); err == nil {
+			judgement, err = query.Judge(context.Background(), judgeModel, *samplesPtr)
+		}
+		if err == nil {
+			printJudgement(judgement)
+			response = judgement.Answer
+		}
+	default:
+		response, err = query.Run()
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error querying model: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Write the response
-	fmt.Println(response)
-
 	// store in cache if --cache was defined
 	if *cachePtr {
-		if err := cache.Set(queryString, response); err != nil {
+		entry := utils.CacheEntry{Prompt: queryString, Model: model.ModelId, Response: response}
+		if err := cache.Set(cacheKey, entry, cacheTTL); err != nil {
 			fmt.Fprintln(os.Stderr, "Error writing to cache:", err)
 		}
+		if queryEmbedding != nil {
+			if err := cache.SetSemantic(scope, cacheKey, queryEmbedding, cacheTTL); err != nil {
+				fmt.Fprintln(os.Stderr, "Error writing to semantic cache:", err)
+			}
+		}
+	}
+
+	// Write the response (after caching it, in case --jq fails)
+	printResponse(response, output)
+}
+
+// printJudgement says which answer the judge picked, and why, on stderr
+// so stdout is just the answer
+func printJudgement(judgement *models.Judgement) {
+	if judgement.Choice == 0 {
+		fmt.Fprintf(os.Stderr, "The judge wrote its own answer from %d candidates: %s\n", len(judgement.Candidates), judgement.Rationale)
+		return
 	}
+	fmt.Fprintf(os.Stderr, "The judge picked answer %d of %d: %s\n", judgement.Choice, len(judgement.Candidates), judgement.Rationale)
+}
+
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// generationOptions overrides options (usually from a template's
+// settings.json) with whatever was passed on the command line
+func generationOptions(options models.GenerationOptions, temperature *float64, topP *float64, maxTokens *int, seed *int) models.GenerationOptions {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "temperature":
+			options.Temperature = temperature
+		case "top-p":
+			options.TopP = topP
+		case "max-tokens":
+			options.MaxTokens = maxTokens
+		case "seed":
+			options.Seed = seed
+		}
+	})
+	return options
 }
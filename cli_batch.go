@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	batch "github.com/WillChangeThisLater/lm/batch"
+	models "github.com/WillChangeThisLater/lm/models"
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+// how often `lm batch fetch --wait` checks on a job
+const batchPollInterval = 30 * time.Second
+
+func defaultBatchDir() string {
+	if dir, set := os.LookupEnv("LM_BATCH_DIR"); set {
+		return dir
+	}
+	usr, err := user.Current()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error fetching user details:", err)
+		os.Exit(1)
+	}
+	return filepath.Join(usr.HomeDir, ".local", "share", "lm", "batches")
+}
+
+func batchUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  lm batch --in requests.jsonl --out results.jsonl [--model model] [--concurrency n] [--rpm n]")
+	fmt.Fprintln(os.Stderr, "  lm batch submit --in requests.jsonl [--model model] [--s3 s3://bucket/prefix --role arn]")
+	fmt.Fprintln(os.Stderr, "  lm batch status [job]")
+	fmt.Fprintln(os.Stderr, "  lm batch fetch [--wait] --out results.jsonl <job>")
+	fmt.Fprintln(os.Stderr, "  lm batch cancel <job>")
+	fmt.Fprintln(os.Stderr, "Rerunning with the same --out skips the requests that already succeeded")
+}
+
+// lm batch [submit|status|fetch|cancel]
+func batchCommand(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "submit":
+			batchSubmitCommand(args[1:])
+			return
+		case "status":
+			batchStatusCommand(args[1:])
+			return
+		case "fetch":
+			batchFetchCommand(args[1:])
+			return
+		case "cancel":
+			batchCancelCommand(args[1:])
+			return
+		}
+	}
+	batchRunCommand(args)
+}
+
+func readRequests(file string) []batch.Request {
+	in, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer in.Close()
+	requests, err := batch.ParseRequests(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read %s: %v\n", file, err)
+		os.Exit(1)
+	}
+	return requests
+}
+
+// openResults opens a results file for appending, and returns the ids
+// in it that already succeeded
+func openResults(file string) (*os.File, map[string]bool) {
+	existing, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	completed, err := batch.Completed(bytes.NewReader(existing))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read %s: %v\n", file, err)
+		os.Exit(1)
+	}
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// finish a line cut off by an interruption so the next result starts
+	// on its own line
+	if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		out.WriteString("\n")
+	}
+	return out, completed
+}
+
+func printSummary(summary *batch.Summary) {
+	fmt.Fprintf(os.Stderr, "%d succeeded, %d failed, %d skipped (already done); %d input and %d output tokens\n",
+		summary.Succeeded, summary.Failed, summary.Skipped, summary.Usage.InputTokens, summary.Usage.OutputTokens)
+}
+
+func loadJob(dir string, id string) *batch.Job {
+	job, err := batch.LoadJob(dir, id)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return job
+}
+
+func saveJob(dir string, job *batch.Job) {
+	if err := batch.SaveJob(dir, job); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not save batch job %s: %v\n", job.ID, err)
+		os.Exit(1)
+	}
+}
+
+// lm batch --in requests.jsonl --out results.jsonl
+func batchRunCommand(args []string) {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	flags.Usage = batchUsage
+	inPtr := flags.String("in", "", "JSONL file of requests")
+	outPtr := flags.String("out", "", "JSONL file results are appended to")
+	modelPtr := flags.String("model", "gpt-4o", "Model for requests that don't set one (templates use their own)")
+	concurrencyPtr := flags.Int("concurrency", 4, "How many requests to run at once")
+	rpmPtr := flags.Int("rpm", 0, "Maximum requests started per minute, across all workers (0 for no limit)")
+	allowShellPtr := flags.Bool("allow-shell", false, "Let templates run commands with shell()")
+	allowURLPtr := flags.Bool("allow-url", false, "Let templates fetch pages with url()")
+	flags.Parse(args)
+	if *inPtr == "" || *outPtr == "" || flags.NArg() != 0 {
+		batchUsage()
+		os.Exit(1)
+	}
+
+	requests := readRequests(*inPtr)
+	model, err := models.GetModel(*modelPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// whatever already succeeded in --out is skipped
+	out, completed := openResults(*outPtr)
+	defer out.Close()
+
+	options := batch.Options{
+		Model:       model,
+		Concurrency: *concurrencyPtr,
+		Limiter:     utils.NewRateLimiter(*rpmPtr),
+		Skip:        completed,
+		Dir:         filepath.Dir(*inPtr),
+		AllowShell:  *allowShellPtr,
+		AllowURL:    *allowURLPtr,
+	}
+	// ctrl-c stops starting new requests; anything unfinished runs next time
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	summary, err := batch.Run(ctx, requests, options, out)
+
+	printSummary(summary)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		out.Close()
+		os.Exit(1)
+	}
+	if summary.Failed > 0 {
+		out.Close()
+		os.Exit(1)
+	}
+}
+
+// lm batch submit --in requests.jsonl
+func batchSubmitCommand(args []string) {
+	flags := flag.NewFlagSet("batch submit", flag.ExitOnError)
+	flags.Usage = batchUsage
+	inPtr := flags.String("in", "", "JSONL file of requests")
+	modelPtr := flags.String("model", "gpt-4o", "Model for requests that don't set one (templates use their own)")
+	s3Ptr := flags.String("s3", os.Getenv("LM_BATCH_S3"), "Bedrock only: S3 location for the requests and results (or set LM_BATCH_S3)")
+	rolePtr := flags.String("role", os.Getenv("LM_BATCH_ROLE"), "Bedrock only: ARN of the role the job uses to access --s3 (or set LM_BATCH_ROLE)")
+	batchDirPtr := flags.String("batch-dir", defaultBatchDir(), "Directory submitted jobs are tracked in (or set LM_BATCH_DIR)")
+	allowShellPtr := flags.Bool("allow-shell", false, "Let templates run commands with shell()")
+	allowURLPtr := flags.Bool("allow-url", false, "Let templates fetch pages with url()")
+	flags.Parse(args)
+	if *inPtr == "" || flags.NArg() != 0 {
+		batchUsage()
+		os.Exit(1)
+	}
+
+	requests := readRequests(*inPtr)
+	model, err := models.GetModel(*modelPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	options := batch.SubmitOptions{
+		Model:      model,
+		Dir:        filepath.Dir(*inPtr),
+		AllowShell: *allowShellPtr,
+		AllowURL:   *allowURLPtr,
+		S3URI:      *s3Ptr,
+		RoleARN:    *rolePtr,
+	}
+	job, err := batch.Submit(context.Background(), requests, *inPtr, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not submit batch: %v\n", err)
+		os.Exit(1)
+	}
+	saveJob(*batchDirPtr, job)
+	fmt.Fprintf(os.Stderr, "Submitted %d request(s) to %s (%s)\n", job.Requests, job.Provider, job.Model)
+	fmt.Println(job.ID)
+}
+
+// lm batch status [job]
+func batchStatusCommand(args []string) {
+	flags := flag.NewFlagSet("batch status", flag.ExitOnError)
+	flags.Usage = batchUsage
+	batchDirPtr := flags.String("batch-dir", defaultBatchDir(), "Directory submitted jobs are tracked in (or set LM_BATCH_DIR)")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		batchUsage()
+		os.Exit(1)
+	}
+
+	var jobs []*batch.Job
+	if flags.NArg() == 1 {
+		jobs = []*batch.Job{loadJob(*batchDirPtr, flags.Arg(0))}
+	} else {
+		var err error
+		if jobs, err = batch.ListJobs(*batchDirPtr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if len(jobs) == 0 {
+			fmt.Fprintln(os.Stderr, "No batch jobs. Submit one with `lm batch submit --in requests.jsonl`")
+			return
+		}
+	}
+
+	// only jobs that can still change are asked about
+	for _, job := range jobs {
+		if job.Finished() {
+			continue
+		}
+		if err := batch.Refresh(context.Background(), job); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not check on %s: %v\n", job.ID, err)
+			continue
+		}
+		saveJob(*batchDirPtr, job)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tPROVIDER\tMODEL\tSTATUS\tREQUESTS\tSUBMITTED\tFETCHED")
+	for _, job := range jobs {
+		status := job.Status
+		if job.Completed > 0 || job.Failed > 0 {
+			status = fmt.Sprintf("%s (%d done, %d failed)", status, job.Completed, job.Failed)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\t%s\t%t\n", job.ID, job.Provider, job.Model, status, job.Requests, job.Submitted.Format("2006-01-02 15:04"), job.Fetched)
+	}
+	table.Flush()
+	for _, job := range jobs {
+		if job.Message != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", job.ID, job.Message)
+		}
+	}
+}
+
+// lm batch fetch --out results.jsonl <job>
+func batchFetchCommand(args []string) {
+	flags := flag.NewFlagSet("batch fetch", flag.ExitOnError)
+	flags.Usage = batchUsage
+	outPtr := flags.String("out", "", "JSONL file results are appended to")
+	waitPtr := flags.Bool("wait", false, "Wait for the job to finish instead of failing if it hasn't")
+	batchDirPtr := flags.String("batch-dir", defaultBatchDir(), "Directory submitted jobs are tracked in (or set LM_BATCH_DIR)")
+	flags.Parse(args)
+	if *outPtr == "" || flags.NArg() != 1 {
+		batchUsage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	job := loadJob(*batchDirPtr, flags.Arg(0))
+	for !job.Finished() {
+		if err := batch.Refresh(ctx, job); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not check on %s: %v\n", job.ID, err)
+			os.Exit(1)
+		}
+		saveJob(*batchDirPtr, job)
+		if job.Finished() {
+			break
+		}
+		if !*waitPtr {
+			fmt.Fprintf(os.Stderr, "Batch %s is still %s (use --wait to wait for it)\n", job.ID, job.Status)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", job.ID, job.Status)
+		time.Sleep(batchPollInterval)
+	}
+	if !job.Succeeded() && job.Message != "" {
+		fmt.Fprintf(os.Stderr, "Batch %s is %s: %s\n", job.ID, job.Status, job.Message)
+	}
+
+	out, completed := openResults(*outPtr)
+	defer out.Close()
+	summary, err := batch.Fetch(ctx, job, out, completed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not fetch %s: %v\n", job.ID, err)
+		out.Close()
+		os.Exit(1)
+	}
+	job.Fetched = true
+	saveJob(*batchDirPtr, job)
+	printSummary(summary)
+	if missing := job.Requests - summary.Succeeded - summary.Failed - summary.Skipped; missing > 0 {
+		fmt.Fprintf(os.Stderr, "%d request(s) have no result; rerun them with `lm batch --in %s --out %s`\n", missing, job.Input, *outPtr)
+	}
+}
+
+// lm batch cancel <job>
+func batchCancelCommand(args []string) {
+	flags := flag.NewFlagSet("batch cancel", flag.ExitOnError)
+	flags.Usage = batchUsage
+	batchDirPtr := flags.String("batch-dir", defaultBatchDir(), "Directory submitted jobs are tracked in (or set LM_BATCH_DIR)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		batchUsage()
+		os.Exit(1)
+	}
+
+	job := loadJob(*batchDirPtr, flags.Arg(0))
+	if job.Finished() {
+		fmt.Fprintf(os.Stderr, "Batch %s is already %s\n", job.ID, job.Status)
+		os.Exit(1)
+	}
+	if err := batch.Cancel(context.Background(), job); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not cancel %s: %v\n", job.ID, err)
+		os.Exit(1)
+	}
+	saveJob(*batchDirPtr, job)
+	fmt.Fprintf(os.Stderr, "Batch %s is %s\n", job.ID, job.Status)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+// keys are sha256 hashes; this many hex characters is plenty to tell
+// entries apart in `lm cache ls`
+const shortKeyLength = 12
+
+func cacheUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  lm cache stats")
+	fmt.Fprintln(os.Stderr, "  lm cache ls")
+	fmt.Fprintln(os.Stderr, "  lm cache show <key>")
+	fmt.Fprintln(os.Stderr, "  lm cache rm <key>...")
+	fmt.Fprintln(os.Stderr, "  lm cache purge --older-than 30d")
+	fmt.Fprintln(os.Stderr, "  lm cache purge --all")
+	fmt.Fprintln(os.Stderr, "  lm cache export [file]")
+	fmt.Fprintln(os.Stderr, "  lm cache import [file]")
+}
+
+// lm cache stats|ls|show|rm|purge|export|import
+func cacheCommand(args []string) {
+	if len(args) == 0 {
+		cacheUsage()
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("cache "+args[0], flag.ExitOnError)
+	cacheDirPtr := flags.String("cache-dir", defaultCacheDir(), "Directory the cache is stored in (or set LM_CACHE_DIR)")
+	olderThanPtr := flags.String("older-than", "", "Purge entries older than this (e.g. 12h, 30d)")
+	allPtr := flags.Bool("all", false, "With purge, delete every entry")
+	flags.Parse(args[1:])
+
+	cache, err := utils.NewCache(*cacheDirPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing cache:", err)
+		os.Exit(1)
+	}
+	defer cache.Close()
+
+	switch args[0] {
+	case "stats":
+		stats, err := cache.Stats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read cache: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("directory:        %s\n", *cacheDirPtr)
+		fmt.Printf("entries:          %d\n", stats.Entries)
+		fmt.Printf("semantic entries: %d\n", stats.SemanticEntries)
+		fmt.Printf("size:             %d bytes\n", stats.Size)
+		fmt.Printf("hits:             %d\n", stats.Hits)
+		if stats.Entries > 0 {
+			fmt.Printf("oldest:           %s\n", stats.Oldest.Format(time.RFC3339))
+			fmt.Printf("newest:           %s\n", stats.Newest.Format(time.RFC3339))
+		}
+		modelNames := make([]string, 0, len(stats.Models))
+		for model := range stats.Models {
+			modelNames = append(modelNames, model)
+		}
+		sort.Strings(modelNames)
+		for _, model := range modelNames {
+			fmt.Printf("  %-16s %d\n", model, stats.Models[model])
+		}
+
+	case "ls":
+		entries := make([]*utils.CacheEntry, 0)
+		err := cache.Entries(func(entry *utils.CacheEntry) error {
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read cache: %v\n", err)
+			os.Exit(1)
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].CreatedAt.After(entries[j].CreatedAt)
+		})
+		for _, entry := range entries {
+			fmt.Printf("%s\t%s\t%s\t%d hits\t%d bytes\t%s\n", entry.Key[:min(shortKeyLength, len(entry.Key))], entry.CreatedAt.Format("2006-01-02 15:04"), entry.Model, entry.Hits, entry.Size, preview(entry.Prompt, 60))
+		}
+
+	case "show":
+		if flags.NArg() != 1 {
+			cacheUsage()
+			os.Exit(1)
+		}
+		entry := findEntry(cache, flags.Arg(0))
+		contents, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not format entry: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(contents))
+
+	case "rm":
+		if flags.NArg() == 0 {
+			cacheUsage()
+			os.Exit(1)
+		}
+		for _, key := range flags.Args() {
+			entry := findEntry(cache, key)
+			if err := cache.Delete(entry.Key); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not delete %s: %v\n", key, err)
+				os.Exit(1)
+			}
+		}
+
+	case "purge":
+		if *olderThanPtr == "" && !*allPtr {
+			fmt.Fprintln(os.Stderr, "Nothing to purge: pass --older-than to purge old entries, or --all to empty the cache")
+			os.Exit(1)
+		}
+		if *olderThanPtr != "" && *allPtr {
+			fmt.Fprintln(os.Stderr, "Pass either --older-than or --all, not both")
+			os.Exit(1)
+		}
+		var count int
+		if *allPtr {
+			count, err = cache.PurgeAll()
+		} else {
+			olderThan, parseErr := utils.ParseDuration(*olderThanPtr)
+			if parseErr != nil || olderThan <= 0 {
+				fmt.Fprintf(os.Stderr, "Invalid --older-than %q\n", *olderThanPtr)
+				os.Exit(1)
+			}
+			count, err = cache.Purge(olderThan)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not purge cache: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Purged %d entries\n", count)
+
+	case "export":
+		var w io.Writer = os.Stdout
+		if flags.NArg() > 0 {
+			file, err := os.Create(flags.Arg(0))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not create %s: %v\n", flags.Arg(0), err)
+				os.Exit(1)
+			}
+			defer file.Close()
+			w = file
+		}
+		count, err := cache.Export(w)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not export cache: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d entries\n", count)
+
+	case "import":
+		var r io.Reader = os.Stdin
+		if flags.NArg() > 0 {
+			file, err := os.Open(flags.Arg(0))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not open %s: %v\n", flags.Arg(0), err)
+				os.Exit(1)
+			}
+			defer file.Close()
+			r = file
+		}
+		count, err := cache.Import(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not import cache: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d entries\n", count)
+
+	default:
+		cacheUsage()
+		os.Exit(1)
+	}
+}
+
+// findEntry resolves a (possibly shortened) key to exactly one entry
+func findEntry(cache *utils.Cache, key string) *utils.CacheEntry {
+	entries, err := cache.Find(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read cache: %v\n", err)
+		os.Exit(1)
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(os.Stderr, "No cache entry matches %s\n", key)
+		os.Exit(1)
+	}
+	if len(entries) > 1 {
+		fmt.Fprintf(os.Stderr, "%s matches %d cache entries, use a longer key\n", key, len(entries))
+		os.Exit(1)
+	}
+	return entries[0]
+}
+
+// preview squashes text onto one line and truncates it
+func preview(text string, length int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > length {
+		return text[:length-3] + "..."
+	}
+	return text
+}
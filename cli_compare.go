@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	compare "github.com/WillChangeThisLater/lm/compare"
+	models "github.com/WillChangeThisLater/lm/models"
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+func compareUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  lm compare --models m1,m2,m3 [--imageURLs ...] [--imageFiles ...] [--format side|stacked|json] [--ensemble vote|judge] < question.txt")
+}
+
+// terminalWidth guesses how wide the terminal is
+func terminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return 160
+}
+
+// collectImages turns the --imageURLs and --imageFiles lists into images
+func collectImages(imageURLs string, imageFiles string) ([]models.ImageContent, error) {
+	names := make([]string, 0)
+	for _, name := range strings.Split(imageURLs+","+imageFiles, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return utils.LoadImages(names, nil)
+}
+
+// lm compare --models a,b,c
+func compareCommand(args []string) {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	flags.Usage = compareUsage
+	modelsPtr := flags.String("models", "", "Comma separated models to ask")
+	promptPtr := flags.String("prompt", "", "Append prompt to stdin")
+	imageURLsPtr := flags.String("imageURLs", "", "Define one or more image URLs. Usage: --imageURLs \"url1,url2,url3\"")
+	imageFilesPtr := flags.String("imageFiles", "", "Define one or more image files. Usage: --imageFiles \"file1,file2,file3\"")
+	jsonPtr := flags.Bool("json", false, "Ask every model for a JSON object")
+	schemaPtr := flags.String("schema", "", "JSON schema the responses must match: a file, or the schema itself")
+	formatPtr := flags.String("format", "side", "How to print the answers: side (by side), stacked or json")
+	widthPtr := flags.Int("width", terminalWidth(), "Width of the side by side output (defaults to $COLUMNS)")
+	timeoutPtr := flags.Int("timeout", 60, "Timeout for reading stdin")
+	ensemblePtr := flags.String("ensemble", "", "Combine the answers: vote (the answer most models agree on) or judge (a model picks the best)")
+	judgeModelPtr := flags.String("judge-model", "gpt-4o", "Model that picks the best answer with --ensemble judge")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		compareUsage()
+		os.Exit(1)
+	}
+	if *formatPtr != "side" && *formatPtr != "stacked" && *formatPtr != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown --format %s (use side, stacked or json)\n", *formatPtr)
+		os.Exit(1)
+	}
+	if *ensemblePtr != "" && *ensemblePtr != "vote" && *ensemblePtr != "judge" {
+		fmt.Fprintf(os.Stderr, "Unknown --ensemble %s (use vote or judge)\n", *ensemblePtr)
+		os.Exit(1)
+	}
+	judgeModel, err := models.GetModel(*judgeModelPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	compareModels, err := splitModels(*modelsPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(compareModels) == 0 {
+		fmt.Fprintln(os.Stderr, "--models needs at least one model")
+		os.Exit(1)
+	}
+	images, err := collectImages(*imageURLsPtr, *imageFilesPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var schema *models.JSONSchema
+	if *schemaPtr != "" {
+		rawSchema, err := readSchema(*schemaPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		schema = &models.JSONSchema{Name: "json_schema", Schema: rawSchema, Strict: true}
+	}
+	needsJSON := *jsonPtr || schema != nil
+
+	queryString, err := readStdinWithTimeout(*timeoutPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	queryString += *promptPtr
+
+	// a model that can't do what's asked gets an error instead of an answer
+	build := func(model *models.Model) (*models.Query, error) {
+		if ok, reason := model.FlightCheck(len(images) > 0, needsJSON && schema == nil, schema != nil); !ok {
+			return nil, errors.New(reason)
+		}
+		if needsJSON {
+			return model.MakeJSONQuery(queryString, schema, images...)
+		}
+		return model.MakeQuery(queryString, images...)
+	}
+	answers := compare.Run(context.Background(), compareModels, build, compare.Options{})
+
+	var verdict *compare.Verdict
+	switch *ensemblePtr {
+	case "vote":
+		verdict, err = compare.Vote(answers)
+	case "judge":
+		verdict, err = compare.Judge(context.Background(), judgeModel, queryString, answers, compare.Options{})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not combine the answers: %v\n", err)
+	}
+
+	var writeErr error
+	switch *formatPtr {
+	case "json":
+		writeErr = compare.WriteJSON(os.Stdout, answers, verdict)
+	case "stacked":
+		writeErr = compare.WriteStacked(os.Stdout, answers)
+	default:
+		writeErr = compare.WriteSideBySide(os.Stdout, answers, *widthPtr)
+	}
+	if writeErr == nil && verdict != nil && *formatPtr != "json" {
+		writeErr = compare.WriteVerdict(os.Stdout, verdict)
+	}
+	if writeErr != nil {
+		fmt.Fprintln(os.Stderr, writeErr)
+		os.Exit(1)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+	for _, answer := range answers {
+		if answer.Error != "" {
+			os.Exit(1)
+		}
+	}
+}
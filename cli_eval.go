@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	evals "github.com/WillChangeThisLater/lm/evals"
+	models "github.com/WillChangeThisLater/lm/models"
+	prompts "github.com/WillChangeThisLater/lm/prompts"
+)
+
+func defaultEvalDir() string {
+	if dir, set := os.LookupEnv("LM_EVAL_DIR"); set {
+		return dir
+	}
+	usr, err := user.Current()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error fetching user details:", err)
+		os.Exit(1)
+	}
+	return filepath.Join(usr.HomeDir, ".local", "share", "lm", "evals")
+}
+
+func evalUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  lm eval [--models m1,m2] [--concurrency n] [--judge-model model] [--tests file] <prompt>")
+	fmt.Fprintln(os.Stderr, "Test cases are read from tests.jsonl next to the prompt")
+}
+
+// splitModels turns "a, b" into models, or nil for ""
+func splitModels(names string) ([]*models.Model, error) {
+	result := make([]*models.Model, 0)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		model, err := models.GetModel(name)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, model)
+	}
+	return result, nil
+}
+
+// lm eval <prompt>
+func evalCommand(args []string) {
+	flags := flag.NewFlagSet("eval", flag.ExitOnError)
+	flags.Usage = evalUsage
+	modelsPtr := flags.String("models", "", "Comma separated models to run the cases against (defaults to the prompt's model)")
+	concurrencyPtr := flags.Int("concurrency", 4, "How many cases to run at once")
+	judgeModelPtr := flags.String("judge-model", "gpt-4o-mini", "Model that grades judge assertions")
+	testsPtr := flags.String("tests", "", "Read test cases from this file instead of the prompt's tests.jsonl")
+	evalDirPtr := flags.String("eval-dir", defaultEvalDir(), "Directory the last run of each prompt is kept in (or set LM_EVAL_DIR)")
+	allowShellPtr := flags.Bool("allow-shell", false, "Let the template run commands with shell()")
+	allowURLPtr := flags.Bool("allow-url", false, "Let the template fetch pages with url()")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		evalUsage()
+		os.Exit(1)
+	}
+
+	prompt, err := prompts.GetPrompt(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	prompt.AllowShell = *allowShellPtr
+	prompt.AllowURL = *allowURLPtr
+
+	var cases []evals.Case
+	if *testsPtr != "" {
+		file, err := os.Open(*testsPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cases, err = evals.ParseCases(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read %s: %v\n", *testsPtr, err)
+			os.Exit(1)
+		}
+	} else if cases, err = evals.LoadCases(prompt); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	evalModels, err := splitModels(*modelsPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	judgeModel, err := models.GetModel(*judgeModelPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	options := evals.Options{Models: evalModels, Concurrency: *concurrencyPtr, JudgeModel: judgeModel}
+	run, err := evals.Evaluate(context.Background(), prompt, cases, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not evaluate %s: %v\n", prompt.Name, err)
+		os.Exit(1)
+	}
+	run.WriteMatrix(os.Stdout)
+
+	previous, err := evals.LastRun(*evalDirPtr, prompt.Name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else if previous != nil {
+		fmt.Println()
+		evals.WriteDiff(os.Stdout, previous, run)
+	}
+	if err := evals.SaveRun(*evalDirPtr, run); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not save this run: %v\n", err)
+	}
+
+	// so `lm eval` can gate CI
+	if !run.Passed() {
+		os.Exit(1)
+	}
+}
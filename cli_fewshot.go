@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	evals "github.com/WillChangeThisLater/lm/evals"
+	models "github.com/WillChangeThisLater/lm/models"
+	prompts "github.com/WillChangeThisLater/lm/prompts"
+)
+
+func fewshotUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  lm fewshot [--shots n] [--variants n] [--generator model] [--models m1,m2] [--dry-run] <prompt>")
+	fmt.Fprintln(os.Stderr, "The prompt needs a tests.jsonl (see `lm eval`) and a template that uses {{ examples }}")
+}
+
+// lm fewshot <prompt>
+func fewshotCommand(args []string) {
+	flags := flag.NewFlagSet("fewshot", flag.ExitOnError)
+	flags.Usage = fewshotUsage
+	shotsPtr := flags.Int("shots", 2, "Examples per variant")
+	variantsPtr := flags.Int("variants", 3, "How many sets of examples to generate and score")
+	generatorPtr := flags.String("generator", "gpt-4o", "Model that writes the examples")
+	modelsPtr := flags.String("models", "", "Comma separated models to score the variants with (defaults to the prompt's model)")
+	concurrencyPtr := flags.Int("concurrency", 4, "How many cases to run at once")
+	judgeModelPtr := flags.String("judge-model", "gpt-4o-mini", "Model that grades judge assertions")
+	dryRunPtr := flags.Bool("dry-run", false, "Print the best examples instead of saving them")
+	allowShellPtr := flags.Bool("allow-shell", false, "Let the template run commands with shell()")
+	allowURLPtr := flags.Bool("allow-url", false, "Let the template fetch pages with url()")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fewshotUsage()
+		os.Exit(1)
+	}
+
+	prompt, err := prompts.GetPrompt(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	prompt.AllowShell = *allowShellPtr
+	prompt.AllowURL = *allowURLPtr
+	// find out now rather than after paying for every run
+	if !*dryRunPtr {
+		if err := prompt.CheckWritable(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v (or pass --dry-run)\n", err)
+			os.Exit(1)
+		}
+	}
+	cases, err := evals.LoadCases(prompt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	evalModels, err := splitModels(*modelsPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	generator, err := models.GetModel(*generatorPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	judgeModel, err := models.GetModel(*judgeModelPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	options := evals.FewShotOptions{
+		Options:   evals.Options{Models: evalModels, Concurrency: *concurrencyPtr, JudgeModel: judgeModel},
+		Generator: generator,
+		Shots:     *shotsPtr,
+		Variants:  *variantsPtr,
+	}
+	baseline, variants, err := evals.FewShot(context.Background(), prompt, cases, options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "baseline\t%.0f%%\n", 100*baseline.Score)
+	best := baseline
+	for i, variant := range variants {
+		fmt.Fprintf(table, "variant %d\t%.0f%%\n", i+1, 100*variant.Score)
+		if variant.Score > best.Score {
+			best = variant
+		}
+	}
+	table.Flush()
+
+	if best.Score <= baseline.Score {
+		fmt.Printf("\nNo variant beat the baseline (%.0f%%), so %s is unchanged\n", 100*baseline.Score, prompt.Name)
+		return
+	}
+	if *dryRunPtr {
+		fmt.Printf("\nBest examples (%.0f%% vs %.0f%%):\n\n%s", 100*best.Score, 100*baseline.Score, best.Examples)
+		return
+	}
+	file, err := prompt.WriteExamples(best.Examples)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not save examples: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("\nWrote %s (%.0f%% vs %.0f%%)\n", file, 100*best.Score, 100*baseline.Score)
+}
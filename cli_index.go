@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	rag "github.com/WillChangeThisLater/lm/rag"
+)
+
+func defaultIndexDir() string {
+	if dir, set := os.LookupEnv("LM_INDEX_DIR"); set {
+		return dir
+	}
+	usr, err := user.Current()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error fetching user details:", err)
+		os.Exit(1)
+	}
+	return filepath.Join(usr.HomeDir, ".local", "share", "lm", "indexes")
+}
+
+func indexUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  lm index add [--index name] [--embedding-model model] <paths|urls>...")
+	fmt.Fprintln(os.Stderr, "  lm index ls")
+	fmt.Fprintln(os.Stderr, "  lm index rm [--index name] <source>...")
+	fmt.Fprintln(os.Stderr, "  lm index rm [--index name] --all")
+}
+
+// lm index add|ls|rm
+func indexCommand(args []string) {
+	if len(args) == 0 {
+		indexUsage()
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("index "+args[0], flag.ExitOnError)
+	indexPtr := flags.String("index", "default", "Name of the index")
+	indexDirPtr := flags.String("index-dir", defaultIndexDir(), "Directory indexes are stored in")
+	embeddingModelPtr := flags.String("embedding-model", "text-embedding-3-small", "Embedding model to use when creating a new index")
+	allPtr := flags.Bool("all", false, "With rm, remove the whole index")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "add":
+		if flags.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "Nothing to index: pass one or more paths or URLs")
+			os.Exit(1)
+		}
+		if _, err := models.GetEmbeddingModel(*embeddingModelPtr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		index, err := rag.Open(*indexDirPtr, *indexPtr, *embeddingModelPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not open index %s: %v\n", *indexPtr, err)
+			os.Exit(1)
+		}
+
+		for _, source := range flags.Args() {
+			docs, err := rag.LoadDocuments(source)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not read %s: %v\n", source, err)
+				os.Exit(1)
+			}
+			for _, doc := range docs {
+				count, err := index.Add(doc)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Could not index %s: %v\n", doc.Source, err)
+					os.Exit(1)
+				}
+				fmt.Fprintf(os.Stderr, "Indexed %s (%d chunks)\n", doc.Source, count)
+			}
+		}
+
+		if err := index.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not save index %s: %v\n", *indexPtr, err)
+			os.Exit(1)
+		}
+
+	case "ls":
+		names, err := rag.List(*indexDirPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not list indexes: %v\n", err)
+			os.Exit(1)
+		}
+		for _, name := range names {
+			index, err := rag.Load(*indexDirPtr, name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not load index %s: %v\n", name, err)
+				continue
+			}
+			sources := make(map[string]bool)
+			for _, chunk := range index.Chunks {
+				sources[chunk.Source] = true
+			}
+			fmt.Printf("%s\t%s\t%d sources\t%d chunks\n", name, index.EmbeddingModel, len(sources), len(index.Chunks))
+		}
+
+	case "rm":
+		if flags.NArg() == 0 && !*allPtr {
+			fmt.Fprintln(os.Stderr, "Nothing to remove: pass one or more sources, or --all to remove the whole index")
+			os.Exit(1)
+		}
+		if flags.NArg() > 0 && *allPtr {
+			fmt.Fprintln(os.Stderr, "Pass either sources or --all, not both")
+			os.Exit(1)
+		}
+		index, err := rag.Load(*indexDirPtr, *indexPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if *allPtr {
+			if err := os.Remove(filepath.Join(*indexDirPtr, *indexPtr+".json")); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not remove index %s: %v\n", *indexPtr, err)
+				os.Exit(1)
+			}
+			return
+		}
+		for _, source := range flags.Args() {
+			// stored the way add names them
+			name, err := rag.SourceName(source)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not resolve %s: %v\n", source, err)
+				os.Exit(1)
+			}
+			index.Remove(name)
+		}
+		if err := index.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not save index %s: %v\n", *indexPtr, err)
+			os.Exit(1)
+		}
+
+	default:
+		indexUsage()
+		os.Exit(1)
+	}
+}
+
+// lm ask --index name: answer stdin using the top-k chunks of an index
+func askCommand(args []string) {
+	flags := flag.NewFlagSet("ask", flag.ExitOnError)
+	modelPtr := flags.String("model", "gpt-4o", "model to use")
+	indexPtr := flags.String("index", "default", "Name of the index to retrieve context from")
+	indexDirPtr := flags.String("index-dir", defaultIndexDir(), "Directory indexes are stored in")
+	topKPtr := flags.Int("top-k", 5, "Number of chunks to include as context")
+	timeoutPtr := flags.Int("timeout", 60, "Timeout for reading stdin")
+	promptPtr := flags.String("prompt", "", "Append prompt to stdin")
+	flags.Parse(args)
+
+	model, err := models.GetModel(*modelPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get model %s: %v\n", *modelPtr, err)
+		os.Exit(1)
+	}
+
+	index, err := rag.Load(*indexDirPtr, *indexPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	question, err := readStdinWithTimeout(*timeoutPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	question += *promptPtr
+	if strings.TrimSpace(question) == "" {
+		fmt.Fprintln(os.Stderr, "No question given on stdin")
+		os.Exit(1)
+	}
+
+	results, err := index.Query(question, *topKPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not search index %s: %v\n", *indexPtr, err)
+		os.Exit(1)
+	}
+
+	query, err := model.MakeQuery(rag.BuildPrompt(question, results))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create query: %v\n", err)
+		os.Exit(1)
+	}
+
+	response, err := query.Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error querying model: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(response)
+	fmt.Println()
+	fmt.Println(rag.Citations(results))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+// readSchema takes --schema: either a path to a schema file, or the
+// schema itself if it looks like a JSON object
+func readSchema(value string) (json.RawMessage, error) {
+	var contents []byte
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		contents = []byte(value)
+	} else {
+		var err error
+		contents, err = os.ReadFile(value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not read schema %s: %v", value, err))
+		}
+	}
+	if !json.Valid(contents) {
+		return nil, errors.New(fmt.Sprintf("Schema %s is not valid JSON", value))
+	}
+	return contents, nil
+}
+
+type jsonOutput struct {
+	path    string
+	pretty  bool
+	compact bool
+}
+
+// enabled is false when the response should be printed exactly as the
+// model returned it
+func (o jsonOutput) enabled() bool {
+	return o.path != "" || o.pretty || o.compact
+}
+
+// format reformats a JSON response for printing. --jq results are
+// printed one per line, with strings unquoted so they can be used
+// directly in shell pipelines
+func (o jsonOutput) format(response string) (string, error) {
+	if !o.enabled() {
+		return response, nil
+	}
+	var value any
+	decoder := json.NewDecoder(strings.NewReader(response))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", errors.New(fmt.Sprintf("Response is not valid JSON: %v", err))
+	}
+
+	results := []any{value}
+	if o.path != "" {
+		var err error
+		results, err = utils.JSONPath(value, o.path)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	lines := make([]string, 0, len(results))
+	for _, result := range results {
+		if text, ok := result.(string); ok && o.path != "" {
+			lines = append(lines, text)
+			continue
+		}
+		line, err := o.marshal(result)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (o jsonOutput) marshal(value any) (string, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if !o.compact {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(buffer.String(), "\n"), nil
+}
+
+// printResponse writes a response (fresh or cached) to stdout
+func printResponse(response string, output jsonOutput) {
+	formatted, err := output.format(response)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not format response: %v\n", err)
+		fmt.Println(response)
+		os.Exit(1)
+	}
+	fmt.Println(formatted)
+}
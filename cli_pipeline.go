@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	pipeline "github.com/WillChangeThisLater/lm/pipeline"
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+func pipelineUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  lm pipeline run [--input name=value]... [--input-file name=path]... [--step id] file.yaml")
+}
+
+// lm pipeline run
+func pipelineCommand(args []string) {
+	if len(args) == 0 || args[0] != "run" {
+		pipelineUsage()
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("pipeline run", flag.ExitOnError)
+	flags.Usage = pipelineUsage
+	var inputs, inputFiles keyValueFlag
+	flags.Var(&inputs, "input", "Set a pipeline input (repeatable). Usage: --input name=value")
+	flags.Var(&inputFiles, "input-file", "Set a pipeline input to the contents of a file (repeatable). Usage: --input-file name=path")
+	stepPtr := flags.String("step", "", "Print this step's output instead of the pipeline's output")
+	concurrencyPtr := flags.Int("concurrency", 4, "How many steps to run at once")
+	noCachePtr := flags.Bool("no-cache", false, "Don't cache step results")
+	refreshPtr := flags.Bool("refresh", false, "Rerun every step, overwriting cached results")
+	cacheDirPtr := flags.String("cache-dir", defaultCacheDir(), "Directory the cache is stored in (or set LM_CACHE_DIR)")
+	allowShellPtr := flags.Bool("allow-shell", false, "Let templates run commands with shell()")
+	allowURLPtr := flags.Bool("allow-url", false, "Let templates fetch pages with url()")
+	verbosePtr := flags.Bool("verbose", false, "Print each step to stderr as it finishes")
+	timeoutPtr := flags.Int("timeout", 60, "Timeout for reading stdin")
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		pipelineUsage()
+		os.Exit(1)
+	}
+
+	p, err := pipeline.Load(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load pipeline: %v\n", err)
+		os.Exit(1)
+	}
+	step := p.OutputStep()
+	if *stepPtr != "" {
+		step = *stepPtr
+	}
+	if !p.HasStep(step) {
+		fmt.Fprintf(os.Stderr, "Pipeline %s has no step %s\n", p.Name, step)
+		os.Exit(1)
+	}
+
+	// --input wins over --input-file
+	pipelineInputs := make(map[string]string)
+	for _, name := range inputFiles.keys {
+		contents, err := os.ReadFile(inputFiles.values[name])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read --input-file %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		pipelineInputs[name] = string(contents)
+	}
+	for _, name := range inputs.keys {
+		pipelineInputs[name] = inputs.values[name]
+	}
+	// stdin is optional here, so only read it when something is piped in
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+		stdin, err := readStdinWithTimeout(*timeoutPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		pipelineInputs["stdin"] = stdin
+	}
+	// check inputs before running anything
+	if _, err := p.ResolveInputs(pipelineInputs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	options := pipeline.RunOptions{Refresh: *refreshPtr, Concurrency: *concurrencyPtr, AllowShell: *allowShellPtr, AllowURL: *allowURLPtr}
+	if !*noCachePtr {
+		cache, err := utils.NewCache(*cacheDirPtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error initializing cache:", err)
+			os.Exit(1)
+		}
+		defer cache.Close()
+		options.Cache = cache
+	}
+	if *verbosePtr {
+		options.OnStep = func(result pipeline.StepResult) {
+			switch {
+			case result.Err != nil:
+				fmt.Fprintf(os.Stderr, "%s: failed: %v\n", result.ID, result.Err)
+			case result.Cached:
+				fmt.Fprintf(os.Stderr, "%s: cached (%s)\n", result.ID, result.Model)
+			default:
+				fmt.Fprintf(os.Stderr, "%s: done in %s (%s)\n", result.ID, result.Duration.Round(time.Millisecond), result.Model)
+			}
+		}
+	}
+
+	result, err := p.Run(context.Background(), pipelineInputs, options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if options.Cache != nil {
+			options.Cache.Close()
+		}
+		os.Exit(1)
+	}
+	fmt.Println(result.Steps[step].Output)
+}
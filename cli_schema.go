@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	prompts "github.com/WillChangeThisLater/lm/prompts"
+)
+
+// the prompt library entry that turns a JSON sample into a schema
+const schemaInferencePrompt = "json-sample-to-schema"
+
+func schemaUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  lm schema infer [-o schema.json] [--local] [--model model] < sample.json")
+}
+
+// lm schema infer
+func schemaCommand(args []string) {
+	if len(args) == 0 || args[0] != "infer" {
+		schemaUsage()
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("schema infer", flag.ExitOnError)
+	outputPtr := flags.String("o", "", "Write the schema to this file instead of stdout")
+	localPtr := flags.Bool("local", false, "Infer the schema locally, without calling a model")
+	modelPtr := flags.String("model", "", "Model to use (defaults to the json-sample-to-schema prompt's model)")
+	timeoutPtr := flags.Int("timeout", 60, "Timeout for reading stdin")
+	flags.Parse(args[1:])
+
+	sample, err := readStdinWithTimeout(*timeoutPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !json.Valid([]byte(sample)) {
+		fmt.Fprintln(os.Stderr, "The sample on stdin is not valid JSON")
+		os.Exit(1)
+	}
+
+	var schema json.RawMessage
+	if !*localPtr {
+		schema, err = inferSchemaWithModel(sample, *modelPtr)
+		if err == nil {
+			if problems := checkInferredSchema(schema, sample); len(problems) > 0 {
+				err = fmt.Errorf("the generated schema has problems:\n  %s", strings.Join(problems, "\n  "))
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not infer schema with a model, inferring it locally instead: %v\n", err)
+			schema = nil
+		}
+	}
+
+	if schema == nil {
+		schema, err = models.InferSchema([]byte(sample))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not infer schema: %v\n", err)
+			os.Exit(1)
+		}
+		if problems := checkInferredSchema(schema, sample); len(problems) > 0 {
+			// only happens when objects in an array have different keys.
+			// strict mode always returns every key, using null for the
+			// ones that are missing
+			fmt.Fprintf(os.Stderr, "Warning: the sample does not match its strict schema exactly:\n  %s\n", strings.Join(problems, "\n  "))
+		}
+	}
+
+	var formatted bytes.Buffer
+	if err := json.Indent(&formatted, schema, "", "  "); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not format schema: %v\n", err)
+		os.Exit(1)
+	}
+	formatted.WriteString("\n")
+
+	if *outputPtr == "" {
+		fmt.Print(formatted.String())
+		return
+	}
+	if err := os.WriteFile(*outputPtr, formatted.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write %s: %v\n", *outputPtr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s (use it with --schema %s)\n", *outputPtr, *outputPtr)
+}
+
+func inferSchemaWithModel(sample string, modelName string) (json.RawMessage, error) {
+	prompt, err := prompts.GetPrompt(schemaInferencePrompt)
+	if err != nil {
+		return nil, err
+	}
+	model := prompt.Model
+	if modelName != "" {
+		if model, err = models.GetModel(modelName); err != nil {
+			return nil, err
+		}
+	}
+	query, err := prompt.MakeQuery(model, sample, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := query.Run()
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(response), nil
+}
+
+// checkInferredSchema makes sure the schema works with --schema (strict
+// mode) and that the sample it came from matches it
+func checkInferredSchema(schema json.RawMessage, sample string) []string {
+	problems := models.CheckStrictSchema(schema)
+	if len(problems) > 0 {
+		return problems
+	}
+	mismatches, err := models.ValidateJSON(&models.JSONSchema{Name: "inferred", Schema: schema}, sample)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	for _, mismatch := range mismatches {
+		problems = append(problems, "sample "+mismatch)
+	}
+	return problems
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	prompts "github.com/WillChangeThisLater/lm/prompts"
+)
+
+func templatesUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  lm templates list")
+	fmt.Fprintln(os.Stderr, "  lm templates show <name>")
+	fmt.Fprintln(os.Stderr, "Run a template with `lm run <name>` or `lm --template <name>`")
+}
+
+// lm templates list|show
+func templatesCommand(args []string) {
+	if len(args) == 0 {
+		templatesUsage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list", "ls":
+		warnPromptProblems()
+		for _, wrapper := range prompts.Wrappers() {
+			output := "text"
+			if wrapper.JSONStructured {
+				output = "json (schema)"
+			} else if wrapper.JSONUnstructured {
+				output = "json"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", wrapper.Name, output, wrapper.Source, wrapper.Description)
+		}
+
+	case "show":
+		if len(args) != 2 {
+			templatesUsage()
+			os.Exit(1)
+		}
+		prompt, err := prompts.GetPrompt(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		template, err := prompt.Template()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read template %s: %v\n", prompt.Name, err)
+			os.Exit(1)
+		}
+		schema, err := prompt.Schema()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read schema for template %s: %v\n", prompt.Name, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("name:        %s\n", prompt.Name)
+		fmt.Printf("description: %s\n", prompt.Description)
+		fmt.Printf("source:      %s (%s)\n", prompt.Source, prompt.PromptFile)
+		fmt.Printf("model:       %s\n", prompt.ModelName)
+		if len(prompt.Requires) > 0 {
+			fmt.Printf("requires:    %s\n", strings.Join(prompt.Requires, ", "))
+		}
+		fmt.Printf("json:        %v\n", prompt.ForceJSON)
+		fmt.Printf("template:    %v\n", prompt.IsTemplate)
+		if prompt.CacheTTL > 0 {
+			fmt.Printf("cache ttl:   %s\n", prompt.CacheTTL)
+		}
+		if len(prompt.Variables) > 0 {
+			fmt.Println("variables:")
+			names := make([]string, 0, len(prompt.Variables))
+			for name := range prompt.Variables {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				variable := prompt.Variables[name]
+				detail := "optional"
+				if variable.Required {
+					detail = "required"
+				} else if variable.Default != nil {
+					detail = fmt.Sprintf("default %v", variable.Default)
+				}
+				fmt.Printf("  %-16s %-20s %s\n", name, detail, variable.Description)
+			}
+		}
+		fmt.Printf("\n--- template ---\n%s\n", template)
+		if schema != nil {
+			fmt.Printf("\n--- schema ---\n%s\n", schema)
+		}
+
+	default:
+		templatesUsage()
+		os.Exit(1)
+	}
+}
+
+// warnPromptProblems points out prompts that were skipped because
+// something in them is invalid
+func warnPromptProblems() {
+	for _, problem := range prompts.LoadProblems() {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", problem)
+	}
+}
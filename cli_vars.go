@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keyValueFlag collects repeated key=value flags, like --var name=lm --var lang=go
+type keyValueFlag struct {
+	keys   []string
+	values map[string]string
+}
+
+func (f *keyValueFlag) String() string {
+	pairs := make([]string, 0, len(f.keys))
+	for _, key := range f.keys {
+		pairs = append(pairs, key+"="+f.values[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f *keyValueFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return errors.New(fmt.Sprintf("expected key=value, got %q", value))
+	}
+	if f.values == nil {
+		f.values = make(map[string]string)
+	}
+	if _, seen := f.values[key]; !seen {
+		f.keys = append(f.keys, key)
+	}
+	f.values[key] = val
+	return nil
+}
+
+// templateVariables merges --vars, --var-file and --var, in that order,
+// so the more specific flags win
+func templateVariables(varsFile string, varFiles keyValueFlag, vars keyValueFlag) (map[string]any, error) {
+	variables := make(map[string]any)
+
+	if varsFile != "" {
+		contents, err := os.ReadFile(varsFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not read %s: %v", varsFile, err))
+		}
+		if err := json.Unmarshal(contents, &variables); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s should be a JSON object: %v", varsFile, err))
+		}
+		// null unmarshals without an error, but leaves nothing to add to
+		if variables == nil {
+			return nil, errors.New(fmt.Sprintf("%s should be a JSON object, not null", varsFile))
+		}
+	}
+
+	for _, key := range varFiles.keys {
+		contents, err := os.ReadFile(varFiles.values[key])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not read --var-file %s: %v", key, err))
+		}
+		variables[key] = string(contents)
+	}
+
+	for _, key := range vars.keys {
+		variables[key] = vars.values[key]
+	}
+	return variables, nil
+}
@@ -0,0 +1,72 @@
+package compare
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	models "github.com/WillChangeThisLater/lm/models"
+)
+
+// the compare package sends the same question to several models at once
+// and collects what each one said, how long it took and what it cost
+
+// Answer is one model's response
+type Answer struct {
+	Model    string        `json:"model"`
+	Response string        `json:"response,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Latency  time.Duration `json:"latency"`
+	Usage    models.Usage  `json:"usage"`
+	// in USD. nil when the model's price isn't known
+	Cost *float64 `json:"cost,omitempty"`
+}
+
+type Options struct {
+	// sends each model's query. defaults to running it against the model
+	Send models.Sender
+}
+
+// Run asks every model at once. build makes the query for a model, since
+// what's sent (JSON mode, where the schema goes) depends on the model. the
+// answers are in the same order as the models
+func Run(ctx context.Context, modelList []*models.Model, build func(model *models.Model) (*models.Query, error), options Options) []Answer {
+	answers := make([]Answer, len(modelList))
+	var wg sync.WaitGroup
+	for i, model := range modelList {
+		wg.Add(1)
+		go func(i int, model *models.Model) {
+			defer wg.Done()
+			answers[i] = ask(ctx, model, build, options)
+		}(i, model)
+	}
+	wg.Wait()
+	return answers
+}
+
+func ask(ctx context.Context, model *models.Model, build func(model *models.Model) (*models.Query, error), options Options) Answer {
+	answer := Answer{Model: model.ModelId}
+	query, err := build(model)
+	if err != nil {
+		answer.Error = err.Error()
+		return answer
+	}
+
+	start := time.Now()
+	response, usage, err := options.Send.Run(ctx, query)
+	answer.Latency = time.Since(start)
+	answer.Response, answer.Usage = response, usage
+	if err != nil {
+		var validationErr *models.ValidationError
+		if errors.As(err, &validationErr) {
+			answer.Response = validationErr.Response
+		}
+		answer.Error = err.Error()
+	}
+	if price, ok := model.Price(); ok {
+		cost := price.Cost(usage)
+		answer.Cost = &cost
+	}
+	return answer
+}
@@ -0,0 +1,166 @@
+package compare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	models "github.com/WillChangeThisLater/lm/models"
+)
+
+func TestRun(t *testing.T) {
+	modelList := make([]*models.Model, 0)
+	for _, name := range []string{"gpt-4o", "aws-nova-pro", "gpt-4"} {
+		model, _ := models.GetModel(name)
+		modelList = append(modelList, model)
+	}
+
+	// both queries have to be in flight before either answers
+	var started sync.WaitGroup
+	started.Add(2)
+	send := func(ctx context.Context, query *models.Query) (string, models.Usage, error) {
+		started.Done()
+		done := make(chan struct{})
+		go func() {
+			started.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			return "", models.Usage{}, errors.New("the models were asked one at a time")
+		}
+		return "answer from " + query.Model().ModelId, models.Usage{InputTokens: 1000, OutputTokens: 100}, nil
+	}
+
+	build := func(model *models.Model) (*models.Query, error) {
+		if model.ModelId == "gpt-4" {
+			return nil, errors.New("Model does not support image output")
+		}
+		return model.MakeQuery("which is older?")
+	}
+	answers := Run(context.Background(), modelList, build, Options{Send: send})
+	if len(answers) != 3 || answers[0].Model != "gpt-4o" || answers[1].Model != "us.amazon.nova-pro-v1:0" {
+		t.Fatalf("Expected an answer per model in order, got %+v", answers)
+	}
+	for _, answer := range answers[:2] {
+		if answer.Error != "" || answer.Response != "answer from "+answer.Model {
+			t.Errorf("Unexpected answer %+v", answer)
+		}
+	}
+	if answers[2].Error == "" || answers[2].Response != "" {
+		t.Errorf("Expected an error for the model that can't answer, got %+v", answers[2])
+	}
+	// 1000 * $2.50/M + 100 * $10/M
+	if answers[0].Cost == nil || *answers[0].Cost < 0.00349 || *answers[0].Cost > 0.00351 {
+		t.Errorf("Expected gpt-4o to cost $0.0035, got %v", answers[0].Cost)
+	}
+}
+
+func TestReport(t *testing.T) {
+	cost := 0.0035
+	answers := []Answer{
+		{Model: "gpt-4o", Response: "The pyramid is much older than the colosseum.", Latency: 1200 * time.Millisecond, Usage: models.Usage{InputTokens: 10, OutputTokens: 9}, Cost: &cost},
+		{Model: "aws-nova-pro", Response: "Pyramid.\nBy about 2500 years.", Latency: 800 * time.Millisecond},
+		{Model: "gpt-4", Error: "Model does not support image output"},
+	}
+
+	var side bytes.Buffer
+	WriteSideBySide(&side, answers, 90)
+	lines := strings.Split(strings.TrimRight(side.String(), "\n"), "\n")
+	for _, line := range lines {
+		if len([]rune(line)) > 90 {
+			t.Errorf("Line is wider than 90 columns: %q", line)
+		}
+	}
+	if !strings.HasPrefix(lines[0], "gpt-4o") || !strings.Contains(lines[0], " | aws-nova-pro") || !strings.Contains(side.String(), "error: Model does not") {
+		t.Errorf("Unexpected side by side output:\n%s", side.String())
+	}
+	if !strings.Contains(side.String(), "$0.003500") || !strings.Contains(side.String(), "unknown") || !strings.Contains(side.String(), "1.2s") {
+		t.Errorf("Expected latency and cost in the output:\n%s", side.String())
+	}
+
+	// too narrow for columns
+	var narrow bytes.Buffer
+	WriteSideBySide(&narrow, answers, 40)
+	if !strings.HasPrefix(narrow.String(), "== gpt-4o (latency 1.2s, tokens 10 in / 9 out, cost $0.003500) ==\n") {
+		t.Errorf("Expected stacked output, got:\n%s", narrow.String())
+	}
+
+	var out bytes.Buffer
+	WriteJSON(&out, answers, nil)
+	var decoded []Answer
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded) != 3 || decoded[1].Cost != nil {
+		t.Errorf("Could not round trip the JSON output: %v", err)
+	}
+
+	if got := wrap("aaaa bbbb cccccccccc", 6); strings.Join(got, "|") != "aaaa|bbbb|cccccc|cccc" {
+		t.Errorf("Unexpected wrapping %q", got)
+	}
+}
+
+func TestVote(t *testing.T) {
+	answers := []Answer{
+		{Model: "gpt-4o", Response: `{"answer": 4}`},
+		{Model: "gpt-4", Error: "timed out"},
+		{Model: "gpt-4o-mini", Response: `{"answer": 5}`},
+		{Model: "us.amazon.nova-pro-v1:0", Response: "```json\n{\"answer\":4}\n```"},
+	}
+	verdict, err := Vote(answers)
+	if err != nil {
+		t.Fatalf("Vote failed: %v", err)
+	}
+	if verdict.Answer != `{"answer": 4}` || verdict.Votes != 2 || strings.Join(verdict.Models, ",") != "gpt-4o,us.amazon.nova-pro-v1:0" {
+		t.Errorf("Unexpected verdict %+v", verdict)
+	}
+	var out bytes.Buffer
+	WriteVerdict(&out, verdict)
+	if !strings.Contains(out.String(), "vote: 2 model(s) agreed (gpt-4o, us.amazon.nova-pro-v1:0)") {
+		t.Errorf("Unexpected verdict output %q", out.String())
+	}
+	out.Reset()
+	WriteJSON(&out, answers, verdict)
+	var decoded struct {
+		Answers []Answer `json:"answers"`
+		Verdict Verdict  `json:"verdict"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded.Answers) != 4 || decoded.Verdict.Votes != 2 {
+		t.Errorf("Expected the answers and the verdict in the JSON output, got %s", out.String())
+	}
+
+	if _, err := Vote([]Answer{{Model: "gpt-4", Error: "timed out"}}); err == nil {
+		t.Errorf("Expected an error when every model failed")
+	}
+}
+
+func TestJudge(t *testing.T) {
+	answers := []Answer{
+		{Model: "gpt-4o", Response: "Rome"},
+		{Model: "gpt-4", Error: "timed out"},
+		{Model: "gpt-4o-mini", Response: "Paris"},
+	}
+	judge, _ := models.GetModel("gpt-4o")
+	send := func(ctx context.Context, query *models.Query) (string, models.Usage, error) {
+		if strings.Contains(query.Prompt(), "timed out") {
+			return "", models.Usage{}, errors.New("failed models should not be judged")
+		}
+		return `{"choice": 2, "answer": "Paris", "rationale": "Rome is wrong"}`, models.Usage{InputTokens: 40}, nil
+	}
+	verdict, err := Judge(context.Background(), judge, "capital of france?", answers, Options{Send: send})
+	if err != nil {
+		t.Fatalf("Judge failed: %v", err)
+	}
+	if verdict.Answer != "Paris" || len(verdict.Models) != 1 || verdict.Models[0] != "gpt-4o-mini" || verdict.Usage.InputTokens != 40 {
+		t.Errorf("Unexpected verdict %+v", verdict)
+	}
+	var out bytes.Buffer
+	WriteVerdict(&out, verdict)
+	if !strings.Contains(out.String(), "judge (gpt-4o) picked gpt-4o-mini: Rome is wrong") {
+		t.Errorf("Unexpected verdict output %q", out.String())
+	}
+}
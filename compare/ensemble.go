@@ -0,0 +1,94 @@
+package compare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	models "github.com/WillChangeThisLater/lm/models"
+)
+
+// Verdict combines the models' answers into one
+type Verdict struct {
+	// vote or judge
+	Strategy string `json:"strategy"`
+	Answer   string `json:"answer"`
+	// the models that gave the winning answer. empty if the judge wrote
+	// its own
+	Models []string `json:"models"`
+	// vote only: how many models agreed
+	Votes int `json:"votes,omitempty"`
+	// judge only
+	Judge     string       `json:"judge,omitempty"`
+	Rationale string       `json:"rationale,omitempty"`
+	Usage     models.Usage `json:"usage"`
+}
+
+// answered leaves out the models that failed
+func answered(answers []Answer) []Answer {
+	result := make([]Answer, 0, len(answers))
+	for _, answer := range answers {
+		if answer.Error == "" {
+			result = append(result, answer)
+		}
+	}
+	return result
+}
+
+// Vote picks the answer most models agree on
+func Vote(answers []Answer) (*Verdict, error) {
+	candidates := answered(answers)
+	if len(candidates) == 0 {
+		return nil, errors.New("every model failed, so there's nothing to vote on")
+	}
+	responses := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		responses[i] = candidate.Response
+	}
+	winner, votes := models.MajorityVote(responses)
+	verdict := &Verdict{Strategy: "vote", Answer: winner, Votes: votes}
+	for _, candidate := range candidates {
+		if models.SameAnswer(candidate.Response, winner) {
+			verdict.Models = append(verdict.Models, candidate.Model)
+		}
+	}
+	return verdict, nil
+}
+
+// Judge has judge pick the best answer to question, or write a better one
+func Judge(ctx context.Context, judge *models.Model, question string, answers []Answer, options Options) (*Verdict, error) {
+	candidates := answered(answers)
+	if len(candidates) == 0 {
+		return nil, errors.New("every model failed, so there's nothing to judge")
+	}
+	responses := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		responses[i] = candidate.Response
+	}
+	judgement, err := models.Ensemble{Send: options.Send}.JudgeAnswers(ctx, judge, question, responses)
+	if err != nil {
+		return nil, err
+	}
+	verdict := &Verdict{Strategy: "judge", Answer: judgement.Answer, Judge: judge.ModelId, Rationale: judgement.Rationale, Usage: judgement.Usage, Models: []string{}}
+	if judgement.Choice > 0 {
+		verdict.Models = append(verdict.Models, candidates[judgement.Choice-1].Model)
+	}
+	return verdict, nil
+}
+
+// WriteVerdict prints the combined answer after the comparison
+func WriteVerdict(w io.Writer, verdict *Verdict) error {
+	var header string
+	switch {
+	case verdict.Strategy == "vote":
+		header = fmt.Sprintf("vote: %d model(s) agreed (%s)", verdict.Votes, strings.Join(verdict.Models, ", "))
+	case len(verdict.Models) == 0:
+		header = fmt.Sprintf("judge (%s) wrote its own answer: %s", verdict.Judge, verdict.Rationale)
+	default:
+		header = fmt.Sprintf("judge (%s) picked %s: %s", verdict.Judge, verdict.Models[0], verdict.Rationale)
+	}
+	_, err := fmt.Fprintf(w, "\n== %s ==\n%s\n", header, strings.TrimRight(verdict.Answer, "\n"))
+	return err
+}
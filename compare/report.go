@@ -0,0 +1,143 @@
+package compare
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// narrower than this and the answers are printed one after another
+const minColumnWidth = 24
+
+const columnSeparator = " | "
+
+func (a Answer) body() string {
+	if a.Error == "" {
+		return a.Response
+	}
+	if a.Response == "" {
+		return "error: " + a.Error
+	}
+	return a.Response + "\n\nerror: " + a.Error
+}
+
+func (a Answer) stats() []string {
+	cost := "unknown"
+	if a.Cost != nil {
+		cost = fmt.Sprintf("$%.6f", *a.Cost)
+	}
+	return []string{
+		fmt.Sprintf("latency %s", a.Latency.Round(time.Millisecond)),
+		fmt.Sprintf("tokens  %d in / %d out", a.Usage.InputTokens, a.Usage.OutputTokens),
+		fmt.Sprintf("cost    %s", cost),
+	}
+}
+
+// WriteSideBySide prints the answers in columns that fit in width, or
+// one after another if they wouldn't be readable
+func WriteSideBySide(w io.Writer, answers []Answer, width int) error {
+	if len(answers) == 0 {
+		return nil
+	}
+	columnWidth := (width - len(columnSeparator)*(len(answers)-1)) / len(answers)
+	if columnWidth < minColumnWidth {
+		return WriteStacked(w, answers)
+	}
+
+	headers := make([][]string, len(answers))
+	bodies := make([][]string, len(answers))
+	stats := make([][]string, len(answers))
+	for i, answer := range answers {
+		headers[i] = wrap(answer.Model, columnWidth)
+		bodies[i] = wrap(answer.body(), columnWidth)
+		stats[i] = wrap(strings.Join(answer.stats(), "\n"), columnWidth)
+	}
+
+	rule := make([]string, len(answers))
+	for i := range rule {
+		rule[i] = strings.Repeat("-", columnWidth)
+	}
+	ruleLine := strings.Join(rule, "-+-") + "\n"
+
+	var out strings.Builder
+	writeRows(&out, headers, columnWidth)
+	out.WriteString(ruleLine)
+	writeRows(&out, bodies, columnWidth)
+	out.WriteString(ruleLine)
+	writeRows(&out, stats, columnWidth)
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// writeRows zips the columns' lines together
+func writeRows(out *strings.Builder, columns [][]string, width int) {
+	rows := 0
+	for _, column := range columns {
+		rows = max(rows, len(column))
+	}
+	for row := 0; row < rows; row++ {
+		cells := make([]string, len(columns))
+		for i, column := range columns {
+			cell := ""
+			if row < len(column) {
+				cell = column[row]
+			}
+			cells[i] = cell + strings.Repeat(" ", width-utf8.RuneCountInString(cell))
+		}
+		out.WriteString(strings.TrimRight(strings.Join(cells, columnSeparator), " ") + "\n")
+	}
+}
+
+// WriteStacked prints each answer under a header line with its stats
+func WriteStacked(w io.Writer, answers []Answer) error {
+	var out strings.Builder
+	for i, answer := range answers {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		stats := answer.stats()
+		for j := range stats {
+			stats[j] = strings.Join(strings.Fields(stats[j]), " ")
+		}
+		fmt.Fprintf(&out, "== %s (%s) ==\n%s\n", answer.Model, strings.Join(stats, ", "), strings.TrimRight(answer.body(), "\n"))
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// WriteJSON prints the answers as a JSON array, or as an object with the
+// answers and the verdict if there is one
+func WriteJSON(w io.Writer, answers []Answer, verdict *Verdict) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if verdict == nil {
+		return encoder.Encode(answers)
+	}
+	return encoder.Encode(map[string]any{"answers": answers, "verdict": verdict})
+}
+
+// wrap breaks text into lines no wider than width, at spaces where it can
+func wrap(text string, width int) []string {
+	lines := make([]string, 0)
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\t", "    "), "\n") {
+		paragraph = strings.TrimRight(paragraph, " \r")
+		for utf8.RuneCountInString(paragraph) > width {
+			runes := []rune(paragraph)
+			cut := width
+			for i := width; i > 0; i-- {
+				if runes[i] == ' ' {
+					cut = i
+					break
+				}
+			}
+			lines = append(lines, strings.TrimRight(string(runes[:cut]), " "))
+			paragraph = strings.TrimLeft(string(runes[cut:]), " ")
+		}
+		lines = append(lines, paragraph)
+	}
+	return lines
+}
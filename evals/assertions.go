@@ -0,0 +1,132 @@
+package evals
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+// what the judge model answers with
+type judgement struct {
+	Pass   bool   `json:"pass" description:"whether the response meets every part of the rubric"`
+	Reason string `json:"reason" description:"one sentence explaining the grade"`
+}
+
+// checker holds what the assertions need besides the response
+type checker struct {
+	schema     *models.JSONSchema
+	judgeModel *models.Model
+	send       models.Sender
+}
+
+func (c *checker) judge(ctx context.Context, rubric string, response string) (judgement, error) {
+	var grade judgement
+	schema, err := models.SchemaFor[judgement]()
+	if err != nil {
+		return grade, err
+	}
+	prompt := fmt.Sprintf("Grade the response below against this rubric. It passes only if it meets every part of the rubric.\n\nRubric:\n%s\n\nResponse:\n%s", rubric, response)
+	query, err := c.judgeModel.MakeJSONQuery(prompt, schema)
+	if err != nil {
+		return grade, err
+	}
+	answer, _, err := c.send.Run(ctx, query)
+	if err != nil {
+		return grade, err
+	}
+	if err := json.Unmarshal([]byte(answer), &grade); err != nil {
+		return grade, errors.New(fmt.Sprintf("could not read the grade: %v", err))
+	}
+	return grade, nil
+}
+
+// check returns why response fails assertion, or "" if it passes. errors
+// are for problems running the check (the judge can't be reached, ...)
+func (c *checker) check(ctx context.Context, assertion Assertion, response string) (string, error) {
+	switch assertion.Type {
+	case "contains":
+		haystack, needle := response, assertion.Value
+		if assertion.IgnoreCase {
+			haystack, needle = strings.ToLower(haystack), strings.ToLower(needle)
+		}
+		if !strings.Contains(haystack, needle) {
+			return fmt.Sprintf("%s: not found", assertion), nil
+		}
+
+	case "regex":
+		pattern, err := regexp.Compile(assertion.Value)
+		if err != nil {
+			return "", err
+		}
+		if !pattern.MatchString(response) {
+			return fmt.Sprintf("%s: no match", assertion), nil
+		}
+
+	case "json_path":
+		var value any
+		if err := json.Unmarshal([]byte(response), &value); err != nil {
+			return fmt.Sprintf("%s: response is not JSON", assertion), nil
+		}
+		results, err := utils.JSONPath(value, assertion.Path)
+		if err != nil {
+			return fmt.Sprintf("%s: %v", assertion, err), nil
+		}
+		var got any = results
+		if len(results) == 1 {
+			got = results[0]
+		}
+		if assertion.Equals == nil {
+			if got == nil {
+				return fmt.Sprintf("%s: is null", assertion), nil
+			}
+			return "", nil
+		}
+		var want any
+		if err := json.Unmarshal(assertion.Equals, &want); err != nil {
+			return "", errors.New(fmt.Sprintf("%s: equals is not valid JSON: %v", assertion.Path, err))
+		}
+		if !reflect.DeepEqual(got, want) {
+			gotJSON, _ := json.Marshal(got)
+			return fmt.Sprintf("%s: got %s", assertion, gotJSON), nil
+		}
+
+	case "schema":
+		schema := c.schema
+		if assertion.Schema != nil {
+			schema = &models.JSONSchema{Name: "assertion", Schema: assertion.Schema}
+		}
+		if schema == nil {
+			return "", errors.New("schema assertion without a schema, and the prompt has no schema.json")
+		}
+		problems, err := models.ValidateJSON(schema, response)
+		if err != nil {
+			return "", err
+		}
+		if len(problems) > 0 {
+			return fmt.Sprintf("schema: %s", strings.Join(problems, "; ")), nil
+		}
+
+	case "judge":
+		if c.judgeModel == nil {
+			return "", errors.New("no judge model")
+		}
+		grade, err := c.judge(ctx, assertion.Rubric, response)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("judge: %v", err))
+		}
+		if !grade.Pass {
+			return fmt.Sprintf("%s: %s", assertion, grade.Reason), nil
+		}
+
+	default:
+		return "", errors.New(fmt.Sprintf("unknown assertion type %q", assertion.Type))
+	}
+	return "", nil
+}
@@ -0,0 +1,148 @@
+package evals
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"strings"
+
+	prompts "github.com/WillChangeThisLater/lm/prompts"
+)
+
+// test cases live in tests.jsonl next to the prompt, one case per line:
+//
+//	{"name": "praise", "input": "I loved it", "assert": [{"type": "json_path", "path": ".sentiment", "equals": "great"}]}
+//	{"input": "meh", "variables": {"tone": "terse"}, "images": ["cat.png"], "assert": [{"type": "judge", "rubric": "is polite"}]}
+//
+// blank lines and lines starting with # are ignored
+const CasesFile = "tests.jsonl"
+
+type Case struct {
+	// defaults to the line number
+	Name      string         `json:"name"`
+	Input     string         `json:"input"`
+	Variables map[string]any `json:"variables"`
+	// image URLs, or files next to the prompt
+	Images []string    `json:"images"`
+	Assert []Assertion `json:"assert"`
+}
+
+// Assertion is one check on a response. which fields matter depends on
+// the type:
+//
+//	contains   value (ignore_case to match case insensitively)
+//	regex      value
+//	json_path  path, and equals if the value matters (otherwise it must not be null)
+//	schema     schema, or the prompt's own schema.json
+//	judge      rubric, graded pass/fail by the judge model
+type Assertion struct {
+	Type       string          `json:"type"`
+	Value      string          `json:"value,omitempty"`
+	IgnoreCase bool            `json:"ignore_case,omitempty"`
+	Path       string          `json:"path,omitempty"`
+	Equals     json.RawMessage `json:"equals,omitempty"`
+	Schema     json.RawMessage `json:"schema,omitempty"`
+	Rubric     string          `json:"rubric,omitempty"`
+}
+
+func (a Assertion) String() string {
+	switch a.Type {
+	case "contains", "regex":
+		return fmt.Sprintf("%s %q", a.Type, a.Value)
+	case "json_path":
+		if a.Equals != nil {
+			return fmt.Sprintf("%s == %s", a.Path, a.Equals)
+		}
+		return a.Path
+	case "judge":
+		return fmt.Sprintf("judge %q", a.Rubric)
+	}
+	return a.Type
+}
+
+func (a Assertion) validate() error {
+	switch a.Type {
+	case "contains":
+		if a.Value == "" {
+			return errors.New("contains needs a value")
+		}
+	case "regex":
+		if _, err := regexp.Compile(a.Value); err != nil {
+			return errors.New(fmt.Sprintf("invalid regex: %v", err))
+		}
+	case "json_path":
+		if a.Path == "" {
+			return errors.New("json_path needs a path")
+		}
+	case "schema":
+	case "judge":
+		if a.Rubric == "" {
+			return errors.New("judge needs a rubric")
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown assertion type %q (valid types are contains, regex, json_path, schema and judge)", a.Type))
+	}
+	return nil
+}
+
+// ParseCases reads cases in the tests.jsonl format
+func ParseCases(r io.Reader) ([]Case, error) {
+	cases := make([]Case, 0)
+	names := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var c Case
+		decoder := json.NewDecoder(bytes.NewReader([]byte(text)))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&c); err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %v", line, err))
+		}
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("line %d", line)
+		}
+		if previous, ok := names[c.Name]; ok {
+			return nil, errors.New(fmt.Sprintf("line %d: case %q is already used on line %d", line, c.Name, previous))
+		}
+		names[c.Name] = line
+		if len(c.Assert) == 0 {
+			return nil, errors.New(fmt.Sprintf("line %d: case %q has no assertions", line, c.Name))
+		}
+		for _, assertion := range c.Assert {
+			if err := assertion.validate(); err != nil {
+				return nil, errors.New(fmt.Sprintf("line %d: %v", line, err))
+			}
+		}
+		cases = append(cases, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cases, nil
+}
+
+// LoadCases reads the tests.jsonl that sits next to prompt
+func LoadCases(prompt *prompts.Prompt) ([]Case, error) {
+	contents, err := prompt.ReadFile(CasesFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.New(fmt.Sprintf("prompt %s has no %s", prompt.Name, CasesFile))
+	}
+	if err != nil {
+		return nil, err
+	}
+	cases, err := ParseCases(bytes.NewReader(contents))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s for prompt %s: %v", CasesFile, prompt.Name, err))
+	}
+	return cases, nil
+}
@@ -0,0 +1,184 @@
+package evals
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	prompts "github.com/WillChangeThisLater/lm/prompts"
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+// the evals package runs a prompt's test cases (see cases.go) against
+// one or more models and grades the responses. results are kept so the
+// next run can say what changed (see report.go)
+
+const (
+	defaultConcurrency = 4
+	defaultJudgeModel  = "gpt-4o-mini"
+)
+
+type Options struct {
+	// defaults to the prompt's own model
+	Models []*models.Model
+	// how many cases run at once. defaults to 4
+	Concurrency int
+	// grades judge assertions. defaults to gpt-4o-mini
+	JudgeModel *models.Model
+	// extra variables for every case. the case's own variables win
+	Variables map[string]any
+	// sends every query, the judge's included. defaults to running it
+	// against its model
+	Send models.Sender
+}
+
+// Result is one case run against one model
+type Result struct {
+	Case   string `json:"case"`
+	Model  string `json:"model"`
+	Passed bool   `json:"passed"`
+	// the assertions that failed
+	Failures []string `json:"failures,omitempty"`
+	// set when the case couldn't be run or graded at all
+	Error    string        `json:"error,omitempty"`
+	Response string        `json:"response,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Status is pass, FAIL or error
+func (r Result) Status() string {
+	switch {
+	case r.Error != "":
+		return "error"
+	case r.Passed:
+		return "pass"
+	}
+	return "FAIL"
+}
+
+type Run struct {
+	Prompt  string    `json:"prompt"`
+	Started time.Time `json:"started"`
+	Models  []string  `json:"models"`
+	Cases   []string  `json:"cases"`
+	// every case for the first model, then every case for the second, ...
+	Results []Result `json:"results"`
+}
+
+// Evaluate runs every case against every model
+func Evaluate(ctx context.Context, prompt *prompts.Prompt, cases []Case, options Options) (*Run, error) {
+	if len(cases) == 0 {
+		return nil, errors.New(fmt.Sprintf("prompt %s has no test cases", prompt.Name))
+	}
+	evalModels := options.Models
+	if len(evalModels) == 0 {
+		evalModels = []*models.Model{prompt.Model}
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	judgeModel := options.JudgeModel
+	if judgeModel == nil && needsJudge(cases) {
+		var err error
+		if judgeModel, err = models.GetModel(defaultJudgeModel); err != nil {
+			return nil, err
+		}
+	}
+
+	schema, err := prompt.Schema()
+	if err != nil {
+		return nil, err
+	}
+	checks := &checker{judgeModel: judgeModel, send: options.Send}
+	if schema != nil {
+		checks.schema = &models.JSONSchema{Name: "json_schema", Schema: schema}
+	}
+
+	run := &Run{Prompt: prompt.Name, Started: time.Now()}
+	for _, model := range evalModels {
+		run.Models = append(run.Models, model.ModelId)
+	}
+	for _, c := range cases {
+		run.Cases = append(run.Cases, c.Name)
+	}
+
+	run.Results = make([]Result, len(evalModels)*len(cases))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, model := range evalModels {
+		for j, c := range cases {
+			wg.Add(1)
+			go func(index int, model *models.Model, c Case) {
+				defer wg.Done()
+				slots <- struct{}{}
+				defer func() { <-slots }()
+				run.Results[index] = runCase(ctx, prompt, model, c, options.Variables, checks)
+			}(i*len(cases)+j, model, c)
+		}
+	}
+	wg.Wait()
+	return run, nil
+}
+
+func needsJudge(cases []Case) bool {
+	for _, c := range cases {
+		for _, assertion := range c.Assert {
+			if assertion.Type == "judge" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func runCase(ctx context.Context, prompt *prompts.Prompt, model *models.Model, c Case, baseVars map[string]any, checks *checker) (result Result) {
+	result = Result{Case: c.Name, Model: model.ModelId}
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+
+	vars := make(map[string]any, len(baseVars)+len(c.Variables))
+	for name, value := range baseVars {
+		vars[name] = value
+	}
+	for name, value := range c.Variables {
+		vars[name] = value
+	}
+	images, err := utils.LoadImages(c.Images, prompt.ReadFile)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	query, err := prompt.MakeQuery(model, c.Input, vars, images...)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	response, _, err := checks.send.Run(ctx, query)
+	if err != nil {
+		var validationErr *models.ValidationError
+		if !errors.As(err, &validationErr) {
+			result.Error = err.Error()
+			return result
+		}
+		// still grade it; the schema assertion will say what's wrong
+		response = validationErr.Response
+	}
+	result.Response = response
+
+	for _, assertion := range c.Assert {
+		failure, err := checks.check(ctx, assertion, response)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if failure != "" {
+			result.Failures = append(result.Failures, failure)
+		}
+	}
+	result.Passed = len(result.Failures) == 0
+	return result
+}
@@ -0,0 +1,285 @@
+package evals
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	prompts "github.com/WillChangeThisLater/lm/prompts"
+)
+
+func TestParseCases(t *testing.T) {
+	input := `
+# comments and blank lines are skipped
+{"name": "a", "input": "hi", "assert": [{"type": "contains", "value": "hello"}]}
+
+{"input": "unnamed", "assert": [{"type": "schema"}]}
+`
+	cases, err := ParseCases(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Could not parse cases: %v", err)
+	}
+	if len(cases) != 2 || cases[0].Name != "a" || cases[1].Name != "line 5" {
+		t.Errorf("Unexpected cases %+v", cases)
+	}
+
+	bad := map[string]string{
+		"no assertions":  `{"input": "x"}`,
+		"unknown type":   `{"input": "x", "assert": [{"type": "vibes"}]}`,
+		"unknown field":  `{"input": "x", "expected": "y", "assert": [{"type": "schema"}]}`,
+		"bad regex":      `{"input": "x", "assert": [{"type": "regex", "value": "("}]}`,
+		"no rubric":      `{"input": "x", "assert": [{"type": "judge"}]}`,
+		"duplicate name": `{"name": "a", "assert": [{"type": "schema"}]}` + "\n" + `{"name": "a", "assert": [{"type": "schema"}]}`,
+	}
+	for name, input := range bad {
+		if _, err := ParseCases(strings.NewReader(input)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	// the judge passes anything polite
+	judgeModel, _ := models.GetModel("gpt-4o-mini")
+	send := func(ctx context.Context, query *models.Query) (string, models.Usage, error) {
+		if !strings.HasPrefix(query.Prompt(), "Grade the response") || query.Model().ModelId != judgeModel.ModelId {
+			return "", models.Usage{}, errors.New("expected a query for the judge")
+		}
+		if strings.Contains(query.Prompt(), "please") {
+			return `{"pass": true, "reason": "polite"}`, models.Usage{}, nil
+		}
+		return `{"pass": false, "reason": "not polite"}`, models.Usage{}, nil
+	}
+
+	schema := &models.JSONSchema{Name: "s", Schema: []byte(`{"type": "object", "properties": {"n": {"type": "integer"}}, "required": ["n"]}`)}
+	checks := &checker{schema: schema, judgeModel: judgeModel, send: send}
+	tests := []struct {
+		assertion Assertion
+		response  string
+		pass      bool
+	}{
+		{Assertion{Type: "contains", Value: "Paris"}, "It's Paris.", true},
+		{Assertion{Type: "contains", Value: "paris"}, "It's Paris.", false},
+		{Assertion{Type: "contains", Value: "paris", IgnoreCase: true}, "It's Paris.", true},
+		{Assertion{Type: "regex", Value: `^\d+$`}, "42", true},
+		{Assertion{Type: "regex", Value: `^\d+$`}, "forty two", false},
+		{Assertion{Type: "json_path", Path: ".n", Equals: []byte(`2`)}, `{"n": 2}`, true},
+		{Assertion{Type: "json_path", Path: ".n", Equals: []byte(`3`)}, `{"n": 2}`, false},
+		{Assertion{Type: "json_path", Path: ".items[].id", Equals: []byte(`["a", "b"]`)}, `{"items": [{"id": "a"}, {"id": "b"}]}`, true},
+		{Assertion{Type: "json_path", Path: ".missing"}, `{"n": 2}`, false},
+		{Assertion{Type: "json_path", Path: ".n"}, `not json`, false},
+		{Assertion{Type: "schema"}, `{"n": 2}`, true},
+		{Assertion{Type: "schema"}, `{"n": "two"}`, false},
+		{Assertion{Type: "schema", Schema: []byte(`{"type": "array"}`)}, `[]`, true},
+		{Assertion{Type: "judge", Rubric: "is polite"}, "pass the salt please", true},
+		{Assertion{Type: "judge", Rubric: "is polite"}, "salt. now.", false},
+	}
+	for _, test := range tests {
+		failure, err := checks.check(context.Background(), test.assertion, test.response)
+		if err != nil {
+			t.Errorf("%s on %q: unexpected error %v", test.assertion, test.response, err)
+			continue
+		}
+		if (failure == "") != test.pass {
+			t.Errorf("%s on %q: expected pass=%v, got failure %q", test.assertion, test.response, test.pass, failure)
+		}
+	}
+
+	if _, err := (&checker{}).check(context.Background(), Assertion{Type: "schema"}, `{}`); err == nil {
+		t.Errorf("A schema assertion with no schema anywhere should be an error")
+	}
+}
+
+// the tests load their prompts from a user prompt directory
+func TestMain(m *testing.M) {
+	config, err := os.MkdirTemp("", "lm-evals")
+	if err != nil {
+		panic(err)
+	}
+	library := map[string]map[string]string{
+		"eval-review": {
+			"prompt":        "Review: {{ text }}",
+			"settings.json": `{"structured_json": true}`,
+			"schema.json":   `{"type": "object", "properties": {"sentiment": {"type": "string"}}, "required": ["sentiment"], "additionalProperties": false}`,
+			"tests.jsonl": `{"name": "good", "input": "loved it", "assert": [{"type": "json_path", "path": ".sentiment", "equals": "good"}]}
+{"name": "bad", "input": "hated it", "assert": [{"type": "schema"}, {"type": "contains", "value": "bad"}]}`,
+		},
+		"eval-fewshot": {
+			"prompt":      "{{ examples }}\nAnswer: {{ text }}",
+			"tests.jsonl": `{"input": "2 + 2", "assert": [{"type": "contains", "value": "4"}]}`,
+		},
+	}
+	for name, files := range library {
+		dir := filepath.Join(config, "lm", "prompts", name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			panic(err)
+		}
+		for file, contents := range files {
+			if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+				panic(err)
+			}
+		}
+	}
+	os.Setenv("XDG_CONFIG_HOME", config)
+	code := m.Run()
+	os.RemoveAll(config)
+	os.Exit(code)
+}
+
+func TestEvaluate(t *testing.T) {
+	prompt, err := prompts.GetPrompt("eval-review")
+	if err != nil {
+		t.Fatalf("Could not get prompt: %v", err)
+	}
+	cases, err := LoadCases(prompt)
+	if err != nil {
+		t.Fatalf("Could not load cases: %v", err)
+	}
+
+	// gpt-4o-mini gets everything right; nova pro always says good
+	send := func(ctx context.Context, query *models.Query) (string, models.Usage, error) {
+		if query.Model().ModelId == "us.amazon.nova-pro-v1:0" {
+			return `{"sentiment": "good"}`, models.Usage{}, nil
+		}
+		if query.Model().ModelId == "us.amazon.nova-lite-v1:0" {
+			return "", models.Usage{}, errors.New("rate limited")
+		}
+		if strings.Contains(query.Prompt(), "hated") {
+			return `{"sentiment": "bad"}`, models.Usage{}, nil
+		}
+		return `{"sentiment": "good"}`, models.Usage{}, nil
+	}
+
+	mini, _ := models.GetModel("gpt-4o-mini")
+	pro, _ := models.GetModel("aws-nova-pro")
+	run, err := Evaluate(context.Background(), prompt, cases, Options{Models: []*models.Model{mini, pro}, Concurrency: 2, Send: send})
+	if err != nil {
+		t.Fatalf("Could not evaluate: %v", err)
+	}
+	if rate := run.PassRate("gpt-4o-mini"); rate != 1 {
+		t.Errorf("Expected gpt-4o-mini to pass everything, got %v", rate)
+	}
+	if rate := run.PassRate("us.amazon.nova-pro-v1:0"); rate != 0.5 {
+		t.Errorf("Expected nova pro to pass half the cases, got %v", rate)
+	}
+	if run.Passed() {
+		t.Errorf("The run should not pass when a case fails")
+	}
+
+	var matrix strings.Builder
+	run.WriteMatrix(&matrix)
+	for _, want := range []string{"gpt-4o-mini", "2/2 (100%)", "1/2 (50%)", "us.amazon.nova-pro-v1:0 / bad:", `contains "bad": not found`} {
+		if !strings.Contains(matrix.String(), want) {
+			t.Errorf("Expected %q in the matrix:\n%s", want, matrix.String())
+		}
+	}
+
+	dir := t.TempDir()
+	if previous, err := LastRun(dir, prompt.Name); err != nil || previous != nil {
+		t.Fatalf("There should be no last run yet, got %v (%v)", previous, err)
+	}
+	if err := SaveRun(dir, run); err != nil {
+		t.Fatalf("Could not save run: %v", err)
+	}
+	previous, err := LastRun(dir, prompt.Name)
+	if err != nil || previous == nil {
+		t.Fatalf("Could not load the last run: %v", err)
+	}
+
+	// nova lite wasn't in the last run, so only nova pro gets compared
+	lite, _ := models.GetModel("aws-nova-lite")
+	next, err := Evaluate(context.Background(), prompt, cases, Options{Models: []*models.Model{lite, pro}, Send: send})
+	if err != nil {
+		t.Fatalf("Could not evaluate: %v", err)
+	}
+	if result, _ := next.Result("good", "us.amazon.nova-lite-v1:0"); result.Status() != "error" || result.Error != "rate limited" {
+		t.Errorf("Expected the query error in the result, got %+v", result)
+	}
+	changes := Diff(previous, next)
+	if len(changes) != 0 {
+		t.Errorf("Nothing changed for the models both runs used, got %+v", changes)
+	}
+	if len(Diff(previous, previous)) != 0 {
+		t.Errorf("A run should not differ from itself")
+	}
+	previous.Results[0].Passed = false
+	changes = Diff(previous, run)
+	if len(changes) != 1 || changes[0].Before != "FAIL" || changes[0].After != "pass" {
+		t.Errorf("Expected one FAIL -> pass change, got %+v", changes)
+	}
+	var diff strings.Builder
+	WriteDiff(&diff, previous, run)
+	if !strings.Contains(diff.String(), "gpt-4o-mini: 50% -> 100% (+50)") {
+		t.Errorf("Expected the pass rate change in the diff:\n%s", diff.String())
+	}
+}
+
+func TestFewShot(t *testing.T) {
+	prompt, err := prompts.GetPrompt("eval-fewshot")
+	if err != nil {
+		t.Fatalf("Could not get prompt: %v", err)
+	}
+	cases, err := LoadCases(prompt)
+	if err != nil {
+		t.Fatalf("Could not load cases: %v", err)
+	}
+
+	// the model only gets it right with examples, and only the second
+	// set of examples is any good
+	var mutex sync.Mutex
+	var request string
+	generated := 0
+	send := func(ctx context.Context, query *models.Query) (string, models.Usage, error) {
+		prompt := query.Prompt()
+		if strings.HasPrefix(prompt, "Write 2 realistic") {
+			mutex.Lock()
+			defer mutex.Unlock()
+			request = prompt
+			generated++
+			if generated == 2 {
+				return `{"examples": [{"input": "1 + 3", "output": "4"}, {"input": "3 + 3", "output": "6"}]}`, models.Usage{}, nil
+			}
+			return `{"examples": [{"input": "1 + 1", "output": "2"}]}`, models.Usage{}, nil
+		}
+		if strings.Contains(prompt, "Output:\n4") {
+			return "4", models.Usage{}, nil
+		}
+		return "five", models.Usage{}, nil
+	}
+
+	baseline, variants, err := FewShot(context.Background(), prompt, cases, FewShotOptions{Options: Options{Send: send}, Variants: 3})
+	if err != nil {
+		t.Fatalf("Could not run fewshot: %v", err)
+	}
+	if baseline.Score != 0 || len(variants) != 3 {
+		t.Fatalf("Expected a failing baseline and 3 variants, got %v and %d", baseline.Score, len(variants))
+	}
+	if variants[0].Score != 0 || variants[1].Score != 1 {
+		t.Errorf("Only the second variant should pass, got %v and %v", variants[0].Score, variants[1].Score)
+	}
+	if !strings.HasPrefix(variants[1].Examples, "Example 1\nInput:\n1 + 3\n\nOutput:\n4\n") {
+		t.Errorf("Unexpected examples format:\n%s", variants[1].Examples)
+	}
+	if !strings.Contains(request, "- 2 + 2") {
+		t.Errorf("The generator should be told not to reuse test inputs:\n%s", request)
+	}
+
+	file, err := prompt.WriteExamples(variants[1].Examples)
+	if err != nil {
+		t.Fatalf("Could not write examples: %v", err)
+	}
+	reloaded, _ := prompts.GetPrompt("eval-fewshot")
+	if reloaded.Examples != variants[1].Examples {
+		t.Errorf("Examples written to %s were not picked up", file)
+	}
+
+	review, _ := prompts.GetPrompt("eval-review")
+	if _, _, err := FewShot(context.Background(), review, cases, FewShotOptions{}); err == nil {
+		t.Errorf("Prompts without {{ examples }} can't be tuned")
+	}
+}
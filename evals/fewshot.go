@@ -0,0 +1,182 @@
+package evals
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	prompts "github.com/WillChangeThisLater/lm/prompts"
+)
+
+// few-shot tuning: a model writes a few sets of examples for a prompt,
+// each set goes into the template as {{ examples }}, and every variant
+// is scored against the prompt's test cases. the caller keeps the best
+// one only if it beats the prompt as it is
+
+type FewShotOptions struct {
+	// for scoring the variants. its Send writes the examples too
+	Options
+	// writes the candidate examples. defaults to gpt-4o
+	Generator *models.Model
+	// examples per variant. defaults to 2
+	Shots int
+	// how many sets of examples to try. defaults to 3
+	Variants int
+}
+
+// Variant is one set of examples and how the prompt scored with it
+type Variant struct {
+	Examples string
+	Run      *Run
+	Score    float64
+}
+
+type example struct {
+	Input  string `json:"input" description:"what the user would send"`
+	Output string `json:"output" description:"the ideal response to the input, exactly as the assistant should write it"`
+}
+
+type exampleSet struct {
+	Examples []example `json:"examples"`
+}
+
+func generateExamples(ctx context.Context, model *models.Model, request string, options Options) ([]example, error) {
+	schema, err := models.SchemaFor[exampleSet]()
+	if err != nil {
+		return nil, err
+	}
+	query, err := model.MakeJSONQuery(request, schema)
+	if err != nil {
+		return nil, err
+	}
+	// variety is the point
+	temperature := 1.0
+	query.SetOptions(models.GenerationOptions{Temperature: &temperature})
+	response, _, err := options.Send.Run(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var set exampleSet
+	if err := json.Unmarshal([]byte(response), &set); err != nil {
+		return nil, err
+	}
+	return set.Examples, nil
+}
+
+// MeanPassRate averages the pass rate of every model in the run
+func (r *Run) MeanPassRate() float64 {
+	if len(r.Models) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, model := range r.Models {
+		total += r.PassRate(model)
+	}
+	return total / float64(len(r.Models))
+}
+
+// FewShot scores the prompt as it is, then with each generated set of
+// examples
+func FewShot(ctx context.Context, prompt *prompts.Prompt, cases []Case, options FewShotOptions) (Variant, []Variant, error) {
+	var baseline Variant
+	if uses, err := prompt.UsesExamples(); err != nil {
+		return baseline, nil, err
+	} else if !uses {
+		return baseline, nil, errors.New(fmt.Sprintf("prompt %s doesn't use {{ examples }}, so there's nowhere to put them", prompt.Name))
+	}
+	generator := options.Generator
+	if generator == nil {
+		var err error
+		if generator, err = models.GetModel("gpt-4o"); err != nil {
+			return baseline, nil, err
+		}
+	}
+	shots := options.Shots
+	if shots <= 0 {
+		shots = 2
+	}
+	variantCount := options.Variants
+	if variantCount <= 0 {
+		variantCount = 3
+	}
+
+	baseline, err := scoreExamples(ctx, prompt, prompt.Examples, cases, options.Options)
+	if err != nil {
+		return baseline, nil, err
+	}
+
+	request, err := examplesRequest(prompt, cases, shots)
+	if err != nil {
+		return baseline, nil, err
+	}
+	variants := make([]Variant, 0, variantCount)
+	for i := 0; i < variantCount; i++ {
+		generated, err := generateExamples(ctx, generator, request, options.Options)
+		if err != nil {
+			return baseline, nil, errors.New(fmt.Sprintf("could not generate examples: %v", err))
+		}
+		variant, err := scoreExamples(ctx, prompt, formatExamples(generated), cases, options.Options)
+		if err != nil {
+			return baseline, nil, err
+		}
+		variants = append(variants, variant)
+	}
+	return baseline, variants, nil
+}
+
+func scoreExamples(ctx context.Context, prompt *prompts.Prompt, examples string, cases []Case, options Options) (Variant, error) {
+	withExamples := *prompt
+	withExamples.Examples = examples
+	run, err := Evaluate(ctx, &withExamples, cases, options)
+	if err != nil {
+		return Variant{}, err
+	}
+	return Variant{Examples: examples, Run: run, Score: run.MeanPassRate()}, nil
+}
+
+// formatExamples is how examples look in the template
+func formatExamples(examples []example) string {
+	var result strings.Builder
+	for i, e := range examples {
+		if i > 0 {
+			result.WriteString("\n")
+		}
+		fmt.Fprintf(&result, "Example %d\nInput:\n%s\n\nOutput:\n%s\n", i+1, strings.TrimSpace(e.Input), strings.TrimSpace(e.Output))
+	}
+	return result.String()
+}
+
+// examplesRequest asks for examples without showing the test cases'
+// expected results, and without letting the generator reuse their
+// inputs (that would only measure memorization)
+func examplesRequest(prompt *prompts.Prompt, cases []Case, shots int) (string, error) {
+	template, err := prompt.Template()
+	if err != nil {
+		return "", err
+	}
+	schema, err := prompt.Schema()
+	if err != nil {
+		return "", err
+	}
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "Write %d realistic, varied examples of an input and the ideal response for the prompt template below. ", shots)
+	request.WriteString("The input is what gets substituted for {{ text }}. The examples will be shown to the model in place of {{ examples }}, so they should teach it what a great answer looks like, including tricky cases.\n\n")
+	request.WriteString("Prompt template:\n" + template + "\n")
+	if prompt.Description != "" {
+		request.WriteString("\nWhat the prompt is for: " + prompt.Description + "\n")
+	}
+	if schema != nil {
+		request.WriteString("\nEvery response must be JSON matching this schema:\n" + string(schema) + "\n")
+	}
+	if len(cases) > 0 {
+		request.WriteString("\nDo not use any of these inputs, or anything close to them:\n")
+		for _, c := range cases {
+			request.WriteString("- " + strings.ReplaceAll(strings.TrimSpace(c.Input), "\n", " ") + "\n")
+		}
+	}
+	return request.String(), nil
+}
@@ -0,0 +1,163 @@
+package evals
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// Result returns the result for a case and model, if the run has one
+func (r *Run) Result(caseName string, model string) (Result, bool) {
+	for _, result := range r.Results {
+		if result.Case == caseName && result.Model == model {
+			return result, true
+		}
+	}
+	return Result{}, false
+}
+
+// PassRate is the fraction of cases model passed
+func (r *Run) PassRate(model string) float64 {
+	passed, total := r.counts(model)
+	if total == 0 {
+		return 0
+	}
+	return float64(passed) / float64(total)
+}
+
+func (r *Run) counts(model string) (passed int, total int) {
+	for _, result := range r.Results {
+		if result.Model != model {
+			continue
+		}
+		total++
+		if result.Passed {
+			passed++
+		}
+	}
+	return passed, total
+}
+
+// Passed is true when every case passed on every model
+func (r *Run) Passed() bool {
+	for _, result := range r.Results {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteMatrix writes a case x model table of results, the pass rate for
+// each model, and what went wrong with every case that didn't pass
+func (r *Run) WriteMatrix(w io.Writer) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "case\t%s\n", strings.Join(r.Models, "\t"))
+	for _, caseName := range r.Cases {
+		row := []string{caseName}
+		for _, model := range r.Models {
+			result, _ := r.Result(caseName, model)
+			row = append(row, result.Status())
+		}
+		fmt.Fprintln(table, strings.Join(row, "\t"))
+	}
+	row := []string{"pass rate"}
+	for _, model := range r.Models {
+		passed, total := r.counts(model)
+		row = append(row, fmt.Sprintf("%d/%d (%.0f%%)", passed, total, 100*r.PassRate(model)))
+	}
+	fmt.Fprintln(table, strings.Join(row, "\t"))
+	table.Flush()
+
+	for _, result := range r.Results {
+		if result.Passed {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s / %s:\n", result.Model, result.Case)
+		if result.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", result.Error)
+		}
+		for _, failure := range result.Failures {
+			fmt.Fprintf(w, "  %s\n", failure)
+		}
+	}
+}
+
+// Change is a case whose result differs from the previous run
+type Change struct {
+	Case   string
+	Model  string
+	Before string
+	After  string
+}
+
+// Diff compares the cases and models the two runs have in common
+func Diff(previous *Run, current *Run) []Change {
+	changes := make([]Change, 0)
+	for _, result := range current.Results {
+		before, ok := previous.Result(result.Case, result.Model)
+		if !ok || before.Status() == result.Status() {
+			continue
+		}
+		changes = append(changes, Change{Case: result.Case, Model: result.Model, Before: before.Status(), After: result.Status()})
+	}
+	return changes
+}
+
+// WriteDiff writes how current differs from previous: pass rates for
+// the models both runs used, then every case that changed
+func WriteDiff(w io.Writer, previous *Run, current *Run) {
+	fmt.Fprintf(w, "since the last run (%s):\n", previous.Started.Format("2006-01-02 15:04"))
+	for _, model := range current.Models {
+		if _, total := previous.counts(model); total == 0 {
+			continue
+		}
+		before, after := 100*previous.PassRate(model), 100*current.PassRate(model)
+		fmt.Fprintf(w, "  %s: %.0f%% -> %.0f%% (%+.0f)\n", model, before, after, after-before)
+	}
+	changes := Diff(previous, current)
+	for _, change := range changes {
+		fmt.Fprintf(w, "  %s / %s: %s -> %s\n", change.Model, change.Case, change.Before, change.After)
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "  no cases changed")
+	}
+}
+
+func runFile(dir string, promptName string) string {
+	return filepath.Join(dir, strings.ReplaceAll(promptName, string(filepath.Separator), "-")+".json")
+}
+
+// SaveRun stores run as the latest run of its prompt
+func SaveRun(dir string, run *Run) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(runFile(dir, run.Prompt), contents, 0644)
+}
+
+// LastRun returns the last saved run of a prompt, or nil if there isn't one
+func LastRun(dir string, promptName string) (*Run, error) {
+	contents, err := os.ReadFile(runFile(dir, promptName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var run Run
+	if err := json.Unmarshal(contents, &run); err != nil {
+		return nil, errors.New(fmt.Sprintf("could not read last run of %s: %v", promptName, err))
+	}
+	return &run, nil
+}
@@ -0,0 +1,21 @@
+// Package replaytest points a test binary at its recorded provider
+// traffic (see models/replay.go). it's only imported from tests
+package replaytest
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Setup replays the recordings in dir, if there are any and neither
+// LM_RECORD nor LM_REPLAY is set. call it from TestMain, before anything
+// is sent. it returns false if nothing can answer provider requests (no
+// recordings and no OPENAI_API_KEY), so tests that need them can be skipped
+func Setup(dir string) bool {
+	if os.Getenv("LM_RECORD") == "" && os.Getenv("LM_REPLAY") == "" {
+		if recordings, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(recordings) > 0 {
+			os.Setenv("LM_REPLAY", dir)
+		}
+	}
+	return os.Getenv("LM_REPLAY") != "" || os.Getenv("OPENAI_API_KEY") != ""
+}
@@ -0,0 +1,174 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// the batch APIs take request bodies in a file instead of over HTTP, so
+// queries can be turned into those bodies and the responses read back.
+// JSON responses from a batch aren't validated or repaired
+
+// ChatRequestBody is the chat completions request Run would send, for
+// OpenAI's batch API. requests that are too long come back as errors in
+// the batch's results instead of being caught here
+func (q *Query) ChatRequestBody() (json.RawMessage, error) {
+	if q.model.Provider == "aws" {
+		return nil, errors.New(fmt.Sprintf("model %s is not an OpenAI-compatible model", q.model.ModelId))
+	}
+	request, err := q.toRequest()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(request)
+}
+
+// ParseChatResponse reads a chat completions response body
+func ParseChatResponse(body []byte) (string, Usage, error) {
+	var parsed response
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", Usage{}, err
+	}
+	if parsed.Error.Message != "" {
+		return "", Usage{}, errors.New(parsed.Error.Message)
+	}
+	if len(parsed.Choices) == 0 {
+		return "", Usage{}, errors.New("response has no choices")
+	}
+	return parsed.Choices[0].Message.Content, parsed.Usage.usage(), nil
+}
+
+// InvokeModel bodies for nova. they're the converse request with
+// lowercase keys and base64 images
+type novaContent struct {
+	Text    string       `json:"text,omitempty"`
+	Image   *novaImage   `json:"image,omitempty"`
+	ToolUse *novaToolUse `json:"toolUse,omitempty"`
+}
+
+type novaImage struct {
+	Format string `json:"format"`
+	Source struct {
+		Bytes string `json:"bytes"`
+	} `json:"source"`
+}
+
+type novaToolUse struct {
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input"`
+}
+
+type novaMessage struct {
+	Role    string        `json:"role"`
+	Content []novaContent `json:"content"`
+}
+
+type novaToolSpec struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	InputSchema struct {
+		JSON json.RawMessage `json:"json"`
+	} `json:"inputSchema"`
+}
+
+type novaRequest struct {
+	SchemaVersion   string         `json:"schemaVersion"`
+	Messages        []novaMessage  `json:"messages"`
+	InferenceConfig map[string]any `json:"inferenceConfig,omitempty"`
+	ToolConfig      map[string]any `json:"toolConfig,omitempty"`
+}
+
+type novaResponse struct {
+	Output struct {
+		Message novaMessage `json:"message"`
+	} `json:"output"`
+	Usage struct {
+		InputTokens  int `json:"inputTokens"`
+		OutputTokens int `json:"outputTokens"`
+	} `json:"usage"`
+}
+
+// BedrockRequestBody is the InvokeModel body for the query, for bedrock
+// batch inference jobs. only nova models are supported
+func (q *Query) BedrockRequestBody() (json.RawMessage, error) {
+	if q.model.Provider != "aws" {
+		return nil, errors.New(fmt.Sprintf("model %s is not a bedrock model", q.model.ModelId))
+	}
+	input, err := q.model.converseInput(q)
+	if err != nil {
+		return nil, err
+	}
+
+	request := novaRequest{SchemaVersion: "messages-v1"}
+	for _, message := range input.Messages {
+		converted := novaMessage{Role: string(message.Role)}
+		for _, block := range message.Content {
+			switch b := block.(type) {
+			case *types.ContentBlockMemberText:
+				converted.Content = append(converted.Content, novaContent{Text: b.Value})
+			case *types.ContentBlockMemberImage:
+				source, ok := b.Value.Source.(*types.ImageSourceMemberBytes)
+				if !ok {
+					return nil, errors.New("only image bytes can be sent to bedrock")
+				}
+				image := &novaImage{Format: string(b.Value.Format)}
+				image.Source.Bytes = base64.StdEncoding.EncodeToString(source.Value)
+				converted.Content = append(converted.Content, novaContent{Image: image})
+			}
+		}
+		request.Messages = append(request.Messages, converted)
+	}
+
+	if config := input.InferenceConfig; config != nil {
+		request.InferenceConfig = make(map[string]any)
+		if config.Temperature != nil {
+			request.InferenceConfig["temperature"] = *config.Temperature
+		}
+		if config.TopP != nil {
+			request.InferenceConfig["topP"] = *config.TopP
+		}
+		if config.MaxTokens != nil {
+			request.InferenceConfig["maxTokens"] = *config.MaxTokens
+		}
+	}
+
+	if q.responseFormat != nil {
+		name := responseToolName(q.responseFormat)
+		schema, err := json.Marshal(anyJSONObject)
+		if err != nil {
+			return nil, err
+		}
+		if q.responseFormat.JSONSchema != nil {
+			schema = q.responseFormat.JSONSchema.Schema
+		}
+		spec := novaToolSpec{Name: name, Description: "Respond by calling this tool. Its input is your response."}
+		spec.InputSchema.JSON = schema
+		request.ToolConfig = map[string]any{
+			"tools":      []map[string]any{{"toolSpec": spec}},
+			"toolChoice": map[string]any{"tool": map[string]string{"name": name}},
+		}
+	}
+	return json.Marshal(request)
+}
+
+// ParseBedrockResponse reads a nova InvokeModel response body. like
+// Converse, a tool call's input is the response
+func ParseBedrockResponse(body []byte) (string, Usage, error) {
+	var parsed novaResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", Usage{}, err
+	}
+	usage := Usage{InputTokens: parsed.Usage.InputTokens, OutputTokens: parsed.Usage.OutputTokens}
+	text := ""
+	for _, content := range parsed.Output.Message.Content {
+		if content.ToolUse != nil {
+			return string(content.ToolUse.Input), usage, nil
+		}
+		text += content.Text
+	}
+	return text, usage, nil
+}
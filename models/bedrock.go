@@ -0,0 +1,143 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// bedrock has no JSON mode. instead, JSON queries give the model a single
+// tool whose input schema is the response schema and force it to call
+// that tool; the tool input is the response
+
+// used when the query wants JSON but has no schema
+var anyJSONObject = map[string]any{"type": "object"}
+
+func responseToolName(format *responseFormat) string {
+	name := "json_response"
+	if format.JSONSchema != nil && format.JSONSchema.Name != "" {
+		name = invalidSchemaName.ReplaceAllString(format.JSONSchema.Name, "_")
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+func responseToolConfig(format *responseFormat) (*types.ToolConfiguration, error) {
+	var schema any = anyJSONObject
+	if format.JSONSchema != nil {
+		if err := json.Unmarshal(format.JSONSchema.Schema, &schema); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid JSON schema %s: %v", format.JSONSchema.Name, err))
+		}
+	}
+	name := responseToolName(format)
+	return &types.ToolConfiguration{
+		Tools: []types.Tool{&types.ToolMemberToolSpec{Value: types.ToolSpecification{
+			Name:        aws.String(name),
+			Description: aws.String("Respond by calling this tool. Its input is your response."),
+			InputSchema: &types.ToolInputSchemaMemberJson{Value: document.NewLazyDocument(schema)},
+		}}},
+		ToolChoice: &types.ToolChoiceMemberTool{Value: types.SpecificToolChoice{Name: aws.String(name)}},
+	}, nil
+}
+
+// converseInput turns a query into a Converse request
+func (m *Model) converseInput(query *Query) (*bedrockruntime.ConverseInput, error) {
+	messages := make([]types.Message, 0, len(query.messages))
+
+	// ignore the initial system message
+	for _, msg := range query.messages[1:] {
+		var content []types.ContentBlock
+		for _, item := range msg.Content {
+			switch v := item.(type) {
+			case textContent:
+				if v.Text == "" {
+					return nil, errors.New("Message text cannot be empty")
+				}
+				content = append(content, &types.ContentBlockMemberText{
+					Value: v.Text,
+				})
+
+			// bedrock needs the image bytes; image URLs aren't supported
+			case ImageContent:
+				fileData := v.ImageContents
+				mimeType := http.DetectContentType(fileData)
+				mimeType = strings.Replace(mimeType, "image/", "", 1)
+				if mimeType == "" {
+					return nil, errors.New(fmt.Sprintf("Unsupported file format %s\n", mimeType))
+				}
+
+				content = append(content, &types.ContentBlockMemberImage{
+					Value: types.ImageBlock{
+						Source: &types.ImageSourceMemberBytes{Value: fileData},
+						Format: types.ImageFormat(mimeType),
+					},
+				})
+			}
+		}
+
+		// Convert string to ConversationRole
+		role := strings.ToLower(msg.Role)
+		if role == "system" {
+			role = "assistant"
+		}
+
+		// converse wants user and assistant turns to alternate, so
+		// back to back messages from the same role are merged
+		if len(messages) > 0 && string(messages[len(messages)-1].Role) == role {
+			last := &messages[len(messages)-1]
+			last.Content = append(last.Content, content...)
+			continue
+		}
+		messages = append(messages, types.Message{
+			Role:    types.ConversationRole(role),
+			Content: content,
+		})
+	}
+
+	input := &bedrockruntime.ConverseInput{
+		ModelId:         aws.String(m.ModelId),
+		Messages:        messages,
+		InferenceConfig: query.options.awsInferenceConfig(),
+	}
+	if query.responseFormat != nil {
+		toolConfig, err := responseToolConfig(query.responseFormat)
+		if err != nil {
+			return nil, err
+		}
+		input.ToolConfig = toolConfig
+	}
+	return input, nil
+}
+
+// converseText returns the response text, or the tool input as JSON for
+// JSON queries
+func converseText(result *bedrockruntime.ConverseOutput) (string, error) {
+	message, ok := result.Output.(*types.ConverseOutputMemberMessage)
+	if !ok {
+		return "", fmt.Errorf("unexpected result type")
+	}
+
+	var messageContent strings.Builder
+	for _, block := range message.Value.Content {
+		switch b := block.(type) {
+		case *types.ContentBlockMemberText:
+			messageContent.WriteString(b.Value)
+		case *types.ContentBlockMemberToolUse:
+			toolInput, err := b.Value.Input.MarshalSmithyDocument()
+			if err != nil {
+				return "", errors.New(fmt.Sprintf("could not read tool input: %v", err))
+			}
+			return string(toolInput), nil
+		}
+	}
+	return messageContent.String(), nil
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// the canonical form of a query used for cache keys. images are
+// reduced to a hash of their URL (data URLs embed the file contents)
+// and schemas are re-marshaled so whitespace and key order don't matter
+type canonicalQuery struct {
+	Provider       string             `json:"provider"`
+	Model          string             `json:"model"`
+	Messages       []canonicalMessage `json:"messages"`
+	ResponseFormat *canonicalFormat   `json:"response_format,omitempty"`
+	Options        GenerationOptions  `json:"options"`
+}
+
+type canonicalMessage struct {
+	Role    string   `json:"role"`
+	Content []string `json:"content"`
+}
+
+type canonicalFormat struct {
+	Type   string      `json:"type"`
+	Name   string      `json:"name,omitempty"`
+	Strict bool        `json:"strict,omitempty"`
+	Schema interface{} `json:"schema,omitempty"`
+}
+
+func (q *Query) canonicalize(includePrompt bool) (*canonicalQuery, error) {
+	canonical := canonicalQuery{Provider: q.model.Provider, Model: q.model.ModelId, Options: q.options}
+
+	for i, message := range q.messages {
+		// the prompt is the text of the last (user) message
+		isPrompt := i == len(q.messages)-1
+		content := make([]string, 0, len(message.Content))
+		for _, item := range message.Content {
+			switch v := item.(type) {
+			case textContent:
+				if isPrompt && !includePrompt {
+					continue
+				}
+				content = append(content, "text:"+v.Text)
+			case ImageContent:
+				content = append(content, fmt.Sprintf("image:%x", sha256.Sum256([]byte(v.ImageURL.URL))))
+			default:
+				return nil, fmt.Errorf("cannot canonicalize message content of type %T", item)
+			}
+		}
+		canonical.Messages = append(canonical.Messages, canonicalMessage{Role: message.Role, Content: content})
+	}
+
+	if q.responseFormat != nil {
+		format := &canonicalFormat{Type: q.responseFormat.Type}
+		if schema := q.responseFormat.JSONSchema; schema != nil {
+			format.Name = schema.Name
+			format.Strict = schema.Strict
+			if err := json.Unmarshal(schema.Schema, &format.Schema); err != nil {
+				return nil, fmt.Errorf("invalid JSON schema: %w", err)
+			}
+		}
+		canonical.ResponseFormat = format
+	}
+
+	return &canonical, nil
+}
+
+func hashCanonical(canonical *canonicalQuery) (string, error) {
+	// encoding/json sorts map keys, so this is stable
+	contents, err := json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(contents)), nil
+}
+
+// CacheKey identifies everything that affects the response: provider,
+// model, every message (including images), response format and options
+func (q *Query) CacheKey() (string, error) {
+	canonical, err := q.canonicalize(true)
+	if err != nil {
+		return "", err
+	}
+	return hashCanonical(canonical)
+}
+
+// ScopeKey is the CacheKey with the prompt text left out. queries that
+// only differ by how the prompt is worded share a scope
+func (q *Query) ScopeKey() (string, error) {
+	canonical, err := q.canonicalize(false)
+	if err != nil {
+		return "", err
+	}
+	return hashCanonical(canonical)
+}
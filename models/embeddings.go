@@ -0,0 +1,204 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+)
+
+type EmbeddingModel struct {
+	Provider   string `json:"provider"`
+	ModelId    string `json:"model_id"`
+	Dimensions int    `json:"dimensions"`
+}
+
+// dimensions of 0 means "whatever the server gives back"
+var embeddingModels = map[string]EmbeddingModel{
+	"text-embedding-3-small": {"openai", "text-embedding-3-small", 1536},
+	"text-embedding-3-large": {"openai", "text-embedding-3-large", 3072},
+	"aws-titan-embed-v2":     {"aws", "amazon.titan-embed-text-v2:0", 1024},
+	"local-embed":            {"local", "embed", 0},
+}
+
+// the OpenAI embeddings endpoint takes at most 2048 inputs per call.
+// stay well under that so individual requests don't get huge
+const embeddingBatchSize = 100
+
+type embeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embeddingData struct {
+	Index     int       `json:"index"`
+	Embedding []float64 `json:"embedding"`
+}
+
+type embeddingResponse struct {
+	Data  []embeddingData `json:"data"`
+	Error errorMessage    `json:"error"`
+}
+
+type titanRequest struct {
+	InputText string `json:"inputText"`
+}
+
+type titanResponse struct {
+	Embedding []float64 `json:"embedding"`
+}
+
+func GetEmbeddingModel(modelID string) (*EmbeddingModel, error) {
+	model, ok := embeddingModels[modelID]
+	if !ok {
+		modelNames := make([]string, 0)
+		for key := range embeddingModels {
+			modelNames = append(modelNames, key)
+		}
+		return nil, errors.New(fmt.Sprintf("Embedding model %s not found. valid embedding models are %v", modelID, modelNames))
+	}
+	return &model, nil
+}
+
+func (e *EmbeddingModel) getEndpoint() (string, error) {
+	if e.Provider == "openai" {
+		return "https://api.openai.com/v1/embeddings", nil
+	} else if e.Provider == "local" {
+		return "http://localhost:8080/v1/embeddings", nil
+	} else if e.Provider == "aws" {
+		return "", errors.New(fmt.Sprintf("Calls to AWS provider should use the Go SDK"))
+	} else {
+		return "", errors.New(fmt.Sprintf("Provider not found: %s", e.Provider))
+	}
+}
+
+// Embed returns one vector per input text, in the same order as the input
+func (e *EmbeddingModel) Embed(texts []string) ([][]float64, error) {
+	if e.Provider == "aws" {
+		return e.embedAWS(texts)
+	}
+
+	embeddings := make([][]float64, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		end := min(start+embeddingBatchSize, len(texts))
+		batch, err := e.embedBatch(texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, batch...)
+	}
+	return embeddings, nil
+}
+
+func (e *EmbeddingModel) embedBatch(texts []string) ([][]float64, error) {
+	apiKey, err := (&Model{Provider: e.Provider}).getAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := e.getEndpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	requestBodyAsJSON, err := json.Marshal(embeddingRequest{Model: e.ModelId, Input: texts})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(requestBodyAsJSON))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	req.Header.Add("Content-Type", "application/json")
+
+	rep, err := HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rep.Body.Close()
+
+	contents, err := io.ReadAll(rep.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	responseStruct := &embeddingResponse{}
+	if err := json.Unmarshal(contents, responseStruct); err != nil {
+		return nil, err
+	}
+	if responseStruct.Error.Message != "" {
+		return nil, errors.New(responseStruct.Error.Message)
+	}
+	if len(responseStruct.Data) != len(texts) {
+		return nil, errors.New(fmt.Sprintf("Expected %d embeddings, got %d", len(texts), len(responseStruct.Data)))
+	}
+
+	// the API doesn't promise to return embeddings in input order
+	embeddings := make([][]float64, len(texts))
+	for _, data := range responseStruct.Data {
+		if data.Index < 0 || data.Index >= len(texts) {
+			return nil, errors.New(fmt.Sprintf("Embedding index %d out of range", data.Index))
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+	return embeddings, nil
+}
+
+// titan only embeds one text per call
+func (e *EmbeddingModel) embedAWS(texts []string) ([][]float64, error) {
+	client, err := newAWSClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS client: %w", err)
+	}
+
+	embeddings := make([][]float64, 0, len(texts))
+	for _, text := range texts {
+		body, err := json.Marshal(titanRequest{InputText: text})
+		if err != nil {
+			return nil, err
+		}
+		result, err := client.InvokeModel(context.TODO(), &bedrockruntime.InvokeModelInput{
+			ModelId:     aws.String(e.ModelId),
+			ContentType: aws.String("application/json"),
+			Accept:      aws.String("application/json"),
+			Body:        body,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to invoke embedding model: %w", err)
+		}
+
+		var response titanResponse
+		if err := json.Unmarshal(result.Body, &response); err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, response.Embedding)
+	}
+	return embeddings, nil
+}
+
+// CosineSimilarity returns a value in [-1, 1]. vectors of different
+// lengths (or zero vectors) are treated as completely dissimilar
+func CosineSimilarity(a []float64, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return -1
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return -1
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,270 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ensembles ask for several answers and combine them. Vote keeps the
+// most common answer (self-consistency), Judge has another model pick
+// the best one or write a better one
+
+// samples need some randomness to be worth voting on
+const defaultSampleTemperature = 0.7
+
+// Sender sends a query. the packages that run lots of queries (batch,
+// compare, evals, ensembles) take one so tests can answer for the model
+type Sender func(ctx context.Context, query *Query) (string, Usage, error)
+
+// Run sends the query with s, or runs it against its model if s is nil
+func (s Sender) Run(ctx context.Context, query *Query) (string, Usage, error) {
+	if s != nil {
+		return s(ctx, query)
+	}
+	return query.RunWithUsage(ctx)
+}
+
+// Ensemble is how the samples and the judge's verdict are asked for. the
+// zero value (what the Query methods use) runs queries against their
+// model
+type Ensemble struct {
+	// sends each query. defaults to RunWithUsage
+	Send Sender
+}
+
+type VoteResult struct {
+	// the first sample with the winning answer, exactly as the model wrote it
+	Answer string
+	// how many samples agreed with it
+	Votes   int
+	Samples []string
+	// every sample, including the ones that failed
+	Usage Usage
+}
+
+type Judgement struct {
+	Answer string
+	// 1-based index of the chosen candidate, or 0 if the judge wrote its
+	// own answer
+	Choice     int
+	Rationale  string
+	Candidates []string
+	// the samples and the judge
+	Usage Usage
+}
+
+// Sample sends the query n times at once, at a temperature of 0.7 unless
+// the query sets one. failed samples are dropped; it's only an error if
+// every sample fails
+func (q *Query) Sample(ctx context.Context, n int) ([]string, Usage, error) {
+	return Ensemble{}.Sample(ctx, q, n)
+}
+
+func (e Ensemble) Sample(ctx context.Context, q *Query, n int) ([]string, Usage, error) {
+	if n < 1 {
+		return nil, Usage{}, errors.New("need at least one sample")
+	}
+	sample := *q
+	if sample.options.Temperature == nil {
+		temperature := defaultSampleTemperature
+		sample.options.Temperature = &temperature
+	}
+
+	responses := make([]string, n)
+	errs := make([]error, n)
+	usages := make([]Usage, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i], usages[i], errs[i] = e.Send.Run(ctx, &sample)
+		}(i)
+	}
+	wg.Wait()
+
+	var usage Usage
+	samples := make([]string, 0, n)
+	for i := range responses {
+		usage.Add(usages[i])
+		if errs[i] == nil {
+			samples = append(samples, responses[i])
+		}
+	}
+	if len(samples) == 0 {
+		return nil, usage, errors.New(fmt.Sprintf("all %d samples failed: %v", n, errs[0]))
+	}
+	return samples, usage, nil
+}
+
+// Vote samples the query n times and returns the most common answer.
+// it's meant for JSON and short answers, which are compared after
+// normalizing (JSON by value, text ignoring case, spacing and trailing
+// punctuation)
+func (q *Query) Vote(ctx context.Context, n int) (*VoteResult, error) {
+	return Ensemble{}.Vote(ctx, q, n)
+}
+
+func (e Ensemble) Vote(ctx context.Context, q *Query, n int) (*VoteResult, error) {
+	samples, usage, err := e.Sample(ctx, q, n)
+	if err != nil {
+		return nil, err
+	}
+	answer, votes := MajorityVote(samples)
+	return &VoteResult{Answer: answer, Votes: votes, Samples: samples, Usage: usage}, nil
+}
+
+// MajorityVote returns the most common answer and how many times it came
+// up. ties go to the answer seen first
+func MajorityVote(answers []string) (string, int) {
+	counts := make(map[string]int)
+	first := make(map[string]string)
+	order := make([]string, 0)
+	for _, answer := range answers {
+		key := normalizeAnswer(answer)
+		if _, seen := first[key]; !seen {
+			first[key] = answer
+			order = append(order, key)
+		}
+		counts[key]++
+	}
+	best := ""
+	for _, key := range order {
+		if best == "" || counts[key] > counts[best] {
+			best = key
+		}
+	}
+	return first[best], counts[best]
+}
+
+// SameAnswer is true if MajorityVote would count a and b as the same
+func SameAnswer(a string, b string) bool {
+	return normalizeAnswer(a) == normalizeAnswer(b)
+}
+
+func normalizeAnswer(answer string) string {
+	answer = strings.TrimSpace(stripCodeFence(answer))
+	var value any
+	if json.Unmarshal([]byte(answer), &value) == nil {
+		// maps marshal with sorted keys, so this ignores key order and
+		// formatting
+		if canonical, err := json.Marshal(value); err == nil {
+			return "json:" + string(canonical)
+		}
+	}
+	answer = strings.ToLower(strings.Join(strings.Fields(answer), " "))
+	return "text:" + strings.TrimRight(answer, ".!")
+}
+
+type verdict struct {
+	Choice    int    `json:"choice" description:"number of the best candidate, or 0 if you wrote a better answer yourself"`
+	Answer    string `json:"answer" description:"the best candidate copied exactly, or your improved answer"`
+	Rationale string `json:"rationale" description:"a few sentences on why this answer is best"`
+}
+
+// Judge samples the query n times and has judge pick the best answer, or
+// combine them into a better one
+func (q *Query) Judge(ctx context.Context, judge *Model, n int) (*Judgement, error) {
+	return Ensemble{}.Judge(ctx, q, judge, n)
+}
+
+func (e Ensemble) Judge(ctx context.Context, q *Query, judge *Model, n int) (*Judgement, error) {
+	samples, usage, err := e.Sample(ctx, q, n)
+	if err != nil {
+		return nil, err
+	}
+	judgement, err := e.JudgeAnswers(ctx, judge, q.Prompt(), samples)
+	if judgement != nil {
+		judgement.Usage.Add(usage)
+	}
+	if err != nil {
+		return judgement, err
+	}
+	if judgement.Choice == 0 && q.validateJSON {
+		// the samples were validated when they were sent, the judge's own
+		// answer wasn't. fall back to the best sample if it doesn't fit
+		problems, err := q.checkJSON(judgement.Answer)
+		if err != nil {
+			return nil, err
+		}
+		if len(problems) > 0 {
+			best, _ := MajorityVote(samples)
+			for i, sample := range samples {
+				if sample == best {
+					judgement.Choice = i + 1
+					break
+				}
+			}
+			judgement.Rationale += fmt.Sprintf(" (the judge's own answer was invalid: %s; using candidate %d instead)", strings.Join(problems, "; "), judgement.Choice)
+			judgement.Answer = best
+		}
+	}
+	return judgement, nil
+}
+
+// checkJSON checks a JSON query's response against its schema, if it has
+// one
+func (q *Query) checkJSON(response string) ([]string, error) {
+	response = stripCodeFence(response)
+	if q.schema != nil {
+		return ValidateJSON(q.schema, response)
+	}
+	return validateResponse(response, nil), nil
+}
+
+// JudgeAnswers has judge pick the best of candidates for question, or
+// write a better answer from them. the candidates can come from anywhere,
+// e.g. several models
+func JudgeAnswers(ctx context.Context, judge *Model, question string, candidates []string) (*Judgement, error) {
+	return Ensemble{}.JudgeAnswers(ctx, judge, question, candidates)
+}
+
+func (e Ensemble) JudgeAnswers(ctx context.Context, judge *Model, question string, candidates []string) (*Judgement, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("there are no answers to judge")
+	}
+	schema, err := SchemaFor[verdict]()
+	if err != nil {
+		return nil, err
+	}
+	schema.Name = "judgement"
+	query, err := judge.MakeJSONQuery(judgePrompt(question, candidates), schema)
+	if err != nil {
+		return nil, err
+	}
+	response, usage, err := e.Send.Run(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var decision verdict
+	if err := json.Unmarshal([]byte(response), &decision); err != nil {
+		return nil, errors.New(fmt.Sprintf("could not read the judge's verdict: %v", err))
+	}
+	if decision.Choice < 0 || decision.Choice > len(candidates) {
+		return nil, errors.New(fmt.Sprintf("the judge chose candidate %d of %d", decision.Choice, len(candidates)))
+	}
+
+	judgement := &Judgement{Answer: decision.Answer, Choice: decision.Choice, Rationale: decision.Rationale, Candidates: candidates, Usage: usage}
+	if decision.Choice > 0 {
+		// the candidate itself, not the judge's copy of it
+		judgement.Answer = candidates[decision.Choice-1]
+	}
+	return judgement, nil
+}
+
+func judgePrompt(question string, candidates []string) string {
+	var prompt strings.Builder
+	prompt.WriteString("Several answers were written for the question below. Decide which one is best: the most correct, complete and clear.\n\n")
+	fmt.Fprintf(&prompt, "Question:\n%s\n", question)
+	for i, candidate := range candidates {
+		fmt.Fprintf(&prompt, "\nCandidate %d:\n%s\n", i+1, candidate)
+	}
+	prompt.WriteString("\nIf one candidate is best, set choice to its number and copy it into answer exactly. " +
+		"If none is right but together they have what's needed, set choice to 0 and write a better answer in the same format the question asks for. " +
+		"Explain your decision in rationale.")
+	return prompt.String()
+}
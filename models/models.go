@@ -9,14 +9,12 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 
 	tiktoken "github.com/pkoukk/tiktoken-go"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
-	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
 )
 
 type Model struct {
@@ -35,15 +33,21 @@ var models = map[string]Model{
 	"gpt-4o":            {"openai", "gpt-4o", 128000, "cl100k_base", true, true, false},
 	"gpt-4-turbo":       {"openai", "gpt-4-turbo", 128000, "cl100k_base", true, true, false},
 	"gpt-4o-mini":       {"openai", "gpt-4o-mini", 128000, "cl100k_base", true, true, true},
-	"local-deepseek-7b": {"local", "deepseek-7b", 8192, "cl100k_base", false, false, false},
-	"aws-nova-lite":     {"aws", "us.amazon.nova-lite-v1:0", 300000, "cl100k_base", true, false, false},
-	"aws-nova-pro":     {"aws", "us.amazon.nova-pro-v1:0", 300000, "cl100k_base", true, false, false},
+	"local-deepseek-7b": {"local", "deepseek-7b", 8192, "cl100k_base", false, true, true},
+	"aws-nova-lite":     {"aws", "us.amazon.nova-lite-v1:0", 300000, "cl100k_base", true, true, true},
+	"aws-nova-pro":     {"aws", "us.amazon.nova-pro-v1:0", 300000, "cl100k_base", true, true, true},
 }
 
 type Query struct {
 	messages       []requestMessage
 	responseFormat *responseFormat
+	options        GenerationOptions
 	model          *Model
+
+	// JSON queries check the response themselves (see validate.go)
+	validateJSON   bool
+	schema         *JSONSchema
+	repairAttempts int
 }
 
 type contentType interface{}
@@ -63,6 +67,11 @@ type ImageContent struct {
 	ImageContents []byte `json:"-"`
 }
 
+// ImageFromURL is an image the provider downloads itself
+func ImageFromURL(url string) ImageContent {
+	return ImageContent{Type: "image_url", ImageURL: ImageURL{URL: url}}
+}
+
 type requestMessage struct {
 	Role    string        `json:"role"`
 	Content []contentType `json:"content"`
@@ -94,6 +103,10 @@ type request struct {
 
 	// optional
 	ResponseFormat *responseFormat `json:"response_format,omitempty"`
+	GenerationOptions
+
+	// llama-server only. it turns the schema into a grammar
+	LocalJSONSchema json.RawMessage `json:"json_schema,omitempty"`
 }
 
 type choice struct {
@@ -107,11 +120,12 @@ type errorMessage struct {
 }
 
 type response struct {
-	Id      string       `json:"id"`
-	Created int64        `json:"created"`
-	Model   string       `json:"model"`
-	Choices []choice     `json:"choices"`
-	Error   errorMessage `json:"error"`
+	Id      string        `json:"id"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []choice      `json:"choices"`
+	Usage   responseUsage `json:"usage"`
+	Error   errorMessage  `json:"error"`
 }
 
 func getLargestModel() *Model {
@@ -185,10 +199,24 @@ func GetModel(modelID string) (*Model, error) {
 	return &model, nil
 }
 
+// ModelIds returns the name of every registered model, sorted
+func ModelIds() []string {
+	modelNames := make([]string, 0, len(models))
+	for key := range models {
+		modelNames = append(modelNames, key)
+	}
+	sort.Strings(modelNames)
+	return modelNames
+}
+
 func (m *Model) getAPIKey() (string, error) {
 	provider := m.Provider
 	if provider == "openai" {
 		apiKey, set := os.LookupEnv("OPENAI_API_KEY")
+		if !set && replaying() {
+			// nothing is sent, so any key will do
+			return redacted, nil
+		}
 		if !set {
 			return "", errors.New("OPENAI_API_KEY not set")
 		}
@@ -204,9 +232,7 @@ func (m *Model) getAPIKey() (string, error) {
 
 func newAWSClient() (*bedrockruntime.Client, error) {
 	// Load the Shared AWS Configuration
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion("us-east-1"), // Specify the region
-	)
+	cfg, err := AWSConfig(context.TODO())
 	if err != nil {
 		return nil, err
 	}
@@ -214,100 +240,29 @@ func newAWSClient() (*bedrockruntime.Client, error) {
 	return bedrockruntime.NewFromConfig(cfg), nil
 }
 
-// AI gen
 func (m *Model) RunAWSClient(query *Query) (string, error) {
+	response, _, err := m.runAWSClient(context.Background(), query)
+	return response, err
+}
 
+func (m *Model) runAWSClient(ctx context.Context, query *Query) (string, Usage, error) {
 	client, err := newAWSClient()
 	if err != nil {
-		return "", fmt.Errorf("failed to create AWS client: %w", err)
-	}
-
-	// ignore the initial system message
-	messages := make([]types.Message, len(query.messages)-1)
-	for i, msg := range query.messages[1:] {
-		var content []types.ContentBlock
-		for _, item := range msg.Content {
-			switch v := item.(type) {
-			case textContent:
-				if v.Text == "" {
-					return "", errors.New("Message text cannot be empty")
-				}
-				content = append(content, &types.ContentBlockMemberText{
-					Value: v.Text,
-				})
-
-			// TODO: add support for image content
-			// apparently ImageSource needs to be an array of bytes
-			// (right now we are using an image URL for everything)
-			case ImageContent:
-				//imagePath := "/Users/paul.wendt/Downloads/rome.jpg"
-	            //fileData, err := os.ReadFile(imagePath)
-	            //if err != nil {
-	            //	return "", errors.New(fmt.Sprintf("Could not read file: %v\n", err))
-	            //}
-				//
-
-				// TODO: figure this out just from the image contents
-				fileData := v.ImageContents
-				mimeType := http.DetectContentType(fileData)
-
-	            //ext := filepath.Ext(imagePath)
-	            //mimeType := mime.TypeByExtension(ext)
-				mimeType = strings.Replace(mimeType, "image/", "", 1)
-	            if mimeType == "" {
-	            	return "", errors.New(fmt.Sprintf("Unsupported file format %s\n", mimeType))
-	            }
-
-                content = append(content, &types.ContentBlockMemberImage{
-                        Value: types.ImageBlock{
-						Source: &types.ImageSourceMemberBytes{Value: fileData},
-                                Format: types.ImageFormat(mimeType), // TODO determine this from the image itself
-                        },
-                })
-			}
-
-		}
-		// Convert string to ConversationRole
-		role := strings.ToLower(msg.Role)
-		if role == "system" {
-			role = "assistant"
-		}
-
-		convertedRole := types.ConversationRole(role)
-		messages[i] = types.Message{
-			Role:    convertedRole,
-			Content: content,
-		}
+		return "", Usage{}, fmt.Errorf("failed to create AWS client: %w", err)
 	}
 
-	// Construct the request
-	input := &bedrockruntime.ConverseInput{
-		ModelId:  aws.String(m.ModelId),
-		Messages: messages,
+	input, err := m.converseInput(query)
+	if err != nil {
+		return "", Usage{}, err
 	}
 
 	// Invoke the API
-	result, err := client.Converse(context.TODO(), input)
+	result, err := client.Converse(ctx, input)
 	if err != nil {
-		return "", fmt.Errorf("failed to invoke Converse API: %w", err)
-	}
-
-	var messageContent strings.Builder // Use a builder for better efficiency
-
-	switch v := (result.Output).(type) {
-	case *types.ConverseOutputMemberMessage:
-		for _, block := range v.Value.Content {
-			switch b := block.(type) {
-			case *types.ContentBlockMemberText:
-				messageContent.WriteString(b.Value)
-			}
-		}
-	default:
-		return "", fmt.Errorf("unexpected result type")
+		return "", Usage{}, fmt.Errorf("failed to invoke Converse API: %w", err)
 	}
-
-	return messageContent.String(), nil
-
+	text, err := converseText(result)
+	return text, converseUsage(result), err
 }
 
 func (m *Model) getEndpoint() (string, error) {
@@ -325,6 +280,7 @@ func (m *Model) getEndpoint() (string, error) {
 func (m *Model) tokenize(query string) ([]int, error) {
 
 	// this could change...
+	useRecordedTokenizer()
 	tokenizer, err := tiktoken.GetEncoding(m.TokenizerName)
 	if err != nil {
 		return nil, err
@@ -365,6 +321,12 @@ func createUserTextMessage(prompt string) *requestMessage {
 	return &userMessage
 }
 
+func createAssistantMessage(response string) *requestMessage {
+	content := contentType(textContent{Type: "text", Text: response})
+	assistantMessage := requestMessage{Role: "assistant", Content: []contentType{content}}
+	return &assistantMessage
+}
+
 func createUserImageMessages(prompt string, imageContents ...ImageContent) *requestMessage {
 	contentList := make([]contentType, 0)
 	contentList = append(contentList, contentType(textContent{Type: "text", Text: prompt}))
@@ -422,29 +384,44 @@ func (m *Model) MakeJSONQuery(prompt string, schema *JSONSchema, imageContent ..
 		return nil, errors.New(fmt.Sprintf("Model %s does not support images. Models that do: %v", m.ModelId, getVisionModelIds()))
 	}
 
-	var jsonFormat responseFormat
+	var jsonFormat *responseFormat
+	jsonInstructions := "JSON output only."
 	if schema == nil {
 		if !m.SupportsUnstructuredJson {
 			return nil, errors.New(fmt.Sprintf("Model %s does not support unstructured JSON output. Models that might: %v", m.ModelId, getJSONModelIds(false)))
 		}
-		jsonFormat = responseFormat{Type: "json_object"}
+		jsonFormat = &responseFormat{Type: "json_object"}
+	} else if m.SupportsStructuredJson {
+		jsonFormat = &responseFormat{Type: "json_schema", JSONSchema: schema}
 	} else {
-		if !m.SupportsStructuredJson {
-			return nil, errors.New(fmt.Sprintf("Model %s does not support structured JSON output. Models that might: %v", m.ModelId, getJSONModelIds(true)))
+		// no native structured output. describe the schema in the prompt
+		// instead; the response gets validated against it either way
+		if _, err := compileSchema(schema); err != nil {
+			return nil, err
+		}
+		jsonInstructions = fmt.Sprintf("Respond with only a JSON value (no code fences or commentary) that matches this JSON schema:\n%s", schema.Schema)
+		if m.SupportsUnstructuredJson {
+			jsonFormat = &responseFormat{Type: "json_object"}
 		}
-		jsonFormat = responseFormat{Type: "json_schema", JSONSchema: schema}
 	}
 
 	systemMessage := createSystemMessage("")
-	jsonMessage := createUserTextMessage("JSON output only.")
-	var userMessage *requestMessage
+	var messages []requestMessage
+	if jsonFormat == nil {
+		// keep it to one user message; bedrock wants user and assistant
+		// messages to alternate
+		prompt = jsonInstructions + "\n\n" + prompt
+		messages = []requestMessage{*systemMessage}
+	} else {
+		messages = []requestMessage{*systemMessage, *createUserTextMessage(jsonInstructions)}
+	}
 
 	if len(imageContent) == 0 {
-		userMessage = createUserTextMessage(prompt)
+		messages = append(messages, *createUserTextMessage(prompt))
 	} else {
-		userMessage = createUserImageMessages(prompt, imageContent...)
+		messages = append(messages, *createUserImageMessages(prompt, imageContent...))
 	}
-	q := Query{messages: []requestMessage{*systemMessage, *jsonMessage, *userMessage}, responseFormat: &jsonFormat, model: m}
+	q := Query{messages: messages, responseFormat: jsonFormat, model: m, validateJSON: true, schema: schema, repairAttempts: defaultRepairAttempts}
 	return &q, nil
 }
 
@@ -502,70 +479,103 @@ func (q *Query) checkTokens() error {
 
 func (q *Query) toRequest() (*request, error) {
 	model := q.model
-	return &request{Model: model.ModelId, Messages: q.messages, ResponseFormat: q.responseFormat}, nil
+	r := &request{Model: model.ModelId, Messages: q.messages, ResponseFormat: q.responseFormat, GenerationOptions: q.options}
+	if model.Provider == "local" && q.responseFormat != nil {
+		// older llama-server builds ignore response_format, but they all
+		// understand a top level json_schema
+		r.ResponseFormat = nil
+		r.LocalJSONSchema = json.RawMessage(`{"type": "object"}`)
+		if q.responseFormat.JSONSchema != nil {
+			r.LocalJSONSchema = q.responseFormat.JSONSchema.Schema
+		}
+	}
+	return r, nil
+}
+
+// Model is the model the query will be sent to
+func (q *Query) Model() *Model {
+	return q.model
 }
 
+// Prompt returns the text of the query's last user message
+func (q *Query) Prompt() string {
+	for i := len(q.messages) - 1; i >= 0; i-- {
+		if q.messages[i].Role != "user" {
+			continue
+		}
+		var text strings.Builder
+		for _, content := range q.messages[i].Content {
+			if v, ok := content.(textContent); ok {
+				text.WriteString(v.Text)
+			}
+		}
+		return text.String()
+	}
+	return ""
+}
+
+// Run sends the query. JSON queries are validated, and re-prompted if
+// the model gets it wrong (see validate.go)
 func (q *Query) Run() (string, error) {
+	return q.RunContext(context.Background())
+}
+
+// RunContext is Run, but gives up when ctx is done
+func (q *Query) RunContext(ctx context.Context) (string, error) {
+	response, _, err := q.RunWithUsage(ctx)
+	return response, err
+}
+
+func (q *Query) send(ctx context.Context) (string, Usage, error) {
 	model := q.model
 
 	if model.Provider == "aws" {
-		return model.RunAWSClient(q)
+		return model.runAWSClient(ctx, q)
 	}
 
 	apiKey, err := model.getAPIKey()
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
 
 	err = q.checkTokens()
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
 
 	request, err := q.toRequest()
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
 
 	requestBodyAsJSON, err := json.Marshal(request)
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
     //jsonString := string(requestBodyAsJSON)
     //fmt.Println(jsonString)
 
-	client := &http.Client{}
+	client := HTTPClient()
 	endpoint, err := model.getEndpoint()
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
 
-	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(requestBodyAsJSON))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(requestBodyAsJSON))
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
 
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 	req.Header.Add("Content-Type", "application/json")
 	rep, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
 
-	responseStruct := &response{}
 	contents, err := io.ReadAll(rep.Body)
 	if err != nil {
-		return "", err
+		return "", Usage{}, err
 	}
-
-	err = json.Unmarshal(contents, responseStruct)
-	if err != nil {
-		return "", err
-	}
-
-	if responseStruct.Error.Message != "" {
-		return "", errors.New(responseStruct.Error.Message)
-	}
-
-	return responseStruct.Choices[0].Message.Content, nil
+	return ParseChatResponse(contents)
 }
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// GenerationOptions are the sampling knobs sent along with a query.
+// nil fields are left up to the provider
+type GenerationOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+}
+
+func (q *Query) SetOptions(options GenerationOptions) {
+	q.options = options
+}
+
+func (q *Query) Options() GenerationOptions {
+	return q.options
+}
+
+// bedrock has no seed parameter, so that one is dropped
+func (o GenerationOptions) awsInferenceConfig() *types.InferenceConfiguration {
+	if o.Temperature == nil && o.TopP == nil && o.MaxTokens == nil {
+		return nil
+	}
+	config := &types.InferenceConfiguration{}
+	if o.Temperature != nil {
+		config.Temperature = aws.Float32(float32(*o.Temperature))
+	}
+	if o.TopP != nil {
+		config.TopP = aws.Float32(float32(*o.TopP))
+	}
+	if o.MaxTokens != nil {
+		config.MaxTokens = aws.Int32(int32(*o.MaxTokens))
+	}
+	return config
+}
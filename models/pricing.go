@@ -0,0 +1,31 @@
+package models
+
+// Price is what a model costs, in USD per million tokens. these are list
+// prices and go stale, so treat costs as estimates
+type Price struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// by model id
+var prices = map[string]Price{
+	"gpt-3.5-turbo":            {0.50, 1.50},
+	"gpt-4":                    {30.00, 60.00},
+	"gpt-4o":                   {2.50, 10.00},
+	"gpt-4-turbo":              {10.00, 30.00},
+	"gpt-4o-mini":              {0.15, 0.60},
+	"deepseek-7b":              {0, 0},
+	"us.amazon.nova-lite-v1:0": {0.06, 0.24},
+	"us.amazon.nova-pro-v1:0":  {0.80, 3.20},
+}
+
+// Price returns the model's price, if it's known
+func (m *Model) Price() (Price, bool) {
+	price, ok := prices[m.ModelId]
+	return price, ok
+}
+
+// Cost is what usage costs at this price, in USD
+func (p Price) Cost(usage Usage) float64 {
+	return (float64(usage.InputTokens)*p.Input + float64(usage.OutputTokens)*p.Output) / 1e6
+}
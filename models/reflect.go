@@ -0,0 +1,366 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schemas generated from Go types, so library users don't have to write
+// JSON schemas by hand. the output follows the rules for OpenAI's strict
+// mode: every property is required, objects don't allow additional
+// properties, and optional fields (pointers or omitempty) are nullable.
+//
+// two extra struct tags are understood:
+//
+//	type Review struct {
+//		Sentiment string  `json:"sentiment" enum:"good,neutral,bad"`
+//		Reason    string  `json:"reason" description:"one sentence"`
+//		Score     *int    `json:"score"` // may be null
+//	}
+
+type schemaNode struct {
+	Type                 any               `json:"type,omitempty"`
+	Description          string            `json:"description,omitempty"`
+	Enum                 []any             `json:"enum,omitempty"`
+	Items                *schemaNode       `json:"items,omitempty"`
+	Properties           *schemaProperties `json:"properties,omitempty"`
+	Required             []string          `json:"required,omitempty"`
+	AdditionalProperties *bool             `json:"additionalProperties,omitempty"`
+	AnyOf                []*schemaNode     `json:"anyOf,omitempty"`
+}
+
+type schemaProperty struct {
+	name   string
+	schema *schemaNode
+}
+
+// schemaProperties marshals in field order. models tend to fill in
+// properties in the order the schema lists them
+type schemaProperties []schemaProperty
+
+func (p schemaProperties) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	for i, property := range p {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		name, _ := json.Marshal(property.name)
+		value, err := json.Marshal(property.schema)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(name)
+		buffer.WriteString(":")
+		buffer.Write(value)
+	}
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+var invalidSchemaName = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// SchemaFor returns a strict JSON schema for T, which has to be a struct
+func SchemaFor[T any]() (*JSONSchema, error) {
+	return SchemaOf(reflect.TypeOf((*T)(nil)).Elem())
+}
+
+// SchemaOf is SchemaFor for a reflect.Type
+func SchemaOf(t reflect.Type) (*JSONSchema, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return nil, errors.New(fmt.Sprintf("Can only generate schemas for structs, not %s", t))
+	}
+	node, err := schemaForType(t, map[reflect.Type]bool{})
+	if err != nil {
+		return nil, err
+	}
+	schema, err := json.Marshal(node)
+	if err != nil {
+		return nil, err
+	}
+
+	name := invalidSchemaName.ReplaceAllString(t.Name(), "_")
+	if name == "" {
+		name = "response"
+	}
+	return &JSONSchema{Name: name, Schema: schema, Strict: true}, nil
+}
+
+func schemaForType(t reflect.Type, seen map[reflect.Type]bool) (*schemaNode, error) {
+	switch {
+	case t == timeType:
+		return &schemaNode{Type: "string", Description: "RFC 3339 timestamp"}, nil
+	case t.Kind() == reflect.Pointer:
+		return schemaForType(t.Elem(), seen)
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &schemaNode{Type: "string"}, nil
+	case reflect.Bool:
+		return &schemaNode{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &schemaNode{Type: "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return &schemaNode{Type: "number"}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json sends []byte as base64
+			return &schemaNode{Type: "string"}, nil
+		}
+		items, err := schemaForType(t.Elem(), seen)
+		if err != nil {
+			return nil, err
+		}
+		return &schemaNode{Type: "array", Items: items}, nil
+	case reflect.Struct:
+		return schemaForStruct(t, seen)
+	}
+	// maps and interfaces can't be described in strict mode
+	return nil, errors.New(fmt.Sprintf("Cannot generate a strict schema for %s", t))
+}
+
+func schemaForStruct(t reflect.Type, seen map[reflect.Type]bool) (*schemaNode, error) {
+	if seen[t] {
+		return nil, errors.New(fmt.Sprintf("Cannot generate a schema for recursive type %s", t))
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	properties := make(schemaProperties, 0)
+	if err := addStructFields(t, seen, &properties); err != nil {
+		return nil, err
+	}
+	required := make([]string, 0, len(properties))
+	for _, property := range properties {
+		required = append(required, property.name)
+	}
+	noAdditionalProperties := false
+	return &schemaNode{Type: "object", Properties: &properties, Required: required, AdditionalProperties: &noAdditionalProperties}, nil
+}
+
+// one field as encoding/json sees it, after embedded structs are flattened
+type structField struct {
+	name    string
+	tagged  bool
+	index   []int
+	field   reflect.StructField
+	options string
+}
+
+// addStructFields follows encoding/json: embedded structs without a
+// json name are flattened into their parent, and when several fields end
+// up with the same name the shallowest wins, then the one with a json
+// tag. if that still doesn't settle it, none of them are used
+func addStructFields(t reflect.Type, seen map[reflect.Type]bool, properties *schemaProperties) error {
+	fields := make([]structField, 0)
+	collectFields(t, nil, map[reflect.Type]bool{}, &fields)
+
+	for _, field := range dominantFields(fields) {
+		fieldType := field.field.Type
+		node, err := schemaForType(fieldType, seen)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s.%s: %v", t.Name(), field.field.Name, err))
+		}
+		node.Description = field.field.Tag.Get("description")
+		if enum := field.field.Tag.Get("enum"); enum != "" {
+			for _, value := range strings.Split(enum, ",") {
+				parsed, err := enumValue(fieldType, strings.TrimSpace(value))
+				if err != nil {
+					return errors.New(fmt.Sprintf("%s.%s: %v", t.Name(), field.field.Name, err))
+				}
+				node.Enum = append(node.Enum, parsed)
+			}
+		}
+		if hasOption(field.options, "string") && quotable(fieldType) {
+			// ,string sends the value as a JSON string holding its encoding
+			node.Type = "string"
+			for i, value := range node.Enum {
+				encoded, _ := json.Marshal(value)
+				node.Enum[i] = string(encoded)
+			}
+		}
+
+		// strict mode has no optional properties, only nullable ones
+		optional := fieldType.Kind() == reflect.Pointer || hasOption(field.options, "omitempty")
+		if optional {
+			node.Type = []string{node.Type.(string), "null"}
+			if node.Enum != nil {
+				node.Enum = append(node.Enum, nil)
+			}
+		}
+		*properties = append(*properties, schemaProperty{name: field.name, schema: node})
+	}
+	return nil
+}
+
+// collectFields lists the fields of t in encoding/json order, depth first
+// through embedded structs. embedding lists the types already being
+// flattened, so a struct that embeds itself doesn't loop forever
+func collectFields(t reflect.Type, index []int, embedding map[reflect.Type]bool, fields *[]structField) {
+	if embedding[t] {
+		return
+	}
+	embedding[t] = true
+	defer delete(embedding, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		fieldIndex := append(append([]int{}, index...), i)
+
+		if field.Anonymous && name == "" {
+			fieldType := field.Type
+			for fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct {
+				collectFields(fieldType, fieldIndex, embedding, fields)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		tagged := name != ""
+		if !tagged {
+			name = field.Name
+		}
+		*fields = append(*fields, structField{name: name, tagged: tagged, index: fieldIndex, field: field, options: options})
+	}
+}
+
+// dominantFields drops the fields that encoding/json would hide behind
+// another field with the same name, keeping the order of the rest
+func dominantFields(fields []structField) []structField {
+	byName := make(map[string][]structField)
+	for _, field := range fields {
+		byName[field.name] = append(byName[field.name], field)
+	}
+
+	kept := make([]structField, 0, len(fields))
+	for _, field := range fields {
+		if winner, ok := dominantField(byName[field.name]); ok && slices.Equal(winner.index, field.index) {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
+
+func dominantField(fields []structField) (structField, bool) {
+	depth := len(fields[0].index)
+	for _, field := range fields {
+		depth = min(depth, len(field.index))
+	}
+	shallowest := make([]structField, 0, len(fields))
+	tagged := make([]structField, 0, len(fields))
+	for _, field := range fields {
+		if len(field.index) != depth {
+			continue
+		}
+		shallowest = append(shallowest, field)
+		if field.tagged {
+			tagged = append(tagged, field)
+		}
+	}
+	if len(shallowest) == 1 {
+		return shallowest[0], true
+	}
+	if len(tagged) == 1 {
+		return tagged[0], true
+	}
+	return structField{}, false
+}
+
+func hasOption(options string, option string) bool {
+	return slices.Contains(strings.Split(options, ","), option)
+}
+
+// quotable says whether encoding/json honors ,string for t
+func quotable(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// enumValue parses one value from an enum tag as the field's type, so an
+// int field gets 1 rather than "1"
+func enumValue(t reflect.Type, value string) (any, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var parsed any
+	var err error
+	switch t.Kind() {
+	case reflect.String:
+		parsed = value
+	case reflect.Bool:
+		parsed, err = strconv.ParseBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err = strconv.ParseInt(value, 10, t.Bits())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err = strconv.ParseUint(value, 10, t.Bits())
+	case reflect.Float32, reflect.Float64:
+		parsed, err = strconv.ParseFloat(value, t.Bits())
+	default:
+		return nil, errors.New(fmt.Sprintf("enum only works on strings, numbers and booleans, not %s", t))
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("enum value %q is not a valid %s", value, t))
+	}
+	return parsed, nil
+}
+
+// QueryInto asks model for a T. the schema comes from SchemaFor[T], and
+// the response is validated against it before being unmarshaled
+func QueryInto[T any](ctx context.Context, model *Model, prompt string, images ...ImageContent) (T, error) {
+	var result T
+	schema, err := SchemaFor[T]()
+	if err != nil {
+		return result, err
+	}
+	query, err := model.MakeJSONQuery(prompt, schema, images...)
+	if err != nil {
+		return result, err
+	}
+	response, err := query.RunContext(ctx)
+	if err != nil {
+		return result, err
+	}
+	return decodeInto[T](response)
+}
+
+func decodeInto[T any](response string) (T, error) {
+	var result T
+	if err := json.Unmarshal([]byte(response), &result); err != nil {
+		return result, errors.New(fmt.Sprintf("Could not unmarshal response into %T: %v", result, err))
+	}
+	return result, nil
+}
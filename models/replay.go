@@ -0,0 +1,305 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	tiktoken "github.com/pkoukk/tiktoken-go"
+)
+
+// LM_RECORD=dir saves every request sent to a provider, and the response,
+// in dir. LM_REPLAY=dir answers requests from those recordings instead of
+// sending them, so the tests can run without a network or keys.
+//
+// recordings are keyed by a hash of the method, URL and body (JSON bodies
+// are compared by value), so identical requests share one. headers aren't
+// part of the key: they carry the keys and AWS signatures, which are
+// scrubbed before anything is written
+
+// one request and its response
+type recording struct {
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeaders http.Header `json:"request_headers"`
+	RequestBody    string      `json:"request_body"`
+	Status         int         `json:"status"`
+	Headers        http.Header `json:"headers"`
+	Body           string      `json:"body"`
+}
+
+const redacted = "REDACTED"
+
+// headers that hold credentials, or that identify the account
+var secretHeaders = []string{"Authorization", "Api-Key", "X-Api-Key", "X-Amz-Security-Token", "Cookie", "Set-Cookie", "Openai-Organization", "Openai-Project"}
+
+var openAIKeyPattern = regexp.MustCompile(`sk-[A-Za-z0-9_\-]{16,}`)
+
+// query parameters that hold credentials (presigned URLs and the like)
+var secretParams = regexp.MustCompile(`([?&](?:X-Amz-Signature|X-Amz-Credential|X-Amz-Security-Token|key|api_key)=)[^&]*`)
+
+type replayTransport struct {
+	dir string
+	// record sends requests and saves them; otherwise they're replayed
+	record bool
+	next   http.RoundTripper
+}
+
+var (
+	trafficOnce      sync.Once
+	trafficTransport http.RoundTripper
+)
+
+// setupTraffic picks the transport from LM_RECORD and LM_REPLAY the first
+// time anything is sent
+func setupTraffic() {
+	trafficOnce.Do(func() {
+		trafficTransport = http.DefaultTransport
+		if dir := os.Getenv("LM_REPLAY"); dir != "" {
+			trafficTransport = &replayTransport{dir: dir}
+		} else if dir := os.Getenv("LM_RECORD"); dir != "" {
+			trafficTransport = &replayTransport{dir: dir, record: true, next: http.DefaultTransport}
+		}
+	})
+}
+
+// HTTPClient is the client every provider request goes through. it
+// records or replays them if LM_RECORD or LM_REPLAY is set
+func HTTPClient() *http.Client {
+	setupTraffic()
+	return &http.Client{Transport: trafficTransport}
+}
+
+var tokenizerOnce sync.Once
+
+// useRecordedTokenizer sends the tokenizer's downloads through HTTPClient
+// when LM_RECORD or LM_REPLAY is set, so replays don't need the network for
+// them either. otherwise tiktoken's own loader is left alone
+func useRecordedTokenizer() {
+	tokenizerOnce.Do(func() {
+		if os.Getenv("LM_RECORD") != "" || replaying() {
+			tiktoken.SetBpeLoader(&tokenizerLoader{fallback: tiktoken.NewDefaultBpeLoader()})
+		}
+	})
+}
+
+type tokenizerLoader struct {
+	fallback tiktoken.BpeLoader
+}
+
+func (l *tokenizerLoader) LoadTiktokenBpe(file string) (map[string]int, error) {
+	if !strings.HasPrefix(file, "http") {
+		return l.fallback.LoadTiktokenBpe(file)
+	}
+	rep, err := HTTPClient().Get(file)
+	if err != nil {
+		return nil, err
+	}
+	defer rep.Body.Close()
+	contents, err := io.ReadAll(rep.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rep.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Could not download %s: %s", file, rep.Status))
+	}
+
+	// one "<base64 token> <rank>" per line
+	ranks := make(map[string]int)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == "" {
+			continue
+		}
+		token, rank, found := strings.Cut(line, " ")
+		if !found {
+			return nil, errors.New(fmt.Sprintf("%s: bad line %q", file, line))
+		}
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, err
+		}
+		ranks[string(decoded)], err = strconv.Atoi(rank)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ranks, nil
+}
+
+func replaying() bool {
+	return os.Getenv("LM_REPLAY") != ""
+}
+
+// AWSConfig loads the AWS configuration, sending requests through the
+// recorder when LM_RECORD or LM_REPLAY is set. replays don't need real
+// credentials, since nothing is sent
+func AWSConfig(ctx context.Context) (aws.Config, error) {
+	options := []func(*config.LoadOptions) error{config.WithRegion("us-east-1")}
+	if replaying() {
+		options = append(options, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("replay", "replay", "")))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return cfg, err
+	}
+
+	setupTraffic()
+	if transport, ok := trafficTransport.(*replayTransport); ok {
+		// the SDK sets up its own transport (AWS_CA_BUNDLE and so on), so
+		// record through that one
+		wrapped := *transport
+		if buildable, ok := cfg.HTTPClient.(*awshttp.BuildableClient); ok && wrapped.record {
+			wrapped.next = buildable.GetTransport()
+		}
+		cfg.HTTPClient = &http.Client{Transport: &wrapped}
+	}
+	return cfg, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	requestBody := []byte{}
+	if req.Body != nil {
+		var err error
+		requestBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(requestBody))
+	}
+	key := requestKey(req, requestBody)
+	file := filepath.Join(t.dir, key+".json")
+
+	if !t.record {
+		contents, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errors.New(fmt.Sprintf("no recording of %s %s in %s (record one with LM_RECORD=%s)", req.Method, scrubURL(req.URL.String()), t.dir, t.dir))
+		} else if err != nil {
+			return nil, err
+		}
+		var saved recording
+		if err := json.Unmarshal(contents, &saved); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %v", file, err))
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", saved.Status, http.StatusText(saved.Status)),
+			StatusCode:    saved.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        saved.Headers,
+			Body:          io.NopCloser(strings.NewReader(saved.Body)),
+			ContentLength: int64(len(saved.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	rep, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(rep.Body)
+	rep.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	rep.Body = io.NopCloser(bytes.NewReader(body))
+
+	// replays hand back the body as read, so the encoding is already undone
+	headers := scrubHeaders(rep.Header)
+	headers.Del("Content-Encoding")
+	headers.Del("Content-Length")
+	saved := recording{
+		Method:         req.Method,
+		URL:            scrubURL(req.URL.String()),
+		RequestHeaders: scrubHeaders(req.Header),
+		RequestBody:    scrubSecrets(string(requestBody)),
+		Status:         rep.StatusCode,
+		Headers:        headers,
+		Body:           scrubSecrets(string(body)),
+	}
+	contents, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, contents, 0644); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// requestKey hashes what identifies a request: the method, the URL and the
+// body. JSON bodies are re-encoded so key order and spacing don't matter,
+// and multipart boundaries (random per request) are replaced
+func requestKey(req *http.Request, body []byte) string {
+	if _, params, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err == nil && params["boundary"] != "" {
+		body = bytes.ReplaceAll(body, []byte(params["boundary"]), []byte("boundary"))
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value any
+	if decoder.Decode(&value) == nil {
+		if canonical, err := json.Marshal(value); err == nil {
+			body = canonical
+		}
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n", req.Method, scrubURL(req.URL.String()))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func scrubHeaders(headers http.Header) http.Header {
+	scrubbed := headers.Clone()
+	if scrubbed == nil {
+		scrubbed = http.Header{}
+	}
+	for _, name := range secretHeaders {
+		if scrubbed.Get(name) != "" {
+			scrubbed.Set(name, redacted)
+		}
+	}
+	for name, values := range scrubbed {
+		for i := range values {
+			values[i] = scrubSecrets(values[i])
+		}
+		scrubbed[name] = values
+	}
+	return scrubbed
+}
+
+func scrubURL(url string) string {
+	return scrubSecrets(secretParams.ReplaceAllString(url, "${1}"+redacted))
+}
+
+// scrubSecrets removes any credentials in the environment, and anything
+// that looks like an OpenAI key, from s
+func scrubSecrets(s string) string {
+	for _, name := range []string{"OPENAI_API_KEY", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		if secret := os.Getenv(name); len(secret) >= 8 {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return openAIKeyPattern.ReplaceAllString(s, redacted)
+}
@@ -0,0 +1,323 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// types allowed in OpenAI strict mode
+var strictTypes = map[string]bool{
+	"string": true, "number": true, "integer": true, "boolean": true,
+	"object": true, "array": true, "null": true,
+}
+
+// CheckStrictSchema returns the reasons schema can't be used with
+// OpenAI's strict structured output mode, or nothing if it can
+func CheckStrictSchema(schema json.RawMessage) []string {
+	var root any
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return []string{fmt.Sprintf("not valid JSON: %v", err)}
+	}
+	object, ok := root.(map[string]any)
+	if !ok {
+		return []string{"the schema must be a JSON object"}
+	}
+
+	problems := make([]string, 0)
+	if _, ok := object["anyOf"]; ok {
+		problems = append(problems, "the root schema must not be anyOf")
+	}
+	if object["type"] != "object" {
+		problems = append(problems, "the root schema must have type object")
+	}
+	checkStrictNode(object, "#", &problems)
+	return problems
+}
+
+func checkStrictNode(node map[string]any, location string, problems *[]string) {
+	types := make([]string, 0)
+	switch t := node["type"].(type) {
+	case string:
+		types = append(types, t)
+	case []any:
+		for _, item := range t {
+			name, _ := item.(string)
+			types = append(types, name)
+		}
+	case nil:
+		if _, ok := node["anyOf"]; !ok {
+			if _, ok := node["enum"]; !ok {
+				*problems = append(*problems, fmt.Sprintf("%s: no type", location))
+			}
+		}
+	}
+	for _, name := range types {
+		if !strictTypes[name] {
+			*problems = append(*problems, fmt.Sprintf("%s: unsupported type %q", location, name))
+		}
+	}
+
+	if anyOf, ok := node["anyOf"].([]any); ok {
+		for i, option := range anyOf {
+			if child, ok := option.(map[string]any); ok {
+				checkStrictNode(child, fmt.Sprintf("%s/anyOf/%d", location, i), problems)
+			}
+		}
+	}
+
+	for _, name := range types {
+		switch name {
+		case "object":
+			checkStrictObject(node, location, problems)
+		case "array":
+			items, ok := node["items"].(map[string]any)
+			if !ok {
+				*problems = append(*problems, fmt.Sprintf("%s: arrays need an items schema", location))
+				continue
+			}
+			checkStrictNode(items, location+"/items", problems)
+		}
+	}
+}
+
+func checkStrictObject(node map[string]any, location string, problems *[]string) {
+	if additional, ok := node["additionalProperties"].(bool); !ok || additional {
+		*problems = append(*problems, fmt.Sprintf("%s: objects must set additionalProperties to false", location))
+	}
+	properties, _ := node["properties"].(map[string]any)
+	required := make(map[string]bool)
+	if list, ok := node["required"].([]any); ok {
+		for _, item := range list {
+			if name, ok := item.(string); ok {
+				required[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !required[name] {
+			*problems = append(*problems, fmt.Sprintf("%s: property %s must be required (make it nullable instead)", location, name))
+		}
+		if child, ok := properties[name].(map[string]any); ok {
+			checkStrictNode(child, location+"/properties/"+name, problems)
+		}
+	}
+}
+
+// ValidateJSON checks document against schema, returning what's wrong
+// with it (nothing if it's valid). the error is for invalid schemas
+func ValidateJSON(schema *JSONSchema, document string) ([]string, error) {
+	compiled, err := compileSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	return validateResponse(document, compiled), nil
+}
+
+// InferSchema builds a strict schema from a sample JSON object, without
+// asking a model. every property seen is required; properties missing
+// from some of the objects in an array, or null in the sample, are
+// nullable. the result is deterministic and keeps the sample's key order
+func InferSchema(sample []byte) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(sample))
+	decoder.UseNumber()
+	value, err := decodeOrdered(decoder)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("sample is not valid JSON: %v", err))
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("sample has more than one JSON value")
+	}
+	if value.kind != "object" {
+		return nil, errors.New(fmt.Sprintf("strict schemas need an object at the top level, not %s", value.kind))
+	}
+
+	var root inferredType
+	root.observe(value)
+	return json.Marshal(root.schema())
+}
+
+// orderedValue is a decoded JSON value that remembers object key order
+type orderedValue struct {
+	kind   string // object, array, string, integer, number, boolean or null
+	keys   []string
+	fields map[string]orderedValue
+	items  []orderedValue
+}
+
+func decodeOrdered(decoder *json.Decoder) (orderedValue, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return orderedValue{}, err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '{' {
+			value := orderedValue{kind: "object", fields: map[string]orderedValue{}}
+			for decoder.More() {
+				keyToken, err := decoder.Token()
+				if err != nil {
+					return value, err
+				}
+				key := keyToken.(string)
+				field, err := decodeOrdered(decoder)
+				if err != nil {
+					return value, err
+				}
+				if _, seen := value.fields[key]; !seen {
+					value.keys = append(value.keys, key)
+				}
+				value.fields[key] = field
+			}
+			_, err := decoder.Token()
+			return value, err
+		}
+		value := orderedValue{kind: "array"}
+		for decoder.More() {
+			item, err := decodeOrdered(decoder)
+			if err != nil {
+				return value, err
+			}
+			value.items = append(value.items, item)
+		}
+		_, err := decoder.Token()
+		return value, err
+	case string:
+		return orderedValue{kind: "string"}, nil
+	case bool:
+		return orderedValue{kind: "boolean"}, nil
+	case json.Number:
+		if _, err := t.Int64(); err == nil && !strings.ContainsAny(t.String(), ".eE") {
+			return orderedValue{kind: "integer"}, nil
+		}
+		return orderedValue{kind: "number"}, nil
+	}
+	return orderedValue{kind: "null"}, nil
+}
+
+// inferredType accumulates every value seen at one place in the sample
+type inferredType struct {
+	types    []string
+	nullable bool
+
+	// objects
+	objects int
+	keys    []string
+	fields  map[string]*inferredType
+	seen    map[string]int
+
+	// arrays
+	items *inferredType
+}
+
+func (t *inferredType) addType(name string) {
+	for _, existing := range t.types {
+		if existing == name {
+			return
+		}
+	}
+	t.types = append(t.types, name)
+}
+
+func (t *inferredType) observe(value orderedValue) {
+	switch value.kind {
+	case "null":
+		t.nullable = true
+	case "object":
+		t.addType("object")
+		t.objects++
+		if t.fields == nil {
+			t.fields = make(map[string]*inferredType)
+			t.seen = make(map[string]int)
+		}
+		for _, key := range value.keys {
+			field, ok := t.fields[key]
+			if !ok {
+				field = &inferredType{}
+				t.fields[key] = field
+				t.keys = append(t.keys, key)
+			}
+			field.observe(value.fields[key])
+			t.seen[key]++
+		}
+	case "array":
+		t.addType("array")
+		if t.items == nil {
+			t.items = &inferredType{}
+		}
+		for _, item := range value.items {
+			t.items.observe(item)
+		}
+	default:
+		t.addType(value.kind)
+	}
+}
+
+func (t *inferredType) schema() *schemaNode {
+	types := make([]string, 0, len(t.types))
+	hasNumber := false
+	for _, name := range t.types {
+		hasNumber = hasNumber || name == "number"
+	}
+	for _, name := range t.types {
+		// 1 and 1.5 in the same place means numbers
+		if name == "integer" && hasNumber {
+			continue
+		}
+		types = append(types, name)
+	}
+
+	switch len(types) {
+	case 0:
+		return &schemaNode{Type: "null"}
+	case 1:
+		node := t.schemaFor(types[0])
+		if t.nullable {
+			node.Type = []string{types[0], "null"}
+		}
+		return node
+	}
+	options := make([]*schemaNode, 0, len(types)+1)
+	for _, name := range types {
+		options = append(options, t.schemaFor(name))
+	}
+	if t.nullable {
+		options = append(options, &schemaNode{Type: "null"})
+	}
+	return &schemaNode{AnyOf: options}
+}
+
+func (t *inferredType) schemaFor(name string) *schemaNode {
+	switch name {
+	case "object":
+		properties := make(schemaProperties, 0, len(t.keys))
+		for _, key := range t.keys {
+			field := t.fields[key]
+			if t.seen[key] < t.objects {
+				// only in some of the objects
+				field.nullable = true
+			}
+			properties = append(properties, schemaProperty{name: key, schema: field.schema()})
+		}
+		required := append([]string{}, t.keys...)
+		noAdditionalProperties := false
+		return &schemaNode{Type: "object", Properties: &properties, Required: required, AdditionalProperties: &noAdditionalProperties}
+	case "array":
+		items := &schemaNode{Type: "string", Description: "no examples in the sample"}
+		if t.items != nil && (len(t.items.types) > 0 || t.items.nullable) {
+			items = t.items.schema()
+		}
+		return &schemaNode{Type: "array", Items: items}
+	}
+	return &schemaNode{Type: name}
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+)
+
+// Usage is how many tokens a query used, as reported by the provider.
+// repair attempts for JSON queries are included
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func (u *Usage) Add(other Usage) {
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+}
+
+func (u Usage) TotalTokens() int {
+	return u.InputTokens + u.OutputTokens
+}
+
+// openai and llama-server report usage the same way
+type responseUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+func (u responseUsage) usage() Usage {
+	return Usage{InputTokens: u.PromptTokens, OutputTokens: u.CompletionTokens}
+}
+
+func converseUsage(result *bedrockruntime.ConverseOutput) Usage {
+	var usage Usage
+	if result.Usage == nil {
+		return usage
+	}
+	if result.Usage.InputTokens != nil {
+		usage.InputTokens = int(*result.Usage.InputTokens)
+	}
+	if result.Usage.OutputTokens != nil {
+		usage.OutputTokens = int(*result.Usage.OutputTokens)
+	}
+	return usage
+}
+
+// RunWithUsage is RunContext, but also says how many tokens were used
+func (q *Query) RunWithUsage(ctx context.Context) (string, Usage, error) {
+	var usage Usage
+	send := func(attempt *Query) (string, error) {
+		response, attemptUsage, err := attempt.send(ctx)
+		usage.Add(attemptUsage)
+		return response, err
+	}
+	var response string
+	var err error
+	if q.validateJSON {
+		response, err = q.runValidated(send)
+	} else {
+		response, err = send(q)
+	}
+	return response, usage, err
+}
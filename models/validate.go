@@ -0,0 +1,149 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	jsonschema "github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// how many times a JSON query re-prompts the model with the problems in
+// its last answer before giving up
+const defaultRepairAttempts = 2
+
+// ValidationError is returned by Query.Run when the model still hasn't
+// produced valid JSON after all its repair attempts
+type ValidationError struct {
+	// the model's last response
+	Response string
+	Problems []string
+	Attempts int
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("response did not match the JSON schema after %d attempt(s): %s", e.Attempts, strings.Join(e.Problems, "; "))
+}
+
+// SetRepairAttempts sets how many times the query re-prompts the model
+// when its response isn't valid JSON or doesn't match the schema. 0
+// disables repairs (responses are still validated)
+func (q *Query) SetRepairAttempts(attempts int) {
+	q.repairAttempts = attempts
+}
+
+// compileSchema compiles a response schema for validation
+func compileSchema(schema *JSONSchema) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	url := "schema.json"
+	if schema.Name != "" {
+		url = schema.Name + ".json"
+	}
+	if err := compiler.AddResource(url, bytes.NewReader(schema.Schema)); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid JSON schema %s: %v", schema.Name, err))
+	}
+	compiled, err := compiler.Compile(url)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid JSON schema %s: %v", schema.Name, err))
+	}
+	return compiled, nil
+}
+
+// stripCodeFence removes the ```json fence models without a JSON mode
+// like to wrap their answers in
+func stripCodeFence(response string) string {
+	trimmed := strings.TrimSpace(response)
+	if !strings.HasPrefix(trimmed, "```") || !strings.HasSuffix(trimmed, "```") || len(trimmed) < 6 {
+		return response
+	}
+	trimmed = strings.TrimSuffix(strings.TrimPrefix(trimmed, "```"), "```")
+	if newline := strings.Index(trimmed, "\n"); newline >= 0 {
+		trimmed = trimmed[newline+1:]
+	}
+	return strings.TrimSpace(trimmed)
+}
+
+// validateResponse returns everything wrong with response, or nothing
+// if it's acceptable
+func validateResponse(response string, schema *jsonschema.Schema) []string {
+	var value any
+	decoder := json.NewDecoder(strings.NewReader(response))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err == nil && decoder.More() {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("the response is not valid JSON: %v", err)}
+	}
+	if schema == nil {
+		return nil
+	}
+
+	err = schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return []string{err.Error()}
+	}
+
+	// only the leaves say what's actually wrong
+	problems := make([]string, 0)
+	for _, basic := range validationErr.BasicOutput().Errors {
+		if basic.Error == "" || strings.HasPrefix(basic.Error, "doesn't validate with") {
+			continue
+		}
+		location := basic.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		problems = append(problems, fmt.Sprintf("%s: %s", location, basic.Error))
+	}
+	if len(problems) == 0 {
+		problems = append(problems, validationErr.Error())
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func repairPrompt(problems []string) string {
+	return "Your response was not valid:\n- " + strings.Join(problems, "\n- ") +
+		"\nRespond again with only the corrected JSON."
+}
+
+// runValidated runs a JSON query through send, re-prompting the model
+// with whatever was wrong with its response until it's valid or the
+// attempts run out
+func (q *Query) runValidated(send func(*Query) (string, error)) (string, error) {
+	var schema *jsonschema.Schema
+	if q.schema != nil {
+		var err error
+		schema, err = compileSchema(q.schema)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	attempt := *q
+	attempt.messages = append([]requestMessage{}, q.messages...)
+	for tries := 1; ; tries++ {
+		response, err := send(&attempt)
+		if err != nil {
+			return "", err
+		}
+		response = stripCodeFence(response)
+		problems := validateResponse(response, schema)
+		if len(problems) == 0 {
+			return response, nil
+		}
+		if tries > q.repairAttempts {
+			return response, &ValidationError{Response: response, Problems: problems, Attempts: tries}
+		}
+		attempt.messages = append(attempt.messages, *createAssistantMessage(response), *createUserTextMessage(repairPrompt(problems)))
+	}
+}
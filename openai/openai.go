@@ -1,420 +1,112 @@
+// Package openai is what lm used before it supported providers other than
+// OpenAI.
+//
+// Deprecated: use the models package. everything here is a thin wrapper
+// around it, kept so existing callers keep compiling
 package openai
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
 
-	tiktoken "github.com/pkoukk/tiktoken-go"
+	models "github.com/WillChangeThisLater/lm/models"
 )
 
+// OpenAIModel is a models.Model from the openai provider.
+//
+// Deprecated: use models.Model
 type OpenAIModel struct {
-	ModelId                  string `json:"model_id"`
-	ContextWindowSize        int    `json:"context_window_size"`
-	TokenizerName            string `json:"tokenizer_name"`
-	SupportsImageOutput      bool   `json:"supports_image"`
-	SupportsUnstructuredJson bool   `json:"supports_unstructured_json"`
-	SupportsStructuredJson   bool   `json:"supports_structured_json"`
-}
-
-var models = map[string]OpenAIModel{
-	"gpt-3.5-turbo": {"gpt-3.5-turbo", 4096, "cl100k_base", false, false, false},
-	"gpt-4":         {"gpt-4", 8192, "cl100k_base", false, false, false},
-	"gpt-4o":        {"gpt-4o", 128000, "cl100k_base", true, true, false},
-	"gpt-4-turbo":   {"gpt-4-turbo", 128000, "cl100k_base", true, true, false},
-	"gpt-4o-mini":   {"gpt-4o-mini", 128000, "cl100k_base", true, true, true},
+	*models.Model
 }
 
+// Query wraps models.Query.
+//
+// Deprecated: use models.Query
 type Query struct {
-	messages       []requestMessage
-	responseFormat *responseFormat
-	model          *OpenAIModel
-}
-
-type contentType interface{}
-
-type textContent struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
-}
-
-type imageURL struct {
-	URL string `json:"url"`
-}
-
-type imageContent struct {
-	Type     string   `json:"type"`
-	ImageURL imageURL `json:"image_url"`
-}
-
-type requestMessage struct {
-	Role    string        `json:"role"`
-	Content []contentType `json:"content"`
-}
-
-type responseMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
-
-type JSONSchema struct {
-	Name   string          `json:"name"`
-	Schema json.RawMessage `json:"schema"`
-	Strict bool            `json:"strict"`
-}
-
-type responseFormat struct {
-	Type string `json:"type"`
-
-	// optional
-	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
-}
-
-// See: https://platform.openai.com/docs/api-reference/chat/create for more info
-type request struct {
-	// required
-	Model    string           `json:"model"`
-	Messages []requestMessage `json:"messages"`
-
-	// optional
-	ResponseFormat *responseFormat `json:"response_format,omitempty"`
-}
-
-type choice struct {
-	Index   int64
-	Message responseMessage
-}
-
-type errorMessage struct {
-	Message string `json:"message"`
-	Type    string `json:"type"`
+	*models.Query
 }
 
-type response struct {
-	Id      string       `json:"id"`
-	Created int64        `json:"created"`
-	Model   string       `json:"model"`
-	Choices []choice     `json:"choices"`
-	Error   errorMessage `json:"error"`
-}
+// Deprecated: use models.JSONSchema
+type JSONSchema = models.JSONSchema
 
-func getLargestModel() *OpenAIModel {
-	var largestModel *OpenAIModel
-	largestModelContext := 0
-	for _, model := range models {
-		if model.ContextWindowSize > largestModelContext {
-			largestModelContext = model.ContextWindowSize
-			largestModel = &model
+// openAIModels returns the registered models this package used to know about
+func openAIModels() map[string]*models.Model {
+	openAIModels := make(map[string]*models.Model)
+	for _, modelID := range models.ModelIds() {
+		model := models.GetModelNoError(modelID)
+		if model.Provider == "openai" {
+			openAIModels[modelID] = model
 		}
 	}
-	return largestModel
-}
-
-func (m *OpenAIModel) FlightCheck(needsImage bool, needsUnstructuredJSON bool, needsStructuredJSON bool) (bool, string) {
-	if needsImage && !m.SupportsImageOutput {
-		return false, "Model does not support image output"
-	}
-	if needsUnstructuredJSON && !m.SupportsUnstructuredJson {
-		return false, "Model does not support unstructured JSON"
-	}
-	if needsStructuredJSON && !m.SupportsStructuredJson {
-		return false, "Model does not support structured JSON"
-	}
-	return true, ""
+	return openAIModels
 }
 
-// TODO: maybe add context here?
+// Deprecated: use models.SuggestedModel
 func SuggestedModel(needsImage bool, needsUnstructuredJSON bool, needsStructuredJSON bool) (*OpenAIModel, error) {
-	for _, model := range models {
+	for _, model := range openAIModels() {
 		valid, _ := model.FlightCheck(needsImage, needsUnstructuredJSON, needsStructuredJSON)
 		if valid {
-			return &model, nil
+			return &OpenAIModel{model}, nil
 		}
 	}
 	return nil, errors.New("Could not find suggested model given your constraints")
 }
 
+// Deprecated: use models.ModelInfoString
 func ModelInfoString() string {
-	result, err := json.Marshal(models)
+	result, err := json.Marshal(openAIModels())
 	if err != nil {
 		return fmt.Sprintf("Could not get model info: %v", err)
 	}
 	return string(result)
 }
 
-func hasModel(modelID string) bool {
-	_, ok := models[modelID]
-	return ok
-}
-
-// TODO: refactor this
-// used by prompts.go to get model when initing a mapping
+// Deprecated: use models.GetModelNoError
 func GetModelNoError(modelID string) *OpenAIModel {
-	model, ok := models[modelID]
-	if !ok {
+	model, err := GetModel(modelID)
+	if err != nil {
 		panic("Could not find model")
 	}
-	return &model
+	return model
 }
 
+// Deprecated: use models.GetModel, which also knows about Bedrock and
+// local models
 func GetModel(modelID string) (*OpenAIModel, error) {
-	model, ok := models[modelID]
+	model, ok := openAIModels()[modelID]
 	if !ok {
 		modelNames := make([]string, 0)
-		for key := range models {
+		for key := range openAIModels() {
 			modelNames = append(modelNames, key)
 		}
 		return nil, errors.New(fmt.Sprintf("Model %s not found. valid models are %v", modelID, modelNames))
 	}
-	return &model, nil
-}
-
-func (m *OpenAIModel) getAPIKey() (string, error) {
-	apiKey, set := os.LookupEnv("OPENAI_API_KEY")
-	if !set {
-		return "", errors.New("OPENAI_API_KEY not set")
-	}
-	return apiKey, nil
-}
-
-func (m *OpenAIModel) tokenize(query string) ([]int, error) {
-
-	// this could change...
-	tokenizer, err := tiktoken.GetEncoding(m.TokenizerName)
-	if err != nil {
-		return nil, err
-	}
-	tokens := tokenizer.Encode(query, nil, nil)
-	return tokens, nil
-}
-
-func (m *OpenAIModel) countTokens(query string) (int, error) {
-	tokens, err := m.tokenize(query)
-	if err != nil {
-		return -1, err
-	}
-	return len(tokens), nil
+	return &OpenAIModel{model}, nil
 }
 
-func (m *OpenAIModel) Query(prompt string) (string, error) {
-	// Convenience method
-	query, err := m.MakeQuery(prompt)
-	if err != nil {
-		return "", err
-	}
-	return query.Run()
-}
-
-func createSystemMessage(systemPrompt string) *requestMessage {
-	if systemPrompt != "" {
-		systemPrompt = "You are a helpful AI system"
-	}
-	content := contentType(textContent{Type: "text", Text: systemPrompt})
-	systemMessage := requestMessage{Role: "system", Content: []contentType{content}}
-	return &systemMessage
-}
-
-func createUserTextMessage(prompt string) *requestMessage {
-	content := contentType(textContent{Type: "text", Text: prompt})
-	systemMessage := requestMessage{Role: "user", Content: []contentType{content}}
-	return &systemMessage
-}
-
-func createUserImageMessages(prompt string, imageURLs ...string) *requestMessage {
-	contentList := make([]contentType, 0)
-	contentList = append(contentList, contentType(textContent{Type: "text", Text: prompt}))
+func imagesFromURLs(imageURLs []string) []models.ImageContent {
+	images := make([]models.ImageContent, 0, len(imageURLs))
 	for _, url := range imageURLs {
-		content := imageContent{Type: "image_url", ImageURL: imageURL{URL: url}}
-		contentList = append(contentList, content)
-
-	}
-	systemMessage := requestMessage{Role: "user", Content: contentList}
-	return &systemMessage
-}
-
-func getJSONModelIds(structured bool) []string {
-	modelsWithJSON := make([]string, 0)
-	for _, model := range models {
-		if structured && model.SupportsStructuredJson {
-			modelsWithJSON = append(modelsWithJSON, model.ModelId)
-		} else if !structured && model.SupportsUnstructuredJson {
-			modelsWithJSON = append(modelsWithJSON, model.ModelId)
-		}
-	}
-	return modelsWithJSON
-}
-
-func getVisionModelIds() []string {
-	modelsWithVision := make([]string, 0)
-	for _, model := range models {
-		if model.SupportsImageOutput {
-			modelsWithVision = append(modelsWithVision, model.ModelId)
-		}
+		images = append(images, models.ImageFromURL(url))
 	}
-	return modelsWithVision
+	return images
 }
 
+// Deprecated: use models.Model.MakeQuery
 func (m *OpenAIModel) MakeQuery(prompt string, imageURLs ...string) (*Query, error) {
-	// TODO: add messages for any image URLs that are passed in
-	systemMessage := createSystemMessage("")
-	var userMessage *requestMessage
-
-	if len(imageURLs) > 0 && !m.SupportsImageOutput {
-		return nil, errors.New(fmt.Sprintf("Model %s does not support images. Models that do: %v", m.ModelId, getVisionModelIds()))
-	}
-
-	if len(imageURLs) == 0 {
-		userMessage = createUserTextMessage(prompt)
-	} else {
-		userMessage = createUserImageMessages(prompt, imageURLs...)
-	}
-
-	q := Query{messages: []requestMessage{*systemMessage, *userMessage}, model: m}
-	return &q, nil
-}
-
-func (m *OpenAIModel) MakeJSONQuery(prompt string, schema *JSONSchema, imageURLs ...string) (*Query, error) {
-	if len(imageURLs) > 0 && !m.SupportsImageOutput {
-		return nil, errors.New(fmt.Sprintf("Model %s does not support images. Models that do: %v", m.ModelId, getVisionModelIds()))
-	}
-
-	var jsonFormat responseFormat
-	if schema == nil {
-		if !m.SupportsUnstructuredJson {
-			return nil, errors.New(fmt.Sprintf("Model %s does not support unstructured JSON output. Models that might: %v", m.ModelId, getJSONModelIds(false)))
-		}
-		jsonFormat = responseFormat{Type: "json_object"}
-	} else {
-		if !m.SupportsStructuredJson {
-			return nil, errors.New(fmt.Sprintf("Model %s does not support structured JSON output. Models that might: %v", m.ModelId, getJSONModelIds(true)))
-		}
-		jsonFormat = responseFormat{Type: "json_schema", JSONSchema: schema}
-	}
-
-	systemMessage := createSystemMessage("")
-	jsonMessage := createUserTextMessage("JSON output only.")
-	var userMessage *requestMessage
-
-	if len(imageURLs) == 0 {
-		userMessage = createUserTextMessage(prompt)
-	} else {
-		userMessage = createUserImageMessages(prompt, imageURLs...)
-	}
-	q := Query{messages: []requestMessage{*systemMessage, *jsonMessage, *userMessage}, responseFormat: &jsonFormat, model: m}
-	return &q, nil
-}
-
-func (q *Query) approxTokenCount() (int, error) {
-	model := q.model
-	tokenCount := 0
-
-	for _, message := range q.messages {
-		for _, content := range message.Content {
-			v, ok := content.(textContent)
-			if ok {
-				count, err := model.countTokens(v.Text)
-				if err != nil {
-					return -1, err
-				}
-				tokenCount += count
-			}
-
-		}
-	}
-
-	approxCount := float64(tokenCount) * 1.1
-	return int(approxCount), nil
-}
-
-func (q *Query) checkTokens() error {
-	model := q.model
-	approxTokenCount, err := q.approxTokenCount()
+	query, err := m.Model.MakeQuery(prompt, imagesFromURLs(imageURLs)...)
 	if err != nil {
-		return err
-	}
-
-	if approxTokenCount > model.ContextWindowSize {
-		errorMessage := fmt.Sprintf("Your query has too many tokens (%d).", approxTokenCount)
-		largestModel := getLargestModel()
-		if largestModel.ContextWindowSize < approxTokenCount {
-			errorMessage += fmt.Sprintf(" The largest model, %s, supports %d tokens", largestModel.ModelId, largestModel.ContextWindowSize)
-			return errors.New(errorMessage)
-		}
-
-		biggerModels := make([]string, 0)
-		for modelId, model := range models {
-			contextLength := model.ContextWindowSize
-			if contextLength > approxTokenCount {
-				biggerModels = append(biggerModels, modelId)
-			}
-		}
-
-		errorMessage += fmt.Sprintf(" Try one of these models instead: %v", biggerModels)
-		return errors.New(errorMessage)
+		return nil, err
 	}
-
-	return nil
-}
-
-func (q *Query) toRequest() (*request, error) {
-	model := q.model
-	return &request{Model: model.ModelId, Messages: q.messages, ResponseFormat: q.responseFormat}, nil
+	return &Query{query}, nil
 }
 
-func (q *Query) Run() (string, error) {
-	model := q.model
-
-	apiKey, err := model.getAPIKey()
-	if err != nil {
-		return "", err
-	}
-
-	err = q.checkTokens()
-	if err != nil {
-		return "", err
-	}
-
-	request, err := q.toRequest()
-	if err != nil {
-		return "", err
-	}
-
-	requestBodyAsJSON, err := json.Marshal(request)
-	if err != nil {
-		return "", err
-	}
-
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewReader(requestBodyAsJSON))
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
-	req.Header.Add("Content-Type", "application/json")
-	rep, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-
-	responseStruct := &response{}
-	contents, err := io.ReadAll(rep.Body)
-	if err != nil {
-		return "", err
-	}
-
-	err = json.Unmarshal(contents, responseStruct)
+// Deprecated: use models.Model.MakeJSONQuery
+func (m *OpenAIModel) MakeJSONQuery(prompt string, schema *JSONSchema, imageURLs ...string) (*Query, error) {
+	query, err := m.Model.MakeJSONQuery(prompt, schema, imagesFromURLs(imageURLs)...)
 	if err != nil {
-		return "", err
-	}
-
-	if responseStruct.Error.Message != "" {
-		return "", errors.New(responseStruct.Error.Message)
+		return nil, err
 	}
-
-	return responseStruct.Choices[0].Message.Content, nil
+	return &Query{query}, nil
 }
@@ -3,9 +3,12 @@ package openai
 import (
 	"encoding/json"
 	"math/rand"
+	"os"
 	"strings"
 	"testing"
 	"time"
+
+	replaytest "github.com/WillChangeThisLater/lm/internal/replaytest"
 )
 
 const charset = "abcdefghijklmnopqrstuvwxyz" +
@@ -37,8 +40,24 @@ type Steps struct {
 	Steps []Step `json:"steps"`
 }
 
-func TestModels(t *testing.T) {
+// whether anything can answer provider requests: recordings in
+// testdata/recordings (make them with LM_RECORD=testdata/recordings go
+// test ./openai) or an OPENAI_API_KEY. tests that need one skip without
+var providersAvailable bool
+
+func TestMain(m *testing.M) {
+	providersAvailable = replaytest.Setup("testdata/recordings")
+	os.Exit(m.Run())
+}
+
+func skipOffline(t *testing.T) {
+	if !providersAvailable {
+		t.Skip("no OPENAI_API_KEY and no recordings in testdata/recordings")
+	}
+}
 
+func TestModels(t *testing.T) {
+	skipOffline(t)
 	// we shouldn't be able to make a model with an invalid name
 	_, err := GetModel("bad-model-id")
 	if err == nil {
@@ -71,6 +90,7 @@ func TestModels(t *testing.T) {
 }
 
 func TestJSONOutputUnstructured(t *testing.T) {
+	skipOffline(t)
 	jsonModel, _ := GetModel("gpt-4o-mini")
 	badModel, _ := GetModel("gpt-3.5-turbo")
 
@@ -107,6 +127,7 @@ func TestJSONOutputUnstructured(t *testing.T) {
 }
 
 func TestJSONOutputStructured(t *testing.T) {
+	skipOffline(t)
 	jsonModel, _ := GetModel("gpt-4o-mini")
 	jsonStructure := []byte(`{"type": "object", "properties": {"steps": {"type": "array", "items": {"type": "object", "properties": {"explanation": {"type": "string"}, "output": {"type": "string"}}, "required": ["explanation", "output"], "additionalProperties": false}}, "final_answer": {"type": "string"}}, "required": ["steps", "final_answer"], "additionalProperties": false}`)
 	schema := JSONSchema{Name: "test-json", Schema: jsonStructure, Strict: true}
@@ -133,6 +154,7 @@ func TestJSONOutputStructured(t *testing.T) {
 }
 
 func TestVision(t *testing.T) {
+	skipOffline(t)
 	visionModel, _ := GetModel("gpt-4o")
 	imageURL := "https://upload.wikimedia.org/wikipedia/commons/thumb/e/ec/Mona_Lisa%2C_by_Leonardo_da_Vinci%2C_from_C2RMF_retouched.jpg/1024px-Mona_Lisa%2C_by_Leonardo_da_Vinci%2C_from_C2RMF_retouched.jpg"
 	query, err := visionModel.MakeQuery("Who painted this?", imageURL)
@@ -148,3 +170,26 @@ func TestVision(t *testing.T) {
 		t.Errorf("Expected 'leonardo da vinci' to be in the result but it was not found")
 	}
 }
+
+func TestShim(t *testing.T) {
+	// only OpenAI models were ever available through this package
+	if _, err := GetModel("aws-nova-lite"); err == nil {
+		t.Errorf("Should not have been able to get a Bedrock model from the openai package")
+	}
+
+	visionModel, err := GetModel("gpt-4o")
+	if err != nil {
+		t.Fatalf("Should have been able to get gpt-4o: %v", err)
+	}
+	if _, err := visionModel.MakeQuery("Who painted this?", "https://example.com/mona-lisa.jpg"); err != nil {
+		t.Errorf("Could not create vision query: %v", err)
+	}
+
+	textModel, _ := GetModel("gpt-4")
+	if _, err := textModel.MakeQuery("Who painted this?", "https://example.com/mona-lisa.jpg"); err == nil {
+		t.Errorf("gpt-4 should not accept images")
+	}
+	if ok, _ := textModel.FlightCheck(false, false, true); ok {
+		t.Errorf("gpt-4 should not support structured JSON")
+	}
+}
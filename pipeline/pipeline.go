@@ -0,0 +1,264 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// a pipeline chains lm calls, like the bash scripts that summarize a doc
+// and feed the summary into a bigger prompt. it's a YAML (or JSON) file:
+//
+//	inputs:
+//	  doc:                      # no default, so it has to be passed in
+//	  audience: engineers
+//	steps:
+//	  - id: summary
+//	    prompt: "Summarize this for {{ inputs.audience }}: {{ inputs.doc }}"
+//	  - id: sentiment
+//	    template: sentiment-single
+//	    input: "{{ inputs.doc }}"
+//	    extract:
+//	      label: .sentiment
+//	  - id: report
+//	    model: gpt-4o
+//	    prompt: |
+//	      Write a report. Overall sentiment: {{ fields.sentiment.label }}
+//	      {{ steps.summary }}
+//
+// every string is a pongo2 template that can use inputs.<name>, the
+// output of earlier steps as steps.<id>, and values extracted from their
+// JSON output as fields.<id>.<name>. steps depend on the steps they
+// mention (or list in needs), and run as soon as those are done
+
+type Pipeline struct {
+	Name string `yaml:"name"`
+	// default model for steps that don't set one (templates bring their own)
+	Model string `yaml:"model"`
+	// inputs and their defaults. stdin is available as inputs.stdin
+	Inputs map[string]*string `yaml:"inputs"`
+	// the step whose output `lm pipeline run` prints. defaults to the last
+	Output string `yaml:"output"`
+	Steps  []Step `yaml:"steps"`
+
+	// schema files are relative to the pipeline file
+	dir string
+}
+
+type Step struct {
+	ID string `yaml:"id"`
+
+	// exactly one of template (from the prompt library) or prompt (inline)
+	Template string `yaml:"template"`
+	Prompt   string `yaml:"prompt"`
+
+	// the template's text, and its other variables
+	Input     string            `yaml:"input"`
+	Variables map[string]string `yaml:"variables"`
+
+	Model string `yaml:"model"`
+	// for inline prompts: ask for JSON, optionally matching a schema
+	// (a file or the schema itself)
+	JSON   bool   `yaml:"json"`
+	Schema string `yaml:"schema"`
+
+	// values pulled out of the step's JSON output with --jq style paths
+	Extract map[string]string `yaml:"extract"`
+	// steps to wait for that aren't mentioned in the templates
+	Needs []string `yaml:"needs"`
+}
+
+var validID = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// references to other steps. they only count inside {{ }} and {% %}, so
+// prose like "follow the steps.Then" isn't mistaken for one
+var (
+	templateTag   = regexp.MustCompile(`(?s){{.*?}}|{%.*?%}`)
+	stepReference = regexp.MustCompile(`(?:^|[^\w.])(?:steps|fields)\.([A-Za-z_][A-Za-z0-9_]*)`)
+)
+
+// Load reads a pipeline file
+func Load(file string) (*Pipeline, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pipeline, err := Parse(contents)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %v", file, err))
+	}
+	pipeline.dir = filepath.Dir(file)
+	if pipeline.Name == "" {
+		pipeline.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	return pipeline, nil
+}
+
+// Parse reads a pipeline in YAML or JSON (which is also YAML)
+func Parse(contents []byte) (*Pipeline, error) {
+	var pipeline Pipeline
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&pipeline); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := pipeline.validate(); err != nil {
+		return nil, err
+	}
+	return &pipeline, nil
+}
+
+func (p *Pipeline) validate() error {
+	if len(p.Steps) == 0 {
+		return errors.New("pipeline has no steps")
+	}
+	for name := range p.Inputs {
+		if !validID.MatchString(name) {
+			return errors.New(fmt.Sprintf("%q is not a valid input name", name))
+		}
+	}
+
+	ids := make(map[string]bool, len(p.Steps))
+	for i, step := range p.Steps {
+		switch {
+		case step.ID == "":
+			return errors.New(fmt.Sprintf("step %d has no id", i+1))
+		case !validID.MatchString(step.ID):
+			return errors.New(fmt.Sprintf("step id %q should be letters, numbers and underscores", step.ID))
+		case ids[step.ID]:
+			return errors.New(fmt.Sprintf("step id %s is used more than once", step.ID))
+		case (step.Template == "") == (step.Prompt == ""):
+			return errors.New(fmt.Sprintf("step %s needs exactly one of template or prompt", step.ID))
+		case step.Template != "" && (step.JSON || step.Schema != ""):
+			return errors.New(fmt.Sprintf("step %s: json and schema are for inline prompts; templates bring their own", step.ID))
+		case step.Prompt != "" && (step.Input != "" || len(step.Variables) > 0):
+			return errors.New(fmt.Sprintf("step %s: input and variables are for templates; put them in the prompt", step.ID))
+		}
+		ids[step.ID] = true
+	}
+	for _, step := range p.Steps {
+		for _, dependency := range step.dependencies() {
+			if !ids[dependency] {
+				return errors.New(fmt.Sprintf("step %s refers to unknown step %s", step.ID, dependency))
+			}
+			if dependency == step.ID {
+				return errors.New(fmt.Sprintf("step %s refers to itself", step.ID))
+			}
+		}
+	}
+	if p.Output != "" && !ids[p.Output] {
+		return errors.New(fmt.Sprintf("output refers to unknown step %s", p.Output))
+	}
+	if _, err := p.order(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// templates returns every string in the step that gets rendered
+func (s *Step) templates() []string {
+	templates := []string{s.Prompt, s.Input}
+	for _, value := range s.Variables {
+		templates = append(templates, value)
+	}
+	return templates
+}
+
+// dependencies are the steps this one mentions or needs, sorted
+func (s *Step) dependencies() []string {
+	seen := make(map[string]bool)
+	for _, need := range s.Needs {
+		seen[need] = true
+	}
+	for _, template := range s.templates() {
+		for _, tag := range templateTag.FindAllString(template, -1) {
+			for _, match := range stepReference.FindAllStringSubmatch(tag, -1) {
+				seen[match[1]] = true
+			}
+		}
+	}
+	dependencies := make([]string, 0, len(seen))
+	for id := range seen {
+		dependencies = append(dependencies, id)
+	}
+	sort.Strings(dependencies)
+	return dependencies
+}
+
+// order sorts the steps so every step comes after its dependencies,
+// keeping file order otherwise. it fails on cycles
+func (p *Pipeline) order() ([]string, error) {
+	done := make(map[string]bool, len(p.Steps))
+	ordered := make([]string, 0, len(p.Steps))
+	for len(ordered) < len(p.Steps) {
+		progress := false
+		for _, step := range p.Steps {
+			if done[step.ID] {
+				continue
+			}
+			ready := true
+			for _, dependency := range step.dependencies() {
+				ready = ready && done[dependency]
+			}
+			if ready {
+				done[step.ID] = true
+				ordered = append(ordered, step.ID)
+				progress = true
+			}
+		}
+		if !progress {
+			stuck := make([]string, 0)
+			for _, step := range p.Steps {
+				if !done[step.ID] {
+					stuck = append(stuck, step.ID)
+				}
+			}
+			return nil, errors.New(fmt.Sprintf("steps %s depend on each other", strings.Join(stuck, ", ")))
+		}
+	}
+	return ordered, nil
+}
+
+// HasStep is true if the pipeline has a step with this id
+func (p *Pipeline) HasStep(id string) bool {
+	for _, step := range p.Steps {
+		if step.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// OutputStep is the step whose output is the pipeline's result
+func (p *Pipeline) OutputStep() string {
+	if p.Output != "" {
+		return p.Output
+	}
+	return p.Steps[len(p.Steps)-1].ID
+}
+
+// schema reads a step's schema, from a file or inline
+func (p *Pipeline) schema(step *Step) (json.RawMessage, error) {
+	value := strings.TrimSpace(step.Schema)
+	if strings.HasPrefix(value, "{") {
+		return json.RawMessage(value), nil
+	}
+	file := value
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(p.dir, file)
+	}
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("step %s: could not read schema: %v", step.ID, err))
+	}
+	return contents, nil
+}
@@ -0,0 +1,210 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+const testPipeline = `
+inputs:
+  doc:
+  audience: engineers
+steps:
+  - id: summary
+    prompt: "Summarize for {{ inputs.audience }}: {{ inputs.doc }}"
+  - id: sentiment
+    template: sentiment-single
+    input: "{{ inputs.doc }}"
+    extract:
+      label: .sentiment
+  - id: report
+    model: gpt-4o
+    prompt: |
+      Sentiment: {{ fields.sentiment.label }}
+      Summary: {{ steps.summary }}
+`
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(testPipeline))
+	if err != nil {
+		t.Fatalf("Could not parse pipeline: %v", err)
+	}
+	if got := p.Steps[2].dependencies(); strings.Join(got, ",") != "sentiment,summary" {
+		t.Errorf("Expected report to depend on sentiment and summary, got %v", got)
+	}
+	if p.OutputStep() != "report" {
+		t.Errorf("The last step should be the output by default, got %s", p.OutputStep())
+	}
+
+	// only template tags are searched for references
+	prose, err := Parse([]byte(`steps: [{id: a, prompt: "follow the steps.Then fill in fields.name and the x.steps.y {{ text }}"}, {id: b, prompt: "{% if fields.a.ok %}{{ steps.a }}{% endif %}"}]`))
+	if err != nil {
+		t.Fatalf("Prose that looks like a reference should not be one: %v", err)
+	}
+	if got := prose.Steps[1].dependencies(); strings.Join(got, ",") != "a" {
+		t.Errorf("Expected b to depend on a, got %v", got)
+	}
+
+	// JSON is YAML too
+	if _, err := Parse([]byte(`{"steps": [{"id": "a", "prompt": "hi"}]}`)); err != nil {
+		t.Errorf("Should be able to parse a JSON pipeline: %v", err)
+	}
+
+	bad := map[string]string{
+		"no steps":      `inputs: {a: b}`,
+		"no id":         `steps: [{prompt: hi}]`,
+		"bad id":        `steps: [{id: a-b, prompt: hi}]`,
+		"duplicate id":  `steps: [{id: a, prompt: hi}, {id: a, prompt: bye}]`,
+		"both":          `steps: [{id: a, prompt: hi, template: sentiment-single}]`,
+		"neither":       `steps: [{id: a}]`,
+		"unknown field": `steps: [{id: a, prompt: hi, temperature: 2}]`,
+		"unknown step":  `steps: [{id: a, prompt: "{{ steps.b }}"}]`,
+		"unknown need":  `steps: [{id: a, prompt: hi, needs: [b]}]`,
+		"self":          `steps: [{id: a, prompt: "{{ steps.a }}"}]`,
+		"cycle":         `steps: [{id: a, prompt: "{{ steps.b }}"}, {id: b, prompt: "{{ fields.a.x }}"}]`,
+		"bad output":    `{output: b, steps: [{id: a, prompt: hi}]}`,
+		"template json": `steps: [{id: a, template: sentiment-single, json: true}]`,
+	}
+	for reason, pipeline := range bad {
+		if _, err := Parse([]byte(pipeline)); err == nil {
+			t.Errorf("%s: expected an error", reason)
+		}
+	}
+
+	if _, err := p.ResolveInputs(nil); err == nil || !strings.Contains(err.Error(), "doc") {
+		t.Errorf("Expected an error naming the missing input, got %v", err)
+	}
+	if _, err := p.ResolveInputs(map[string]string{"doc": "x", "typo": "y"}); err == nil {
+		t.Errorf("Undeclared inputs should be an error")
+	}
+	inputs, err := p.ResolveInputs(map[string]string{"doc": "x", "stdin": "y"})
+	if err != nil || inputs["audience"] != "engineers" {
+		t.Errorf("Defaults should be filled in, got %v (%v)", inputs, err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	p, err := Parse([]byte(testPipeline))
+	if err != nil {
+		t.Fatalf("Could not parse pipeline: %v", err)
+	}
+
+	// summary and sentiment don't depend on each other, so neither
+	// answers until both have started
+	var started sync.WaitGroup
+	started.Add(2)
+	var calls atomic.Int32
+	var reportPrompt string
+	send := func(ctx context.Context, query *models.Query) (string, error) {
+		calls.Add(1)
+		prompt := query.Prompt()
+		switch {
+		case strings.HasPrefix(prompt, "Summarize"):
+			started.Done()
+			if !waitTimeout(&started, 5*time.Second) {
+				return "", errors.New("sentiment never started")
+			}
+			return "a short summary", nil
+		case strings.Contains(prompt, "Analyze the sentiment"):
+			started.Done()
+			if !waitTimeout(&started, 5*time.Second) {
+				return "", errors.New("summary never started")
+			}
+			return `{"sentiment": "good", "reason": "they liked it"}`, nil
+		}
+		if query.Model().ModelId != "gpt-4o" {
+			return "", errors.New("report should use its own model")
+		}
+		reportPrompt = prompt
+		return "the report", nil
+	}
+
+	cache, err := utils.NewCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("Could not create cache: %v", err)
+	}
+	defer cache.Close()
+
+	inputs := map[string]string{"doc": "I liked it"}
+	result, err := p.Run(context.Background(), inputs, RunOptions{Cache: cache, Send: send})
+	if err != nil {
+		t.Fatalf("Pipeline failed: %v", err)
+	}
+	if result.Output != "the report" {
+		t.Errorf("Expected the report as the output, got %q", result.Output)
+	}
+	if reportPrompt != "Sentiment: good\nSummary: a short summary\n" {
+		t.Errorf("Earlier outputs and fields were not passed along, got %q", reportPrompt)
+	}
+	if result.Steps["sentiment"].Fields["label"] != "good" {
+		t.Errorf("Expected the extracted label, got %v", result.Steps["sentiment"].Fields)
+	}
+
+	// a second run comes entirely from the cache
+	calls.Store(0)
+	result, err = p.Run(context.Background(), inputs, RunOptions{Cache: cache, Send: send})
+	if err != nil || calls.Load() != 0 || !result.Steps["report"].Cached {
+		t.Errorf("Expected every step to be cached, got %d call(s) (%v)", calls.Load(), err)
+	}
+
+	// editing the last step only reruns it
+	p.Steps[2].Prompt = "Shorter: {{ steps.summary }}"
+	result, err = p.Run(context.Background(), inputs, RunOptions{Cache: cache, Send: send})
+	if err != nil || calls.Load() != 1 || result.Steps["report"].Cached || !result.Steps["summary"].Cached {
+		t.Errorf("Expected only the edited step to run, got %d call(s) (%v)", calls.Load(), err)
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	p, err := Parse([]byte(`
+steps:
+  - id: broken
+    prompt: fail
+  - id: after
+    prompt: "{{ steps.broken }}"
+  - id: unrelated
+    prompt: fine
+`))
+	if err != nil {
+		t.Fatalf("Could not parse pipeline: %v", err)
+	}
+	send := func(ctx context.Context, query *models.Query) (string, error) {
+		if query.Prompt() == "fail" {
+			return "", errors.New("rate limited")
+		}
+		return "ok", nil
+	}
+
+	result, err := p.Run(context.Background(), nil, RunOptions{Send: send})
+	if err == nil || !strings.Contains(err.Error(), "rate limited") {
+		t.Errorf("Expected the step error, got %v", err)
+	}
+	if after := result.Steps["after"]; after.Err == nil || !strings.Contains(after.Err.Error(), "skipped") {
+		t.Errorf("Steps after a failure should be skipped, got %+v", after)
+	}
+	if unrelated := result.Steps["unrelated"]; unrelated.Err != nil || unrelated.Output != "ok" {
+		t.Errorf("Unrelated steps should still run, got %+v", unrelated)
+	}
+}
+
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
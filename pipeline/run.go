@@ -0,0 +1,308 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	prompts "github.com/WillChangeThisLater/lm/prompts"
+	utils "github.com/WillChangeThisLater/lm/utils"
+	pongo2 "github.com/flosch/pongo2/v6"
+)
+
+const defaultModel = "gpt-4o-mini"
+
+type RunOptions struct {
+	// steps are cached by their full request, so rerunning a pipeline
+	// after editing one step only reruns that step and the ones after it.
+	// nil disables caching
+	Cache *utils.Cache
+	// query every step, overwriting the cache
+	Refresh bool
+	// how many steps run at once. defaults to 4
+	Concurrency int
+	// lets templates run commands with shell()
+	AllowShell bool
+	// lets templates fetch pages with url()
+	AllowURL bool
+	// called as each step finishes, e.g. for progress output
+	OnStep func(result StepResult)
+	// sends each step's query. defaults to running it against its model
+	Send func(ctx context.Context, query *models.Query) (string, error)
+}
+
+type StepResult struct {
+	ID       string
+	Model    string
+	Output   string
+	Fields   map[string]any
+	Cached   bool
+	Duration time.Duration
+	Err      error
+}
+
+type Result struct {
+	// by step id
+	Steps map[string]StepResult
+	// the output of the pipeline's output step
+	Output string
+}
+
+func (o RunOptions) send(ctx context.Context, query *models.Query) (string, error) {
+	if o.Send != nil {
+		return o.Send(ctx, query)
+	}
+	return query.RunContext(ctx)
+}
+
+// ResolveInputs fills in defaults and reports every input that's missing
+func (p *Pipeline) ResolveInputs(inputs map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(p.Inputs)+len(inputs))
+	for name, value := range inputs {
+		if _, declared := p.Inputs[name]; !declared && name != "stdin" {
+			return nil, errors.New(fmt.Sprintf("pipeline %s has no input %s", p.Name, name))
+		}
+		resolved[name] = value
+	}
+	missing := make([]string, 0)
+	for name, value := range p.Inputs {
+		if _, ok := resolved[name]; ok {
+			continue
+		}
+		if value == nil {
+			missing = append(missing, name)
+			continue
+		}
+		resolved[name] = *value
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, errors.New(fmt.Sprintf("pipeline %s is missing input(s): %s (set them with --input name=value)", p.Name, strings.Join(missing, ", ")))
+	}
+	return resolved, nil
+}
+
+// Run runs every step, each one as soon as the steps it depends on are
+// done. a failed step fails the steps that depend on it, but unrelated
+// steps still run
+func (p *Pipeline) Run(ctx context.Context, inputs map[string]string, options RunOptions) (*Result, error) {
+	resolved, err := p.ResolveInputs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	var mutex sync.Mutex
+	results := make(map[string]StepResult, len(p.Steps))
+	done := make(map[string]chan struct{}, len(p.Steps))
+	for _, step := range p.Steps {
+		done[step.ID] = make(chan struct{})
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range p.Steps {
+		step := &p.Steps[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[step.ID])
+
+			var result StepResult
+			failed := make([]string, 0)
+			for _, dependency := range step.dependencies() {
+				<-done[dependency]
+				mutex.Lock()
+				if results[dependency].Err != nil {
+					failed = append(failed, dependency)
+				}
+				mutex.Unlock()
+			}
+			if len(failed) > 0 {
+				result = StepResult{ID: step.ID, Err: errors.New(fmt.Sprintf("skipped because %s failed", strings.Join(failed, ", ")))}
+			} else {
+				slots <- struct{}{}
+				mutex.Lock()
+				scope := p.templateContext(resolved, results)
+				mutex.Unlock()
+				result = p.runStep(ctx, step, scope, options)
+				<-slots
+			}
+
+			mutex.Lock()
+			results[step.ID] = result
+			mutex.Unlock()
+			if options.OnStep != nil {
+				options.OnStep(result)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := &Result{Steps: results, Output: results[p.OutputStep()].Output}
+	failures := make([]string, 0)
+	for _, step := range p.Steps {
+		if err := results[step.ID].Err; err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", step.ID, err))
+		}
+	}
+	if len(failures) > 0 {
+		return result, errors.New(fmt.Sprintf("pipeline %s failed:\n  %s", p.Name, strings.Join(failures, "\n  ")))
+	}
+	return result, nil
+}
+
+// templateContext is what every template in a step can see. results
+// only has the steps that are done, which includes every dependency
+func (p *Pipeline) templateContext(inputs map[string]string, results map[string]StepResult) pongo2.Context {
+	outputs := make(map[string]string, len(results))
+	fields := make(map[string]map[string]any, len(results))
+	for id, result := range results {
+		outputs[id] = result.Output
+		fields[id] = result.Fields
+	}
+	return pongo2.Context{"inputs": inputs, "steps": outputs, "fields": fields}
+}
+
+func render(template string, scope pongo2.Context) (string, error) {
+	if !strings.Contains(template, "{{") && !strings.Contains(template, "{%") {
+		return template, nil
+	}
+	compiled, err := prompts.CompileTemplate(template)
+	if err != nil {
+		return "", err
+	}
+	return compiled.Execute(scope)
+}
+
+func (p *Pipeline) runStep(ctx context.Context, step *Step, scope pongo2.Context, options RunOptions) (result StepResult) {
+	result = StepResult{ID: step.ID}
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+
+	query, err := p.makeQuery(step, scope, options)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Model = query.Model().ModelId
+
+	var cacheKey string
+	if options.Cache != nil {
+		if cacheKey, err = query.CacheKey(); err != nil {
+			result.Err = err
+			return result
+		}
+		if !options.Refresh {
+			if entry, err := options.Cache.Get(cacheKey); err == nil {
+				result.Output, result.Cached = entry.Response, true
+			}
+		}
+	}
+	if !result.Cached {
+		if result.Output, err = options.send(ctx, query); err != nil {
+			result.Err = err
+			return result
+		}
+		if options.Cache != nil {
+			entry := utils.CacheEntry{Prompt: query.Prompt(), Model: result.Model, Response: result.Output}
+			if err := options.Cache.Set(cacheKey, entry, 0); err != nil {
+				result.Err = err
+				return result
+			}
+		}
+	}
+
+	result.Fields, result.Err = extract(step, result.Output)
+	return result
+}
+
+func (p *Pipeline) makeQuery(step *Step, scope pongo2.Context, options RunOptions) (*models.Query, error) {
+	modelName := step.Model
+	if step.Template != "" {
+		prompt, err := prompts.GetPrompt(step.Template)
+		if err != nil {
+			return nil, err
+		}
+		prompt.AllowShell = options.AllowShell
+		prompt.AllowURL = options.AllowURL
+		input, err := render(step.Input, scope)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not render input: %v", err))
+		}
+		vars := make(map[string]any, len(step.Variables))
+		for name, value := range step.Variables {
+			if vars[name], err = render(value, scope); err != nil {
+				return nil, errors.New(fmt.Sprintf("could not render variable %s: %v", name, err))
+			}
+		}
+
+		// the template's own model, unless the step says otherwise
+		model := prompt.Model
+		if modelName != "" {
+			if model, err = models.GetModel(modelName); err != nil {
+				return nil, err
+			}
+		}
+		return prompt.MakeQuery(model, input, vars)
+	}
+
+	if modelName == "" {
+		modelName = p.Model
+	}
+	if modelName == "" {
+		modelName = defaultModel
+	}
+	model, err := models.GetModel(modelName)
+	if err != nil {
+		return nil, err
+	}
+	text, err := render(step.Prompt, scope)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not render prompt: %v", err))
+	}
+	if step.Schema != "" {
+		schema, err := p.schema(step)
+		if err != nil {
+			return nil, err
+		}
+		return model.MakeJSONQuery(text, &models.JSONSchema{Name: step.ID, Schema: schema, Strict: true})
+	}
+	if step.JSON {
+		return model.MakeJSONQuery(text, nil)
+	}
+	return model.MakeQuery(text)
+}
+
+// extract pulls the step's fields out of its JSON output
+func extract(step *Step, output string) (map[string]any, error) {
+	if len(step.Extract) == 0 {
+		return nil, nil
+	}
+	var value any
+	if err := json.Unmarshal([]byte(output), &value); err != nil {
+		return nil, errors.New(fmt.Sprintf("could not extract fields, the output is not JSON: %v", err))
+	}
+	fields := make(map[string]any, len(step.Extract))
+	for name, path := range step.Extract {
+		results, err := utils.JSONPath(value, path)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not extract %s: %v", name, err))
+		}
+		if len(results) == 1 {
+			fields[name] = results[0]
+		} else {
+			fields[name] = results
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,295 @@
+package prompts
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	utils "github.com/WillChangeThisLater/lm/utils"
+	pongo2 "github.com/flosch/pongo2/v6"
+)
+
+// template helpers for pulling context into a prompt, so templates don't
+// need a bash wrapper (project(), builderror(), lynx -dump, ...):
+//
+//	{{ file("cmd/**/*.go") }}          files, each in a fenced block under its path
+//	{{ tree(".") }}                    directory tree
+//	{{ shell("go build ./...") }}      command output (needs --allow-shell)
+//	{{ url("https://example.com") }}   readable text of a page (needs --allow-url)
+//	{{ text|dedent }}                  strip common indentation, like <<- heredocs
+//	{{ shell("go vet")|fence:"bash" }} wrap in a fenced code block
+//
+// file and tree only read below the current directory, symlinks included
+
+// don't dump huge files into a prompt by accident
+const maxHelperFileSize = 256 * 1024
+
+func init() {
+	pongo2.RegisterFilter("dedent", filterDedent)
+	pongo2.RegisterFilter("fence", filterFence)
+}
+
+// helperContext returns the helper functions for one render
+func (p *Prompt) helperContext() pongo2.Context {
+	return pongo2.Context{
+		"file": includeFiles,
+		"tree": directoryTree,
+		"url": func(address string) (string, error) {
+			if !p.AllowURL {
+				return "", errors.New(fmt.Sprintf("url(%q) is disabled; rerun with --allow-url if you trust this template", address))
+			}
+			return utils.FetchURLText(address)
+		},
+		"shell": func(command string) (string, error) {
+			if !p.AllowShell {
+				return "", errors.New(fmt.Sprintf("shell(%q) is disabled; rerun with --allow-shell if you trust this template", command))
+			}
+			return runShell(command)
+		},
+	}
+}
+
+// localPath rejects paths that leave the current directory
+func localPath(name string) (string, error) {
+	cleaned := filepath.Clean(name)
+	if !filepath.IsLocal(cleaned) && cleaned != "." {
+		return "", errors.New(fmt.Sprintf("%s is outside the current directory", name))
+	}
+	return cleaned, nil
+}
+
+// insideWorkingDir follows any symlinks in name, and rejects it if the
+// file it really points at is outside the current directory
+func insideWorkingDir(name string) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(cwd)
+	if err != nil {
+		return err
+	}
+	absolute, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(absolute)
+	if err != nil {
+		return err
+	}
+	relative, err := filepath.Rel(root, resolved)
+	if err != nil || !(filepath.IsLocal(relative) || relative == ".") {
+		return errors.New(fmt.Sprintf("%s links to %s, outside the current directory", name, resolved))
+	}
+	return nil
+}
+
+// globPattern turns a glob into a regexp. * and ? don't cross directories,
+// ** does
+func globPattern(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			expr.WriteString("[^/]*")
+		case pattern[i] == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// globFiles returns the regular files matching pattern, sorted
+func globFiles(pattern string) ([]string, error) {
+	pattern, err := localPath(pattern)
+	if err != nil {
+		return nil, err
+	}
+	pattern = filepath.ToSlash(pattern)
+	matcher, err := globPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// only walk the part of the tree that can match
+	root := "."
+	if index := strings.IndexAny(pattern, "*?"); index >= 0 {
+		if slash := strings.LastIndex(pattern[:index], "/"); slash >= 0 {
+			root = pattern[:slash]
+		}
+	} else {
+		root = pattern
+	}
+
+	matches := make([]string, 0)
+	err = filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		slashed := filepath.ToSlash(name)
+		if entry.IsDir() {
+			if name != root && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return insideWorkingDir(name)
+		}
+		if !matcher.MatchString(slashed) {
+			return nil
+		}
+		if err := insideWorkingDir(name); err != nil {
+			return err
+		}
+		if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+			matches = append(matches, slashed)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// includeFiles renders every file matching pattern like files-to-prompt:
+// the path, then the contents in a fenced block
+func includeFiles(pattern string) (string, error) {
+	names, err := globFiles(pattern)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("file(%q): %v", pattern, err))
+	}
+	if len(names) == 0 {
+		return "", errors.New(fmt.Sprintf("file(%q): no files match", pattern))
+	}
+
+	var result strings.Builder
+	for i, name := range names {
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		if len(contents) > maxHelperFileSize {
+			return "", errors.New(fmt.Sprintf("file(%q): %s is larger than %d bytes", pattern, name, maxHelperFileSize))
+		}
+		if i > 0 {
+			result.WriteString("\n")
+		}
+		result.WriteString(name + "\n")
+		result.WriteString(fence(string(contents), strings.TrimPrefix(filepath.Ext(name), ".")))
+		result.WriteString("\n")
+	}
+	return result.String(), nil
+}
+
+// directoryTree prints something close to `tree`, skipping hidden files
+func directoryTree(dir string) (string, error) {
+	dir, err := localPath(dir)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("tree(%q): %v", dir, err))
+	}
+	if err := insideWorkingDir(dir); err != nil {
+		return "", errors.New(fmt.Sprintf("tree(%q): %v", dir, err))
+	}
+	var result strings.Builder
+	result.WriteString(dir + "\n")
+	if err := writeTree(&result, dir, ""); err != nil {
+		return "", errors.New(fmt.Sprintf("tree(%q): %v", dir, err))
+	}
+	return result.String(), nil
+}
+
+func writeTree(result *strings.Builder, dir string, indent string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	visible := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			visible = append(visible, entry)
+		}
+	}
+	for i, entry := range visible {
+		branch, next := "├── ", "│   "
+		if i == len(visible)-1 {
+			branch, next = "└── ", "    "
+		}
+		result.WriteString(indent + branch + entry.Name() + "\n")
+		if entry.IsDir() {
+			if err := writeTree(result, filepath.Join(dir, entry.Name()), indent+next); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runShell returns stdout and stderr together. a failing command isn't
+// an error, since the output of a broken build is usually the point
+func runShell(command string) (string, error) {
+	output, err := exec.Command("sh", "-c", command).CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", errors.New(fmt.Sprintf("shell(%q): %v", command, err))
+	}
+	return string(output), nil
+}
+
+// fence wraps text in a markdown code block, using a longer fence if
+// the text has one of its own
+func fence(text string, language string) string {
+	marker := "```"
+	for strings.Contains(text, marker) {
+		marker += "`"
+	}
+	return marker + language + "\n" + strings.TrimRight(text, "\n") + "\n" + marker
+}
+
+// dedent removes the indentation shared by every non-blank line
+func dedent(text string) string {
+	lines := strings.Split(text, "\n")
+	prefix := ""
+	first := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			prefix = indent
+			first = false
+			continue
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, prefix)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func filterDedent(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	return pongo2.AsValue(dedent(in.String())), nil
+}
+
+func filterFence(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	return pongo2.AsValue(fence(in.String(), param.String())), nil
+}
@@ -0,0 +1,132 @@
+package prompts
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDedent(t *testing.T) {
+	input := "\n\t\tfirst\n\t\t  indented\n\n\t\tlast"
+	expected := "\nfirst\n  indented\n\nlast"
+	if result := dedent(input); result != expected {
+		t.Errorf("dedent(%q) = %q, expected %q", input, result, expected)
+	}
+	if result := fence("has ``` inside", "md"); !strings.HasPrefix(result, "````md\n") {
+		t.Errorf("fence should use a longer marker when the text contains one: %q", result)
+	}
+}
+
+func TestTemplateHelpers(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "cmd", "lm"), 0755)
+	os.MkdirAll(filepath.Join(dir, ".git"), 0755)
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "cmd", "lm", "lm.go"), []byte("package lm\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "README.md"), []byte("# readme\n"), 0644)
+	os.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("ref\n"), 0644)
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+
+	files, err := globFiles("**/*.go")
+	if err != nil || strings.Join(files, ",") != "cmd/lm/lm.go,main.go" {
+		t.Errorf("Unexpected glob result %v (%v)", files, err)
+	}
+	if _, err := globFiles("../*.go"); err == nil {
+		t.Errorf("Globs outside the current directory should be rejected")
+	}
+
+	template := fstest.MapFS{
+		"p/context/prompt": {Data: []byte(`{{ file("*.go") }}{{ tree(".") }}{% filter dedent %}
+		    {{ text }}
+		{% endfilter %}`)},
+		"p/shell/prompt": {Data: []byte(`{{ shell("echo hello; exit 3") }}`)},
+	}
+	found, problems := discoverPrompts(template, "p", "")
+	if len(problems) > 0 {
+		t.Fatalf("Could not load helper prompts: %v", problems)
+	}
+	loadPrompts()
+	library := prompts
+	prompts = found
+	defer func() { prompts = library }()
+
+	prompt, err := GetPrompt("context")
+	if err != nil {
+		t.Fatalf("Could not get prompt: %v", err)
+	}
+	result, err := prompt.Render("input")
+	if err != nil {
+		t.Fatalf("Could not render helpers: %v", err)
+	}
+	for _, expected := range []string{"main.go\n```go\npackage main\n```", "└── main.go", "├── cmd\n│   └── lm", "\ninput\n"} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %q in rendered prompt:\n%s", expected, result)
+		}
+	}
+	if strings.Contains(result, ".git") {
+		t.Errorf("Hidden directories should not be included:\n%s", result)
+	}
+
+	shell, err := GetPrompt("shell")
+	if err != nil {
+		t.Fatalf("Could not get prompt: %v", err)
+	}
+	if _, err := shell.Render(""); err == nil {
+		t.Errorf("shell() should be disabled by default")
+	}
+	shell.AllowShell = true
+	if result, err := shell.Render(""); err != nil || result != "hello\n" {
+		t.Errorf("Expected shell output even when the command fails, got %q (%v)", result, err)
+	}
+}
+
+func TestHelperSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "id_rsa"), []byte("secret\n"), 0644)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644)
+	if err := os.Symlink(filepath.Join(outside, "id_rsa"), filepath.Join(dir, "notes")); err != nil {
+		t.Skipf("Could not make a symlink: %v", err)
+	}
+	os.Symlink(outside, filepath.Join(dir, "elsewhere"))
+	os.Symlink("main.go", filepath.Join(dir, "main_link.go"))
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+
+	for _, pattern := range []string{"notes", "*", "elsewhere/id_rsa"} {
+		if result, err := includeFiles(pattern); err == nil || strings.Contains(result, "secret") {
+			t.Errorf("file(%q) should refuse links out of the directory, got %q (%v)", pattern, result, err)
+		}
+	}
+	if _, err := directoryTree("elsewhere"); err == nil {
+		t.Errorf("tree() should refuse links out of the directory")
+	}
+	if result, err := includeFiles("main_link.go"); err != nil || !strings.Contains(result, "package main") {
+		t.Errorf("Links that stay in the directory should be read, got %q (%v)", result, err)
+	}
+}
+
+func TestURLHelper(t *testing.T) {
+	template := fstest.MapFS{"p/fetch/prompt": {Data: []byte(`{{ url("http://127.0.0.1:1/") }}`)}}
+	found, problems := discoverPrompts(template, "p", "")
+	if len(problems) > 0 {
+		t.Fatalf("Could not load helper prompts: %v", problems)
+	}
+	loadPrompts()
+	library := prompts
+	prompts = found
+	defer func() { prompts = library }()
+
+	prompt, err := GetPrompt("fetch")
+	if err != nil {
+		t.Fatalf("Could not get prompt: %v", err)
+	}
+	if _, err := prompt.Render(""); err == nil || !strings.Contains(err.Error(), "--allow-url") {
+		t.Errorf("url() should be disabled by default, got %v", err)
+	}
+}
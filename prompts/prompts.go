@@ -5,75 +5,221 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	//"io"
 
-	openai "github.com/WillChangeThisLater/lm/openai"
+	models "github.com/WillChangeThisLater/lm/models"
 	pongo2 "github.com/flosch/pongo2/v6"
 )
 
 //go:embed promptFiles/*
 var promptFS embed.FS
 
-var prompts = map[string]PromptWrapper{
-	"json-sample-to-schema": {"json-sample-to-schema", "Turn JSON sample into formal schema OpenAI can understand and coerce results to", "promptFiles/json-example-to-schema", true, false},
-	"pdf-to-text":           {"pdf-to-text", "Convert page(s) in a PDF (represented as JPEG files based in via imageURLs...) to text", "promptFiles/pdf-to-text", true, true},
+// templates are compiled in their own set, so nothing here changes the
+// defaults for other users of pongo2
+var templateSet = pongo2.NewSet("lm", pongo2.MustNewLocalFileSystemLoader(""))
+
+// CompileTemplate compiles a prompt template with escaping off: prompts
+// aren't HTML, and code piped in on stdin shouldn't come out with every <
+// and & escaped. pongo2 only has a global switch for that, so the template
+// goes in an autoescape block (on the same line, so error lines still match)
+func CompileTemplate(source string) (*pongo2.Template, error) {
+	return templateSet.FromString("{% autoescape off %}" + source + "{% endautoescape %}")
 }
 
+const promptRoot = "promptFiles"
+
+// prompts under promptFiles/tests are only registered by the tests
+const testPromptRoot = "promptFiles/tests"
+
+// prompts are discovered the first time they're needed (see sources.go).
+// prompts that fail to load are skipped and end up in loadProblems
+var (
+	prompts      map[string]PromptWrapper
+	loadProblems []error
+	loadOnce     sync.Once
+)
+
 type PromptWrapper struct {
-	Name             string `json:"name"`
-	Description      string `json:"description"`
-	Path             string `json:"prompt_path"`
-	JSONUnstructured bool   `json:"json_unstructured"`
-	JSONStructured   bool   `json:"json_structured"`
+	Name             string   `json:"name"`
+	Description      string   `json:"description"`
+	Path             string   `json:"prompt_path"`
+	JSONUnstructured bool     `json:"json_unstructured"`
+	JSONStructured   bool     `json:"json_structured"`
+	Settings         Settings `json:"settings"`
+
+	// where the prompt was found: embedded, user or project
+	Source string `json:"source"`
+	fsys   fs.FS
+	// the prompt directory on disk; empty for embedded prompts
+	dir string
 }
 
 type Prompt struct {
-	Name       string              `json:"name"`
-	Model      *openai.OpenAIModel `json:"model"`
-	PromptFile string              `json:"prompt_file"`
-	ForceJSON  bool                `json:"force_json"`
-	SchemaFile string              `json:"schema_file"`
+	Name        string                   `json:"name"`
+	Description string                   `json:"description"`
+	ModelName   string                   `json:"model_name"`
+	Model       *models.Model            `json:"model"`
+	PromptFile  string                   `json:"prompt_file"`
+	ForceJSON   bool                     `json:"force_json"`
+	SchemaFile  string                   `json:"schema_file"`
+	IsTemplate  bool                     `json:"is_template"`
+	Options     models.GenerationOptions `json:"options"`
+	CacheTTL    time.Duration            `json:"cache_ttl"`
+	Source      string                   `json:"source"`
+	Variables   map[string]Variable      `json:"variables"`
+	Requires    []string                 `json:"requires"`
+	// few-shot examples, available to the template as {{ examples }}
+	Examples string `json:"examples"`
+
+	needsImages, needsUnstructuredJSON, needsStructuredJSON bool
+
+	// lets the template run commands with shell(). off unless the caller
+	// trusts the template (see helpers.go)
+	AllowShell bool `json:"-"`
+	// url() fetches pages, so it's off unless the caller allows it too
+	AllowURL bool `json:"-"`
+
+	fsys fs.FS
+	dir  string
 }
 
-func (p *PromptWrapper) GetPrompt() (*Prompt, error) {
-	var model *openai.OpenAIModel
-	var err error
-	var prompt Prompt
+// few-shot examples for a prompt are kept in this file next to it
+const ExamplesFile = "examples"
 
-	// the way we get models here is kinda weird.
-	// but it's good enough for now
-	prompt.Name = p.Name
-	if p.JSONUnstructured || p.JSONStructured {
-		prompt.ForceJSON = true
+func loadPrompts() {
+	loadOnce.Do(func() {
+		prompts, loadProblems = layerPrompts(defaultSources())
+	})
+}
+
+// LoadProblems says which prompts were skipped, and why
+func LoadProblems() []error {
+	loadPrompts()
+	return loadProblems
+}
 
-		model, err = openai.GetModel("gpt-4o-mini")
+// discoverPrompts registers every directory under root that contains a
+// `prompt` file. skip is a directory that should not be walked. a prompt
+// that can't be loaded is left out, and what was wrong with it comes back
+// with the others
+func discoverPrompts(fsys fs.FS, root string, skip string) (map[string]PromptWrapper, []error) {
+	found := make(map[string]PromptWrapper)
+	problems := make([]error, 0)
+	fs.WalkDir(fsys, root, func(dir string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			return nil, err
+			problems = append(problems, err)
+			if entry != nil && entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
 		}
-		prompt.Model = model
-	} else {
-		prompt.ForceJSON = false
-		model, err = openai.GetModel("gpt-4o-mini")
+		if !entry.IsDir() {
+			return nil
+		}
+		if dir == skip {
+			return fs.SkipDir
+		}
+		if dir == root {
+			return nil
+		}
+		if _, err := fs.Stat(fsys, path.Join(dir, "prompt")); err != nil {
+			return nil
+		}
+
+		wrapper, err := newPromptWrapper(fsys, root, dir)
 		if err != nil {
-			return nil, err
+			problems = append(problems, err)
+			return nil
 		}
-		prompt.Model = model
+		if existing, ok := found[wrapper.Name]; ok {
+			problems = append(problems, errors.New(fmt.Sprintf("Prompt name %s is used by both %s and %s; skipping %s", wrapper.Name, existing.Path, wrapper.Path, wrapper.Path)))
+			return nil
+		}
+		found[wrapper.Name] = *wrapper
+		return nil
+	})
+	return found, problems
+}
+
+func newPromptWrapper(fsys fs.FS, root string, dir string) (*PromptWrapper, error) {
+	settings, err := readSettings(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := settings.validate(fsys, dir); err != nil {
+		return nil, err
+	}
+
+	name := settings.Name
+	if name == "" {
+		relative := strings.TrimPrefix(dir, root+"/")
+		name = strings.ReplaceAll(relative, "/", "-")
+	}
+
+	return &PromptWrapper{
+		Name:             name,
+		Description:      settings.Description,
+		Path:             dir,
+		JSONUnstructured: settings.UnstructuredJSON,
+		JSONStructured:   settings.StructuredJSON,
+		Settings:         *settings,
+		fsys:             fsys,
+	}, nil
+}
+
+func (p *PromptWrapper) GetPrompt() (*Prompt, error) {
+	var prompt Prompt
+
+	model, err := models.GetModel(p.Settings.ModelName())
+	if err != nil {
+		return nil, err
 	}
 
-	prompt.PromptFile = filepath.Join(p.Path, "prompt")
+	prompt.Name = p.Name
+	prompt.Description = p.Description
+	prompt.ModelName = p.Settings.ModelName()
+	prompt.Model = model
+	prompt.Requires = p.Settings.Requires
+	prompt.needsImages, prompt.needsUnstructuredJSON, prompt.needsStructuredJSON = p.Settings.needs()
+	prompt.ForceJSON = p.JSONUnstructured || p.JSONStructured
+	prompt.PromptFile = path.Join(p.Path, "prompt")
 	if p.JSONStructured {
-		prompt.SchemaFile = filepath.Join(p.Path, "schema.json")
-	} else {
-		prompt.SchemaFile = ""
+		prompt.SchemaFile = path.Join(p.Path, p.Settings.SchemaFile())
+	}
+	prompt.IsTemplate = p.Settings.IsTemplate()
+	prompt.Options = p.Settings.Options
+	prompt.CacheTTL = p.Settings.cacheTTL()
+	prompt.Source = p.Source
+	prompt.Variables = p.Settings.Variables
+	prompt.fsys = p.fsys
+	prompt.dir = p.dir
+
+	examples, err := fs.ReadFile(p.fsys, path.Join(p.Path, ExamplesFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
 	}
+	prompt.Examples = string(examples)
 
 	return &prompt, nil
 }
 
 func GetPrompt(name string) (*Prompt, error) {
+	loadPrompts()
 	promptWrapper, ok := prompts[name]
+	if !ok && len(loadProblems) > 0 {
+		// it might be one of the skipped prompts
+		return nil, errors.New(fmt.Sprintf("Prompt %s not found (%v)", name, errors.Join(loadProblems...)))
+	}
 	if !ok {
 		return nil, errors.New(fmt.Sprintf("Prompt %s not found", name))
 	}
@@ -81,7 +227,21 @@ func GetPrompt(name string) (*Prompt, error) {
 
 }
 
+// Wrappers returns every registered prompt, sorted by name
+func Wrappers() []PromptWrapper {
+	loadPrompts()
+	wrappers := make([]PromptWrapper, 0, len(prompts))
+	for _, wrapper := range prompts {
+		wrappers = append(wrappers, wrapper)
+	}
+	sort.Slice(wrappers, func(i, j int) bool {
+		return wrappers[i].Name < wrappers[j].Name
+	})
+	return wrappers
+}
+
 func ListPrompts() string {
+	loadPrompts()
 	result, err := json.Marshal(prompts)
 	if err != nil {
 		return fmt.Sprintf("Could not get prompt info: %v", err)
@@ -89,17 +249,62 @@ func ListPrompts() string {
 	return string(result)
 }
 
+// ResolveVariables checks vars against the variables the prompt declares
+// and fills in defaults. every missing required variable is reported at
+// once, so it's cheap to call before doing anything expensive
+func (p *Prompt) ResolveVariables(vars map[string]any) (map[string]any, error) {
+	if len(vars) > 0 && !p.IsTemplate {
+		return nil, errors.New(fmt.Sprintf("prompt %s is not a template, so it does not take variables", p.Name))
+	}
+
+	resolved := make(map[string]any, len(vars)+len(p.Variables))
+	for name, value := range vars {
+		if reservedVariables[name] {
+			return nil, errors.New(fmt.Sprintf("variable %s is reserved and can't be set", name))
+		}
+		resolved[name] = value
+	}
+
+	missing := make([]string, 0)
+	for name, variable := range p.Variables {
+		if _, ok := resolved[name]; ok {
+			continue
+		}
+		if variable.Required {
+			missing = append(missing, name)
+		} else if variable.Default != nil {
+			resolved[name] = variable.Default
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, errors.New(fmt.Sprintf("prompt %s is missing required variable(s): %s (set them with --var name=value)", p.Name, strings.Join(missing, ", ")))
+	}
+	return resolved, nil
+}
+
 // TODO: do this better
-func (p *Prompt) buildPrompt(text string, imageURLs ...string) (string, error) {
-	promptBytes, err := promptFS.ReadFile(p.PromptFile)
+func (p *Prompt) buildPrompt(text string, vars map[string]any, imageURLs ...string) (string, error) {
+	promptBytes, err := fs.ReadFile(p.fsys, p.PromptFile)
 	if err != nil {
 		return "", err
 	}
-	template, err := pongo2.FromBytes(promptBytes)
+	// non-template prompts are instructions followed by the input
+	if !p.IsTemplate {
+		return strings.TrimRight(string(promptBytes), "\n") + "\n\n" + text, nil
+	}
+	template, err := CompileTemplate(string(promptBytes))
 	if err != nil {
 		return "", err
 	}
-	result, err := template.Execute(pongo2.Context{"text": text, "imageURLs": imageURLs})
+	context := p.helperContext()
+	for name, value := range vars {
+		context[name] = value
+	}
+	context["text"] = text
+	context["imageURLs"] = imageURLs
+	context["examples"] = p.Examples
+	result, err := template.Execute(context)
 	if err != nil {
 		return "", err
 	}
@@ -107,52 +312,168 @@ func (p *Prompt) buildPrompt(text string, imageURLs ...string) (string, error) {
 	return result, nil
 }
 
-func (p *Prompt) getSchema() (*openai.JSONSchema, error) {
-	schemaBytes, err := promptFS.ReadFile(p.SchemaFile)
+// Render fills in the prompt template. text is usually whatever came in on stdin
+func (p *Prompt) Render(text string, imageURLs ...string) (string, error) {
+	return p.RenderWithVariables(text, nil, imageURLs...)
+}
+
+// RenderWithVariables is Render with extra template variables. they go
+// through ResolveVariables first, so missing required variables are an error
+func (p *Prompt) RenderWithVariables(text string, vars map[string]any, imageURLs ...string) (string, error) {
+	resolved, err := p.ResolveVariables(vars)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	return &openai.JSONSchema{Name: "json_schema", Schema: schemaBytes, Strict: true}, nil
+	return p.buildPrompt(text, resolved, imageURLs...)
 }
 
-func (p *Prompt) Query(input string, imageURLs ...string) (string, error) {
-	return Query(input, p.Name, imageURLs...)
+// Template returns the unrendered prompt file
+func (p *Prompt) Template() (string, error) {
+	promptBytes, err := fs.ReadFile(p.fsys, p.PromptFile)
+	if err != nil {
+		return "", err
+	}
+	return string(promptBytes), nil
 }
 
-func Query(input string, promptName string, imageURLs ...string) (string, error) {
-	var model *openai.OpenAIModel
-	var query *openai.Query
-	var err error
+// ReadFile reads a file that sits next to the prompt, like tests.jsonl
+func (p *Prompt) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(p.fsys, path.Join(path.Dir(p.PromptFile), name))
+}
 
-	prompt, err := GetPrompt(promptName)
+// UsesExamples is true when the template has somewhere to put few-shot
+// examples
+func (p *Prompt) UsesExamples() (bool, error) {
+	if !p.IsTemplate {
+		return false, nil
+	}
+	template, err := p.Template()
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	model = prompt.Model
+	return examplesReference.MatchString(template), nil
+}
 
-	promptText, err := prompt.buildPrompt(input)
+var examplesReference = regexp.MustCompile(`{[{%][^}]*\bexamples\b`)
+
+// CheckWritable says whether WriteExamples can work, so callers can find
+// out before doing anything expensive. embedded prompts are read only
+func (p *Prompt) CheckWritable() error {
+	if p.dir == "" {
+		return errors.New(fmt.Sprintf("prompt %s is %s, so it can't be changed. copy it to .lm/prompts/ or ~/.config/lm/prompts/ first", p.Name, p.Source))
+	}
+	probe, err := os.CreateTemp(p.dir, ".lm-write-check-*")
 	if err != nil {
+		return errors.New(fmt.Sprintf("prompt %s can't be changed: %v", p.Name, err))
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// WriteExamples saves examples to the prompt's examples file, and returns
+// the file's path
+func (p *Prompt) WriteExamples(examples string) (string, error) {
+	if err := p.CheckWritable(); err != nil {
+		return "", err
+	}
+	file := filepath.Join(p.dir, ExamplesFile)
+	if err := os.WriteFile(file, []byte(examples), 0644); err != nil {
 		return "", err
 	}
+	p.Examples = examples
+	return file, nil
+}
+
+// Schema returns the raw schema.json for structured JSON prompts and
+// nil for everything else
+func (p *Prompt) Schema() (json.RawMessage, error) {
+	if p.SchemaFile == "" {
+		return nil, nil
+	}
+	return fs.ReadFile(p.fsys, p.SchemaFile)
+}
+
+func (p *Prompt) getSchema() (*models.JSONSchema, error) {
+	schemaBytes, err := fs.ReadFile(p.fsys, p.SchemaFile)
+	if err != nil {
+		return nil, err
+	}
+	return &models.JSONSchema{Name: "json_schema", Schema: schemaBytes, Strict: true}, nil
+}
 
-	if prompt.ForceJSON {
-		var schema *openai.JSONSchema
-		if prompt.SchemaFile != "" {
-			schema, err = prompt.getSchema()
+// FlightCheck checks that model can run the prompt: the capabilities
+// from its settings.json, plus images if there are any
+func (p *Prompt) FlightCheck(model *models.Model, hasImages bool) (bool, string) {
+	return model.FlightCheck(p.needsImages || hasImages, p.needsUnstructuredJSON, p.needsStructuredJSON)
+}
+
+// MakeQuery renders the prompt and builds a query for model (or the
+// prompt's own model if model is nil), with the prompt's JSON mode,
+// schema and generation options
+func (p *Prompt) MakeQuery(model *models.Model, input string, vars map[string]any, images ...models.ImageContent) (*models.Query, error) {
+	if model == nil {
+		model = p.Model
+	}
+	if ok, reason := p.FlightCheck(model, len(images) > 0); !ok {
+		return nil, errors.New(fmt.Sprintf("Model %s cannot be used for prompt %s: %s", model.ModelId, p.Name, reason))
+	}
+
+	promptText, err := p.RenderWithVariables(input, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	var query *models.Query
+	if p.ForceJSON {
+		var schema *models.JSONSchema
+		if p.SchemaFile != "" {
+			schema, err = p.getSchema()
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 		}
-		query, err = model.MakeJSONQuery(promptText, schema, imageURLs...)
-		if err != nil {
-			return "", err
-		}
+		query, err = model.MakeJSONQuery(promptText, schema, images...)
 	} else {
-		query, err = model.MakeQuery(promptText, imageURLs...)
-		if err != nil {
-			return "", err
-		}
+		query, err = model.MakeQuery(promptText, images...)
+	}
+	if err != nil {
+		return nil, err
 	}
+	query.SetOptions(p.Options)
+	return query, nil
+}
+
+// Query runs the prompt on its own model. the images are URLs the
+// provider downloads itself; use QueryImages for anything else
+func (p *Prompt) Query(input string, imageURLs ...string) (string, error) {
+	return p.QueryImages(input, imagesFromURLs(imageURLs)...)
+}
 
+// QueryImages is Query with images from anywhere (URLs, files, base64)
+func (p *Prompt) QueryImages(input string, images ...models.ImageContent) (string, error) {
+	query, err := p.MakeQuery(nil, input, nil, images...)
+	if err != nil {
+		return "", err
+	}
 	return query.Run()
 }
+
+func Query(input string, promptName string, imageURLs ...string) (string, error) {
+	return QueryImages(input, promptName, imagesFromURLs(imageURLs)...)
+}
+
+func QueryImages(input string, promptName string, images ...models.ImageContent) (string, error) {
+	prompt, err := GetPrompt(promptName)
+	if err != nil {
+		return "", err
+	}
+	return prompt.QueryImages(input, images...)
+}
+
+func imagesFromURLs(imageURLs []string) []models.ImageContent {
+	images := make([]models.ImageContent, 0, len(imageURLs))
+	for _, url := range imageURLs {
+		images = append(images, models.ImageFromURL(url))
+	}
+	return images
+}
@@ -2,14 +2,265 @@ package prompts
 
 import (
 	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"testing/fstest"
+
+	replaytest "github.com/WillChangeThisLater/lm/internal/replaytest"
+	models "github.com/WillChangeThisLater/lm/models"
+	pongo2 "github.com/flosch/pongo2/v6"
 )
 
+// whether anything can answer provider requests: recordings in
+// testdata/recordings (make them with LM_RECORD=testdata/recordings go
+// test ./prompts) or an OPENAI_API_KEY. tests that need one skip without
+var providersAvailable bool
+
+func TestMain(m *testing.M) {
+	providersAvailable = replaytest.Setup("testdata/recordings")
+	os.Exit(m.Run())
+}
+
+func skipOffline(t *testing.T) {
+	if !providersAvailable {
+		t.Skip("no OPENAI_API_KEY and no recordings in testdata/recordings")
+	}
+}
+
 func addTestPromptWrappers() {
-	prompts["test-simple"] = PromptWrapper{"test-simple", "", "promptFiles/tests/test-simple", false, false}
-	prompts["test-json-unstructured"] = PromptWrapper{"test-json-unstructured", "", "promptFiles/tests/test-json-unstructured", true, false}
-	prompts["test-json-structured"] = PromptWrapper{"test-json-structured", "", "promptFiles/tests/test-json-structured", true, true}
+	loadPrompts()
+	testPrompts, problems := discoverPrompts(promptFS, testPromptRoot, "")
+	if len(problems) > 0 {
+		panic(errors.Join(problems...))
+	}
+	for name, wrapper := range testPrompts {
+		prompts[name] = wrapper
+	}
+}
+
+func TestDiscoverPrompts(t *testing.T) {
+	library, problems := discoverPrompts(promptFS, promptRoot, testPromptRoot)
+	if len(problems) > 0 {
+		t.Fatalf("Embedded prompt library should load: %v", problems)
+	}
+	for _, name := range []string{"json-sample-to-schema", "pdf-to-text", "sentiment-single", "sentiment-multiple"} {
+		if _, ok := library[name]; !ok {
+			t.Errorf("Expected prompt %s to be discovered", name)
+		}
+	}
+	if _, ok := library["tests-test-simple"]; ok {
+		t.Errorf("Test prompts should not be part of the library")
+	}
+	if !library["sentiment-single"].JSONStructured {
+		t.Errorf("sentiment-single should be a structured JSON prompt")
+	}
+
+	bad := map[string]fstest.MapFS{
+		"unknown field":      {"p/a/prompt": {Data: []byte("{{text}}")}, "p/a/settings.json": {Data: []byte(`{"structured": true}`)}},
+		"missing schema":     {"p/a/prompt": {Data: []byte("{{text}}")}, "p/a/settings.json": {Data: []byte(`{"structured_json": true}`)}},
+		"both json modes":    {"p/a/prompt": {Data: []byte("{{text}}")}, "p/a/settings.json": {Data: []byte(`{"structured_json": true, "unstructured_json": true}`)}},
+		"unknown model":      {"p/a/prompt": {Data: []byte("{{text}}")}, "p/a/settings.json": {Data: []byte(`{"model": "gpt-17"}`)}},
+		"bad template":       {"p/a/prompt": {Data: []byte("{% if %}")}},
+		"unknown capability": {"p/a/prompt": {Data: []byte("{{text}}")}, "p/a/settings.json": {Data: []byte(`{"requires": ["telepathy"]}`)}},
+		"incapable model":    {"p/a/prompt": {Data: []byte("{{text}}")}, "p/a/settings.json": {Data: []byte(`{"model": "gpt-4", "requires": ["images"]}`)}},
+		"duplicate name":     {"p/a/prompt": {Data: []byte("a")}, "p/a/settings.json": {Data: []byte(`{"name": "x"}`)}, "p/b/prompt": {Data: []byte("b")}, "p/b/settings.json": {Data: []byte(`{"name": "x"}`)}},
+	}
+	for reason, fsys := range bad {
+		if found, problems := discoverPrompts(fsys, "p", ""); len(problems) != 1 || len(found) > 1 {
+			t.Errorf("Expected one problem loading prompts with %s, got %v", reason, problems)
+		}
+	}
+
+	// a broken prompt only costs itself
+	mixed := fstest.MapFS{
+		"p/bad/prompt":         {Data: []byte("{{text}}")},
+		"p/bad/settings.json":  {Data: []byte(`{"structured": true}`)},
+		"p/good/prompt":        {Data: []byte("{{text}}")},
+		"p/good/settings.json": {Data: []byte(`{}`)},
+	}
+	found, problems := discoverPrompts(mixed, "p", "")
+	if _, ok := found["good"]; !ok || len(found) != 1 || len(problems) != 1 || !strings.Contains(problems[0].Error(), "p/bad") {
+		t.Errorf("Expected only the bad prompt to be skipped, got %v and %v", found, problems)
+	}
+
+	good := fstest.MapFS{
+		"p/nested/dir/prompt":        {Data: []byte("Summarize:")},
+		"p/nested/dir/settings.json": {Data: []byte(`{"template": false, "options": {"temperature": 0}}`)},
+	}
+	found, problems = discoverPrompts(good, "p", "")
+	if len(problems) > 0 {
+		t.Fatalf("Did not expect problems loading valid prompt: %v", problems)
+	}
+	wrapper, ok := found["nested-dir"]
+	if !ok {
+		t.Fatalf("Expected prompt name to default to its path, got %v", found)
+	}
+	if wrapper.Settings.IsTemplate() || wrapper.Settings.Options.Temperature == nil {
+		t.Errorf("Settings were not parsed: %+v", wrapper.Settings)
+	}
+}
+
+func TestCompileTemplate(t *testing.T) {
+	template, err := CompileTemplate("code: {{ text }}")
+	if err != nil {
+		t.Fatalf("Could not compile template: %v", err)
+	}
+	if result, err := template.Execute(pongo2.Context{"text": "a < b && c"}); err != nil || result != "code: a < b && c" {
+		t.Errorf("Prompt templates should not escape HTML, got %q (%v)", result, err)
+	}
+
+	// pongo2's own default is left alone
+	global, _ := pongo2.FromString("{{ text }}")
+	if result, _ := global.Execute(pongo2.Context{"text": "<"}); result != "&lt;" {
+		t.Errorf("Compiling prompts should not change pongo2's global autoescape, got %q", result)
+	}
+
+	if _, err := CompileTemplate("line one\n{% if %}"); err == nil || !strings.Contains(err.Error(), "Line 2") {
+		t.Errorf("Errors should point at the line in the prompt, got %v", err)
+	}
+}
+
+func TestLayerPrompts(t *testing.T) {
+	user := fstest.MapFS{
+		"summarize/prompt":        {Data: []byte("user summary: {{text}}")},
+		"sentiment/single/prompt": {Data: []byte("override: {{text}}")},
+	}
+	project := fstest.MapFS{
+		"summarize/prompt": {Data: []byte("project summary: {{text}}")},
+	}
+	layered, problems := layerPrompts([]promptSource{
+		{Name: "embedded", FS: promptFS, Root: promptRoot, Skip: testPromptRoot},
+		{Name: "user", FS: user, Root: "."},
+		{Name: "project", FS: project, Root: "."},
+	})
+	if len(problems) > 0 {
+		t.Fatalf("Did not expect problems layering prompts: %v", problems)
+	}
+
+	if wrapper := layered["summarize"]; wrapper.Source != "project" {
+		t.Errorf("Project prompts should override user prompts, got source %q", wrapper.Source)
+	}
+	if wrapper := layered["sentiment-single"]; wrapper.Source != "user" || wrapper.JSONStructured {
+		t.Errorf("User prompt should replace the embedded one, got %+v", wrapper)
+	}
+	if wrapper := layered["pdf-to-text"]; wrapper.Source != "embedded" {
+		t.Errorf("Prompts that aren't overridden should come from the embedded library, got %q", wrapper.Source)
+	}
+
+	// overridden prompts have to read their files from their own source
+	loadPrompts()
+	library := prompts
+	prompts = layered
+	defer func() { prompts = library }()
+	prompt, err := GetPrompt("summarize")
+	if err != nil {
+		t.Fatalf("Could not get layered prompt: %v", err)
+	}
+	rendered, err := prompt.Render("hello")
+	if err != nil || rendered != "project summary: hello" {
+		t.Errorf("Wrong rendering for layered prompt: %q (%v)", rendered, err)
+	}
+
+	// a broken prompt is skipped, and the rest of its directory still loads
+	broken := fstest.MapFS{
+		"bad/prompt":   {Data: []byte("{% if %}")},
+		"notes/prompt": {Data: []byte("user notes: {{text}}")},
+	}
+	layered, problems = layerPrompts([]promptSource{
+		{Name: "embedded", FS: promptFS, Root: promptRoot, Skip: testPromptRoot},
+		{Name: "user", FS: broken, Root: "."},
+		{Name: "project", FS: project, Root: "."},
+	})
+	if len(problems) != 1 || !strings.Contains(problems[0].Error(), "user") {
+		t.Errorf("Expected one problem with the user prompts, got %v", problems)
+	}
+	if _, ok := layered["bad"]; ok {
+		t.Errorf("A broken prompt should be skipped")
+	}
+	if layered["notes"].Source != "user" || layered["pdf-to-text"].Source != "embedded" || layered["summarize"].Source != "project" {
+		t.Errorf("The other prompts should still load, got %+v", layered)
+	}
+
+	// lookups that miss say which prompts were skipped
+	prompts, loadProblems = layered, problems
+	defer func() { loadProblems = nil }()
+	if _, err := GetPrompt("bad"); err == nil || !strings.Contains(err.Error(), "skipped a user prompt: bad/prompt") {
+		t.Errorf("Expected the missing prompt error to mention the skipped prompt, got %v", err)
+	}
+}
+
+func TestExamples(t *testing.T) {
+	dir := t.TempDir()
+	promptDir := filepath.Join(dir, "classify")
+	if err := os.MkdirAll(promptDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"prompt":   "{% if examples %}{{ examples }}\n{% endif %}Classify: {{ text }}",
+		"examples": "Input: a\nOutput: b",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(promptDir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	layered, problems := layerPrompts([]promptSource{
+		{Name: "embedded", FS: promptFS, Root: promptRoot, Skip: testPromptRoot},
+		{Name: "project", FS: os.DirFS(dir), Root: ".", Dir: dir},
+	})
+	if len(problems) > 0 {
+		t.Fatalf("Did not expect problems layering prompts: %v", problems)
+	}
+	loadPrompts()
+	library := prompts
+	prompts = layered
+	defer func() { prompts = library }()
+
+	prompt, err := GetPrompt("classify")
+	if err != nil {
+		t.Fatalf("Could not get prompt: %v", err)
+	}
+	if uses, err := prompt.UsesExamples(); err != nil || !uses {
+		t.Errorf("The template uses examples (%v)", err)
+	}
+	rendered, err := prompt.Render("c")
+	if err != nil || rendered != "Input: a\nOutput: b\nClassify: c" {
+		t.Errorf("Examples should be rendered into the template, got %q (%v)", rendered, err)
+	}
+	if _, err := prompt.ResolveVariables(map[string]any{"examples": "x"}); err == nil {
+		t.Errorf("examples is reserved and should not be settable")
+	}
+
+	file, err := prompt.WriteExamples("Input: d\nOutput: e")
+	if err != nil {
+		t.Fatalf("Could not write examples: %v", err)
+	}
+	if contents, _ := os.ReadFile(file); string(contents) != "Input: d\nOutput: e" || file != filepath.Join(promptDir, ExamplesFile) {
+		t.Errorf("Wrong examples written to %s: %q", file, contents)
+	}
+
+	embedded, err := GetPrompt("sentiment-single")
+	if err != nil {
+		t.Fatalf("Could not get prompt: %v", err)
+	}
+	if uses, _ := embedded.UsesExamples(); uses {
+		t.Errorf("sentiment-single has no examples")
+	}
+	if _, err := embedded.WriteExamples("x"); err == nil {
+		t.Errorf("Embedded prompts should be read only")
+	}
+	if err := embedded.CheckWritable(); err == nil {
+		t.Errorf("Embedded prompts should not be writable")
+	}
+	if err := prompt.CheckWritable(); err != nil {
+		t.Errorf("Prompts on disk should be writable: %v", err)
+	}
+	if entries, _ := os.ReadDir(promptDir); len(entries) != 2 {
+		t.Errorf("Checking should not leave anything behind, got %v", entries)
+	}
 }
 
 func TestGetPrompt(t *testing.T) {
@@ -39,7 +290,7 @@ func TestBuildPrompt(t *testing.T) {
 	}
 
 	text := "hey there!"
-	result, err := prompt.buildPrompt(text)
+	result, err := prompt.buildPrompt(text, nil)
 	if err != nil {
 		t.Errorf("Did not expect error when building prompt: %v", err)
 	}
@@ -50,6 +301,47 @@ func TestBuildPrompt(t *testing.T) {
 	}
 }
 
+func TestTemplateVariables(t *testing.T) {
+	addTestPromptWrappers()
+
+	prompt, err := GetPrompt("test-variables")
+	if err != nil {
+		t.Fatalf("Should have been able to get test prompt: %v", err)
+	}
+
+	if _, err := prompt.ResolveVariables(nil); err == nil || !strings.Contains(err.Error(), "name") {
+		t.Errorf("Expected an error naming the missing required variable, got %v", err)
+	}
+	if _, err := prompt.ResolveVariables(map[string]any{"name": "x", "text": "y"}); err == nil {
+		t.Errorf("Should not be able to set the reserved text variable")
+	}
+
+	result, err := prompt.RenderWithVariables("bye", map[string]any{"name": "lm"})
+	if err != nil {
+		t.Fatalf("Did not expect error rendering prompt: %v", err)
+	}
+	if strings.TrimSpace(result) != "Hello, lm! bye" {
+		t.Errorf("Defaults were not applied: %q", result)
+	}
+
+	result, _ = prompt.RenderWithVariables("bye", map[string]any{"name": "lm", "greeting": "Howdy"})
+	if strings.TrimSpace(result) != "Howdy, lm! bye" {
+		t.Errorf("Variables should override defaults: %q", result)
+	}
+
+	bad := map[string]fstest.MapFS{
+		"reserved":          {"p/a/prompt": {Data: []byte("{{text}}")}, "p/a/settings.json": {Data: []byte(`{"variables": {"text": {}}}`)}},
+		"invalid name":      {"p/a/prompt": {Data: []byte("{{text}}")}, "p/a/settings.json": {Data: []byte(`{"variables": {"my-var": {}}}`)}},
+		"required default":  {"p/a/prompt": {Data: []byte("{{text}}")}, "p/a/settings.json": {Data: []byte(`{"variables": {"x": {"required": true, "default": "y"}}}`)}},
+		"non-template vars": {"p/a/prompt": {Data: []byte("hi")}, "p/a/settings.json": {Data: []byte(`{"template": false, "variables": {"x": {}}}`)}},
+	}
+	for reason, fsys := range bad {
+		if _, problems := discoverPrompts(fsys, "p", ""); len(problems) == 0 {
+			t.Errorf("Expected a problem loading prompts with %s variable", reason)
+		}
+	}
+}
+
 func TestGetSchema(t *testing.T) {
 
 	//prompts["test-json-structured"] = PromptWrapper{"test-json-structured", "", "promptFiles/tests/test-json-structured", true, true}
@@ -68,8 +360,72 @@ func TestGetSchema(t *testing.T) {
 	}
 }
 
-func TestQuery(t *testing.T) {
+func TestPromptModels(t *testing.T) {
+	addTestPromptWrappers()
+
+	prompt, err := GetPrompt("test-json-structured")
+	if err != nil {
+		t.Fatalf("Should have been able to get test prompt: %v", err)
+	}
+	if prompt.ModelName != "gpt-4o-mini" {
+		t.Errorf("Prompts should default to gpt-4o-mini, got %s", prompt.ModelName)
+	}
+
+	// schema prompts work with any model that has structured output
+	gpt4, _ := models.GetModel("gpt-4")
+	if _, err := prompt.MakeQuery(gpt4, "hello", nil); err == nil {
+		t.Errorf("%s has no structured output, so it should not be able to run a structured prompt", gpt4.ModelId)
+	}
+	nova, _ := models.GetModel("aws-nova-lite")
+	if _, err := prompt.MakeQuery(nova, "hello", nil); err != nil {
+		t.Errorf("Should be able to make a structured query for %s: %v", nova.ModelId, err)
+	}
+	unstructured, err := GetPrompt("test-json-unstructured")
+	if err != nil {
+		t.Fatalf("Should have been able to get test prompt: %v", err)
+	}
+	if ok, _ := unstructured.FlightCheck(gpt4, false); ok {
+		t.Errorf("%s has no JSON mode, so it should fail the flight check for an unstructured JSON prompt", gpt4.ModelId)
+	}
 
+	simple, err := GetPrompt("test-simple")
+	if err != nil {
+		t.Fatalf("Should have been able to get test prompt: %v", err)
+	}
+	if _, err := simple.MakeQuery(gpt4, "hello", nil); err != nil {
+		t.Errorf("Plain prompts should work with any model: %v", err)
+	}
+	image := models.ImageContent{Type: "image_url", ImageURL: models.ImageURL{URL: "https://example.com/cat.jpg"}}
+	if _, err := simple.MakeQuery(gpt4, "hello", nil, image); err == nil {
+		t.Errorf("Should not be able to send images to %s", gpt4.ModelId)
+	}
+
+	pdf, err := GetPrompt("pdf-to-text")
+	if err != nil {
+		t.Fatalf("Should have been able to get pdf-to-text: %v", err)
+	}
+	if ok, _ := pdf.FlightCheck(gpt4, false); ok {
+		t.Errorf("pdf-to-text requires images, so %s should fail the flight check", gpt4.ModelId)
+	}
+}
+
+// Query and Prompt.Query took image URLs before QueryImages existed, and
+// callers still pass them
+var (
+	_ func(string, string, ...string) (string, error)              = Query
+	_ func(string, string, ...models.ImageContent) (string, error) = QueryImages
+	_ func(*Prompt, string, ...string) (string, error)             = (*Prompt).Query
+)
+
+func TestImagesFromURLs(t *testing.T) {
+	images := imagesFromURLs([]string{"https://example.com/a.png"})
+	if len(images) != 1 || images[0].ImageURL.URL != "https://example.com/a.png" || images[0].Type != "image_url" {
+		t.Errorf("Unexpected images %+v", images)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	skipOffline(t)
 	//prompts["test-simple"] = PromptWrapper{"test-simple", "", "promptFiles/tests/test-simple", false, false}
 	//prompts["test-json-unstructured"] = PromptWrapper{"test-json-unstructured", "", "promptFiles/tests/test-json-unstructured", true, false}
 	//prompts["test-json-structured"] = PromptWrapper{"test-json-structured", "", "promptFiles/tests/test-json-structured", true, true}
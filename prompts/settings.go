@@ -0,0 +1,210 @@
+package prompts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"time"
+	"unicode"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+const defaultPromptModel = "gpt-4o-mini"
+
+// Settings is the typed form of a prompt directory's settings.json.
+// every field is optional
+type Settings struct {
+	// defaults to the directory path, with / replaced by -
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// any model from `lm --list-models`. defaults to gpt-4o-mini
+	Model string `json:"model"`
+
+	// capabilities the model has to have on top of the ones implied by
+	// the JSON settings: images, json or structured_json. checked
+	// against the default model here and against --model at run time
+	Requires []string `json:"requires"`
+
+	StructuredJSON   bool `json:"structured_json"`
+	UnstructuredJSON bool `json:"unstructured_json"`
+
+	// schema file for structured JSON prompts, relative to the prompt
+	// directory. defaults to schema.json
+	Schema string `json:"schema"`
+
+	// when false the prompt file is sent verbatim with the input
+	// appended, instead of being rendered with pongo2. defaults to true
+	Template *bool `json:"template"`
+
+	Options  models.GenerationOptions `json:"options"`
+	CacheTTL string                   `json:"cache_ttl"`
+
+	// extra template variables, on top of text and imageURLs
+	Variables map[string]Variable `json:"variables"`
+}
+
+// Variable declares a template variable. optional variables without a
+// default are simply empty in the template
+type Variable struct {
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+	Default     any    `json:"default"`
+}
+
+// variables every template gets for free; they can't be declared or set
+// examples is filled in from the prompt's examples file (see `lm fewshot`)
+var reservedVariables = map[string]bool{"text": true, "imageURLs": true, "examples": true}
+
+func (s *Settings) IsTemplate() bool {
+	return s.Template == nil || *s.Template
+}
+
+func (s *Settings) ModelName() string {
+	if s.Model == "" {
+		return defaultPromptModel
+	}
+	return s.Model
+}
+
+func (s *Settings) SchemaFile() string {
+	if s.Schema == "" {
+		return "schema.json"
+	}
+	return s.Schema
+}
+
+// readSettings parses <dir>/settings.json. a missing file is the same
+// as an empty one; unknown fields are an error so typos don't get
+// silently ignored
+func readSettings(fsys fs.FS, dir string) (*Settings, error) {
+	var settings Settings
+	settingsPath := path.Join(dir, "settings.json")
+	settingsBytes, err := fs.ReadFile(fsys, settingsPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(settingsBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&settings); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %v", settingsPath, err))
+	}
+	return &settings, nil
+}
+
+// validate checks settings against the files in the prompt directory
+func (s *Settings) validate(fsys fs.FS, dir string) error {
+	settingsPath := path.Join(dir, "settings.json")
+
+	if s.StructuredJSON && s.UnstructuredJSON {
+		return errors.New(fmt.Sprintf("%s: structured_json and unstructured_json cannot both be set", settingsPath))
+	}
+
+	model, err := models.GetModel(s.ModelName())
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: %v", settingsPath, err))
+	}
+	for _, capability := range s.Requires {
+		if !knownCapabilities[capability] {
+			return errors.New(fmt.Sprintf("%s: unknown capability %q in requires (expected images, json or structured_json)", settingsPath, capability))
+		}
+	}
+	if ok, reason := model.FlightCheck(s.needs()); !ok {
+		return errors.New(fmt.Sprintf("%s: model %s can't be used for this prompt: %s", settingsPath, s.ModelName(), reason))
+	}
+
+	if s.CacheTTL != "" {
+		if _, err := utils.ParseDuration(s.CacheTTL); err != nil {
+			return errors.New(fmt.Sprintf("%s: cache_ttl: %v", settingsPath, err))
+		}
+	}
+
+	for name, variable := range s.Variables {
+		if reservedVariables[name] {
+			return errors.New(fmt.Sprintf("%s: variable %s is reserved", settingsPath, name))
+		}
+		if !validVariableName(name) {
+			return errors.New(fmt.Sprintf("%s: %q is not a valid variable name", settingsPath, name))
+		}
+		if variable.Required && variable.Default != nil {
+			return errors.New(fmt.Sprintf("%s: variable %s is required, so it can't have a default", settingsPath, name))
+		}
+	}
+	if len(s.Variables) > 0 && !s.IsTemplate() {
+		return errors.New(fmt.Sprintf("%s: variables are only supported by templates", settingsPath))
+	}
+
+	promptBytes, err := fs.ReadFile(fsys, path.Join(dir, "prompt"))
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: could not read prompt file: %v", dir, err))
+	}
+	if s.IsTemplate() {
+		if _, err := CompileTemplate(string(promptBytes)); err != nil {
+			return errors.New(fmt.Sprintf("%s: invalid template: %v", path.Join(dir, "prompt"), err))
+		}
+	}
+
+	if !s.StructuredJSON {
+		if s.Schema != "" {
+			return errors.New(fmt.Sprintf("%s: schema is set but structured_json is not", settingsPath))
+		}
+		return nil
+	}
+	schemaPath := path.Join(dir, s.SchemaFile())
+	schemaBytes, err := fs.ReadFile(fsys, schemaPath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: structured_json is set but the schema could not be read: %v", settingsPath, err))
+	}
+	if !json.Valid(schemaBytes) {
+		return errors.New(fmt.Sprintf("%s: not valid JSON", schemaPath))
+	}
+	return nil
+}
+
+var knownCapabilities = map[string]bool{"images": true, "json": true, "structured_json": true}
+
+func (s *Settings) requires(capability string) bool {
+	for _, required := range s.Requires {
+		if required == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// needs returns what the prompt needs from a model, in the order
+// models.FlightCheck takes them
+func (s *Settings) needs() (images bool, unstructuredJSON bool, structuredJSON bool) {
+	structuredJSON = s.StructuredJSON || s.requires("structured_json")
+	unstructuredJSON = !structuredJSON && (s.UnstructuredJSON || s.requires("json"))
+	return s.requires("images"), unstructuredJSON, structuredJSON
+}
+
+func (s *Settings) cacheTTL() time.Duration {
+	// already validated
+	ttl, _ := utils.ParseDuration(s.CacheTTL)
+	return ttl
+}
+
+// variable names have to be usable as pongo2 identifiers
+func validVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r)) {
+			continue
+		}
+		return false
+	}
+	return true
+}
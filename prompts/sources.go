@@ -0,0 +1,96 @@
+package prompts
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// a place prompts are loaded from. later sources override earlier ones
+type promptSource struct {
+	Name string
+	FS   fs.FS
+	Root string
+	Skip string
+	// where FS lives on disk, for sources that can be written to
+	Dir string
+}
+
+// defaultSources layers (lowest precedence first):
+//
+//  1. the prompts embedded in the binary
+//  2. ~/.config/lm/prompts (or $XDG_CONFIG_HOME/lm/prompts)
+//  3. .lm/prompts in the current directory or the closest parent that has one
+//
+// user and project directories use the same layout as promptFiles:
+// one directory per prompt holding prompt, settings.json and schema.json
+func defaultSources() []promptSource {
+	sources := []promptSource{{Name: "embedded", FS: promptFS, Root: promptRoot, Skip: testPromptRoot}}
+	if dir := userPromptDir(); dir != "" && isDir(dir) {
+		sources = append(sources, promptSource{Name: "user", FS: os.DirFS(dir), Root: ".", Dir: dir})
+	}
+	if dir := projectPromptDir(); dir != "" {
+		sources = append(sources, promptSource{Name: "project", FS: os.DirFS(dir), Root: ".", Dir: dir})
+	}
+	return sources
+}
+
+func userPromptDir() string {
+	if config, set := os.LookupEnv("XDG_CONFIG_HOME"); set && config != "" {
+		return filepath.Join(config, "lm", "prompts")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "lm", "prompts")
+}
+
+// projectPromptDir looks for .lm/prompts the same way git looks for .git
+func projectPromptDir() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		candidate := filepath.Join(dir, ".lm", "prompts")
+		if isDir(candidate) {
+			return candidate
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// layerPrompts loads every source in order. a prompt with the same name
+// as one from an earlier source replaces it. prompts that fail to load are
+// skipped, so one bad settings.json only costs that prompt; what was wrong
+// comes back with the rest
+func layerPrompts(sources []promptSource) (map[string]PromptWrapper, []error) {
+	layered := make(map[string]PromptWrapper)
+	problems := make([]error, 0)
+	for _, source := range sources {
+		found, sourceProblems := discoverPrompts(source.FS, source.Root, source.Skip)
+		for _, problem := range sourceProblems {
+			problems = append(problems, errors.New(fmt.Sprintf("skipped a %s prompt: %v", source.Name, problem)))
+		}
+		for name, wrapper := range found {
+			wrapper.Source = source.Name
+			if source.Dir != "" {
+				wrapper.dir = filepath.Join(source.Dir, filepath.FromSlash(wrapper.Path))
+			}
+			layered[name] = wrapper
+		}
+	}
+	return layered, problems
+}
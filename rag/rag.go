@@ -0,0 +1,359 @@
+package rag
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	utils "github.com/WillChangeThisLater/lm/utils"
+)
+
+// chunk sizes are in characters. ~1500 chars is a few hundred tokens,
+// which keeps top-k context small enough for every model we support
+const (
+	DefaultChunkSize    = 1500
+	DefaultChunkOverlap = 200
+)
+
+type Chunk struct {
+	Source    string    `json:"source"`
+	Position  int       `json:"position"`
+	Text      string    `json:"text"`
+	Embedding []float64 `json:"embedding"`
+}
+
+type Index struct {
+	Name           string  `json:"name"`
+	EmbeddingModel string  `json:"embedding_model"`
+	Chunks         []Chunk `json:"chunks"`
+
+	path string
+}
+
+type Result struct {
+	Chunk
+	Score float64 `json:"score"`
+}
+
+type Document struct {
+	Source string
+	Text   string
+}
+
+func indexPath(dir string, name string) string {
+	return filepath.Join(dir, name+".json")
+}
+
+// Open loads the named index from dir. if it doesn't exist yet an
+// empty index using embeddingModel is returned; it is written on Save
+func Open(dir string, name string, embeddingModel string) (*Index, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, errors.New(fmt.Sprintf("Invalid index name %q", name))
+	}
+
+	path := indexPath(dir, name)
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Index{Name: name, EmbeddingModel: embeddingModel, Chunks: []Chunk{}, path: path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var index Index
+	if err := json.Unmarshal(contents, &index); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read index %s: %v", path, err))
+	}
+	index.path = path
+	return &index, nil
+}
+
+// Load is like Open but fails if the index does not exist
+func Load(dir string, name string) (*Index, error) {
+	if _, err := os.Stat(indexPath(dir, name)); err != nil {
+		return nil, errors.New(fmt.Sprintf("Index %s not found in %s", name, dir))
+	}
+	return Open(dir, name, "")
+}
+
+func List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
+			names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+	return names, nil
+}
+
+func (i *Index) Save() error {
+	if err := os.MkdirAll(filepath.Dir(i.path), 0755); err != nil {
+		return err
+	}
+	contents, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	// write then rename so a crash never leaves a half written index
+	tmpPath := i.path + ".tmp"
+	if err := os.WriteFile(tmpPath, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, i.path)
+}
+
+func (i *Index) embeddingModel() (*models.EmbeddingModel, error) {
+	return models.GetEmbeddingModel(i.EmbeddingModel)
+}
+
+// Add chunks and embeds a document. re-adding a source replaces
+// whatever was previously indexed for it
+func (i *Index) Add(doc Document) (int, error) {
+	embeddingModel, err := i.embeddingModel()
+	if err != nil {
+		return 0, err
+	}
+
+	texts := ChunkText(doc.Text, DefaultChunkSize, DefaultChunkOverlap)
+	if len(texts) == 0 {
+		return 0, nil
+	}
+
+	embeddings, err := embeddingModel.Embed(texts)
+	if err != nil {
+		return 0, err
+	}
+
+	i.Remove(doc.Source)
+	for position, text := range texts {
+		i.Chunks = append(i.Chunks, Chunk{Source: doc.Source, Position: position, Text: text, Embedding: embeddings[position]})
+	}
+	return len(texts), nil
+}
+
+// Remove drops every chunk from the given source
+func (i *Index) Remove(source string) {
+	kept := i.Chunks[:0]
+	for _, chunk := range i.Chunks {
+		if chunk.Source != source {
+			kept = append(kept, chunk)
+		}
+	}
+	i.Chunks = kept
+}
+
+// Query embeds the question and returns the k closest chunks
+func (i *Index) Query(question string, k int) ([]Result, error) {
+	embeddingModel, err := i.embeddingModel()
+	if err != nil {
+		return nil, err
+	}
+	embeddings, err := embeddingModel.Embed([]string{question})
+	if err != nil {
+		return nil, err
+	}
+	return i.Search(embeddings[0], k), nil
+}
+
+// Search is an exact (brute force) cosine search. that's plenty fast
+// for the few thousand chunks a local index ends up with
+func (i *Index) Search(embedding []float64, k int) []Result {
+	results := make([]Result, 0, len(i.Chunks))
+	for _, chunk := range i.Chunks {
+		results = append(results, Result{Chunk: chunk, Score: models.CosineSimilarity(embedding, chunk.Embedding)})
+	}
+	sort.SliceStable(results, func(a, b int) bool {
+		return results[a].Score > results[b].Score
+	})
+	if k > 0 && len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
+
+// ChunkText packs paragraphs into chunks of roughly size characters.
+// consecutive chunks share up to overlap characters so an answer that
+// straddles a boundary is still retrievable
+func ChunkText(text string, size int, overlap int) []string {
+	paragraphs := make([]string, 0)
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		paragraphs = append(paragraphs, splitLong(paragraph, size)...)
+	}
+
+	chunks := make([]string, 0)
+	current := ""
+	for _, paragraph := range paragraphs {
+		if current != "" && len(current)+len(paragraph)+2 > size {
+			chunks = append(chunks, current)
+			current = tail(current, overlap)
+		}
+		if current == "" {
+			current = paragraph
+		} else {
+			current = current + "\n\n" + paragraph
+		}
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// splitLong breaks a paragraph that is bigger than a whole chunk,
+// preferring to break on whitespace
+func splitLong(paragraph string, size int) []string {
+	pieces := make([]string, 0)
+	for len(paragraph) > size {
+		cut := strings.LastIndexAny(paragraph[:size], " \n\t")
+		if cut <= 0 {
+			cut = size
+			for cut > 0 && !utf8.RuneStart(paragraph[cut]) {
+				cut--
+			}
+		}
+		pieces = append(pieces, strings.TrimSpace(paragraph[:cut]))
+		paragraph = strings.TrimSpace(paragraph[cut:])
+	}
+	if paragraph != "" {
+		pieces = append(pieces, paragraph)
+	}
+	return pieces
+}
+
+// tail returns (at most) the last n characters of s, starting on a word
+func tail(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	s = s[len(s)-n:]
+	if space := strings.IndexAny(s, " \n\t"); space >= 0 {
+		s = s[space+1:]
+	}
+	return strings.TrimSpace(s)
+}
+
+// SourceName is how a source is stored in the index: URLs as they are,
+// paths made absolute so they match whatever directory lm runs from
+func SourceName(source string) (string, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return source, nil
+	}
+	return filepath.Abs(source)
+}
+
+// LoadDocuments turns a path, directory or http(s) URL into documents.
+// directories are walked recursively and binary files are skipped. the
+// documents' sources are named by SourceName
+func LoadDocuments(source string) ([]Document, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		text, err := utils.FetchURLText(source)
+		if err != nil {
+			return nil, err
+		}
+		return []Document{{Source: source, Text: text}}, nil
+	}
+
+	source, err := SourceName(source)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		doc, ok, err := loadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s does not look like a text file", source))
+		}
+		return []Document{doc}, nil
+	}
+
+	docs := make([]Document, 0)
+	err = filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != source && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		doc, ok, err := loadFile(path)
+		if err != nil {
+			return err
+		}
+		if ok {
+			docs = append(docs, doc)
+		}
+		return nil
+	})
+	return docs, err
+}
+
+func loadFile(path string) (Document, bool, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return Document{}, false, err
+	}
+	if !utf8.Valid(contents) || !strings.HasPrefix(http.DetectContentType(contents), "text/") {
+		return Document{}, false, nil
+	}
+	return Document{Source: path, Text: string(contents)}, true, nil
+}
+
+// BuildPrompt puts the retrieved chunks in front of the question.
+// chunks are numbered so the model can cite them as [n]
+func BuildPrompt(question string, results []Result) string {
+	var sb strings.Builder
+	sb.WriteString("Answer the question using the context below. ")
+	sb.WriteString("Cite the context you used with its number, like [1]. ")
+	sb.WriteString("If the context does not contain the answer, say so.\n\n")
+	sb.WriteString("Context:\n\n")
+	for n, result := range results {
+		sb.WriteString(fmt.Sprintf("[%d] %s (chunk %d)\n", n+1, result.Source, result.Position))
+		sb.WriteString(result.Text)
+		sb.WriteString("\n\n")
+	}
+	sb.WriteString("Question:\n\n")
+	sb.WriteString(question)
+	return sb.String()
+}
+
+// Citations is the footer printed under an answer
+func Citations(results []Result) string {
+	var sb strings.Builder
+	sb.WriteString("Sources:\n")
+	for n, result := range results {
+		sb.WriteString(fmt.Sprintf("[%d] %s (chunk %d, score %.3f)\n", n+1, result.Source, result.Position, result.Score))
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
@@ -0,0 +1,130 @@
+package rag
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChunkText(t *testing.T) {
+	if chunks := ChunkText("   \n\n  ", 100, 10); len(chunks) != 0 {
+		t.Errorf("Expected no chunks for blank text, got %d", len(chunks))
+	}
+
+	short := "one paragraph\n\nanother paragraph"
+	chunks := ChunkText(short, 100, 10)
+	if len(chunks) != 1 || chunks[0] != short {
+		t.Errorf("Short text should be a single chunk, got %q", chunks)
+	}
+
+	long := strings.Repeat("word ", 200)
+	chunks = ChunkText(long, 100, 20)
+	if len(chunks) < 10 {
+		t.Errorf("Expected long text to be split into many chunks, got %d", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if len(chunk) > 130 {
+			t.Errorf("Chunk is much bigger than the chunk size (%d chars)", len(chunk))
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	index := &Index{Name: "test", Chunks: []Chunk{
+		{Source: "a", Text: "a", Embedding: []float64{1, 0, 0}},
+		{Source: "b", Text: "b", Embedding: []float64{0, 1, 0}},
+		{Source: "c", Text: "c", Embedding: []float64{0.9, 0.1, 0}},
+	}}
+
+	results := index.Search([]float64{1, 0, 0}, 2)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	if results[0].Source != "a" || results[1].Source != "c" {
+		t.Errorf("Results in wrong order: %s, %s", results[0].Source, results[1].Source)
+	}
+
+	index.Remove("a")
+	results = index.Search([]float64{1, 0, 0}, 5)
+	if len(results) != 2 || results[0].Source != "c" {
+		t.Errorf("Remove did not drop chunks for source 'a'")
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := Load(dir, "missing"); err == nil {
+		t.Errorf("Should not have been able to load an index that does not exist")
+	}
+
+	index, err := Open(dir, "notes", "text-embedding-3-small")
+	if err != nil {
+		t.Fatalf("Could not open new index: %v", err)
+	}
+	index.Chunks = append(index.Chunks, Chunk{Source: "notes.txt", Text: "hello", Embedding: []float64{1, 2}})
+	if err := index.Save(); err != nil {
+		t.Fatalf("Could not save index: %v", err)
+	}
+
+	loaded, err := Load(dir, "notes")
+	if err != nil {
+		t.Fatalf("Could not load saved index: %v", err)
+	}
+	if loaded.EmbeddingModel != "text-embedding-3-small" || len(loaded.Chunks) != 1 {
+		t.Errorf("Loaded index does not match saved index: %+v", loaded)
+	}
+
+	names, err := List(dir)
+	if err != nil || len(names) != 1 || names[0] != "notes" {
+		t.Errorf("Expected List to return [notes], got %v (%v)", names, err)
+	}
+}
+
+func TestBuildPrompt(t *testing.T) {
+	results := []Result{{Chunk: Chunk{Source: "README.md", Position: 3, Text: "lm caches responses"}}}
+	prompt := BuildPrompt("does lm cache?", results)
+	if !strings.Contains(prompt, "[1] README.md (chunk 3)") {
+		t.Errorf("Prompt is missing citation header: %s", prompt)
+	}
+	if !strings.HasSuffix(prompt, "does lm cache?") {
+		t.Errorf("Prompt should end with the question: %s", prompt)
+	}
+}
+
+func TestLoadDocuments(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docs", "notes.md"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	// the same file has the same source however it was named
+	want, _ := filepath.Abs(filepath.Join("docs", "notes.md"))
+	for _, source := range []string{"docs", "./docs/notes.md", want} {
+		docs, err := LoadDocuments(source)
+		if err != nil {
+			t.Fatalf("Could not load %s: %v", source, err)
+		}
+		if len(docs) != 1 || docs[0].Source != want {
+			t.Errorf("Expected %s to load %s, got %+v", source, want, docs)
+		}
+	}
+	if name, err := SourceName("docs/notes.md"); err != nil || name != want {
+		t.Errorf("Expected SourceName to match the loaded source, got %s (%v)", name, err)
+	}
+	if name, _ := SourceName("https://example.com/a"); name != "https://example.com/a" {
+		t.Errorf("URLs should be left alone, got %s", name)
+	}
+}
@@ -1,57 +1,511 @@
 package utils
 
 import (
-        "bytes"
-        "crypto/sha256"
-        "encoding/gob"
-        "fmt"
-        "github.com/dgraph-io/badger/v3"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	models "github.com/WillChangeThisLater/lm/models"
+	"github.com/dgraph-io/badger/v3"
 )
 
 type Cache struct {
-        db *badger.DB
+	db *badger.DB
+}
+
+// CacheFormatVersion changes whenever the key or value layout changes.
+// opening a cache written with an older version wipes it, so stale
+// entries can never be returned under the new key scheme. caches from a
+// newer lm, and databases that aren't lm caches at all, are refused
+// rather than wiped
+//
+// 1: sha256 of the raw prompt text
+// 2: sha256 of the canonical request (models.Query.CacheKey)
+// 3: values are CacheEntry structs instead of bare responses
+const CacheFormatVersion = 3
+
+var versionKey = []byte("meta:version")
+
+// every entry key is <prefix><sha256 of the cache key>. semantic
+// records additionally carry the hashed scope:
+// semantic:<scope hash>:<key hash>
+const (
+	entryPrefix    = "entry:"
+	semanticPrefix = "semantic:"
+)
+
+type CacheEntry struct {
+	Key       string    `json:"key"`
+	Prompt    string    `json:"prompt"`
+	Model     string    `json:"model"`
+	Response  string    `json:"response"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LastHitAt time.Time `json:"last_hit_at"`
+	Hits      int       `json:"hits"`
+	Size      int       `json:"size"`
+
+	// only filled in by Export, so semantic matches survive a round trip
+	Semantic *SemanticRecord `json:"semantic,omitempty"`
+}
+
+type SemanticRecord struct {
+	Scope     string    `json:"scope"`
+	Embedding []float64 `json:"embedding"`
+}
+
+type semanticEntry struct {
+	Key       string
+	Embedding []float64
+}
+
+type SemanticMatch struct {
+	Entry *CacheEntry
+	Score float64
+}
+
+type CacheStats struct {
+	Entries         int            `json:"entries"`
+	SemanticEntries int            `json:"semantic_entries"`
+	Size            int            `json:"size"`
+	Hits            int            `json:"hits"`
+	Oldest          time.Time      `json:"oldest"`
+	Newest          time.Time      `json:"newest"`
+	Models          map[string]int `json:"models"`
 }
 
 func NewCache(dbPath string) (*Cache, error) {
-        opts := badger.DefaultOptions(dbPath)
-        opts.Logger = nil
-        db, err := badger.Open(opts)
-        if err != nil {
-                return nil, err
-        }
-        return &Cache{db: db}, nil
+	opts := badger.DefaultOptions(dbPath)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	cache := &Cache{db: db}
+	if err := cache.checkVersion(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return cache, nil
+}
+
+func (c *Cache) checkVersion() error {
+	stored, err := c.storedVersion()
+	if err != nil {
+		return err
+	}
+	if stored == CacheFormatVersion {
+		return nil
+	}
+	if stored > CacheFormatVersion {
+		return errors.New(fmt.Sprintf("cache was written by a newer lm (format %d, this one understands up to %d); upgrade lm or use a different --cache-dir", stored, CacheFormatVersion))
+	}
+
+	// either a fresh cache or one from an older version of lm
+	if err := c.db.DropAll(); err != nil {
+		return err
+	}
+	return c.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(versionKey, []byte(strconv.Itoa(CacheFormatVersion)))
+	})
+}
+
+// version 1 keys are bare sha256 hex digests
+var version1Key = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// storedVersion reads the format the cache was written with. an empty
+// database is version 0. version 1 didn't record itself, so a database
+// without the version key is only taken for one if every key looks like
+// a version 1 key
+func (c *Cache) storedVersion() (int, error) {
+	version := 0
+	err := c.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(versionKey)
+		if err == nil {
+			return item.Value(func(val []byte) error {
+				version, err = strconv.Atoi(string(val))
+				if err != nil {
+					return errors.New(fmt.Sprintf("not an lm cache (bad format version %q)", val))
+				}
+				return nil
+			})
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if !version1Key.Match(it.Item().Key()) {
+				return errors.New(fmt.Sprintf("not an lm cache (unexpected key %q); refusing to wipe it", it.Item().Key()))
+			}
+			version = 1
+		}
+		return nil
+	})
+	return version, err
 }
 
 func (c *Cache) Close() error {
-        return c.db.Close()
+	return c.db.Close()
 }
 
 func (c *Cache) keyHash(key string) string {
-        return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
-}
-
-func (c *Cache) Get(key string) (string, error) {
-        var result string
-        err := c.db.View(func(txn *badger.Txn) error {
-                item, err := txn.Get([]byte(c.keyHash(key)))
-                if err != nil {
-                        return err
-                }
-                return item.Value(func(val []byte) error {
-                        buf := bytes.NewBuffer(val)
-                        return gob.NewDecoder(buf).Decode(&result)
-                })
-        })
-        return result, err
-}
-
-func (c *Cache) Set(key string, value string) error {
-        return c.db.Update(func(txn *badger.Txn) error {
-                var buf bytes.Buffer
-                err := gob.NewEncoder(&buf).Encode(value)
-                if err != nil {
-                        return err
-                }
-                return txn.Set([]byte(c.keyHash(key)), buf.Bytes())
-        })
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+func encode(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeEntry(item *badger.Item) (*CacheEntry, error) {
+	var entry CacheEntry
+	err := item.Value(func(val []byte) error {
+		return gob.NewDecoder(bytes.NewBuffer(val)).Decode(&entry)
+	})
+	return &entry, err
+}
+
+// Get returns the entry cached under key and records the hit
+func (c *Cache) Get(key string) (*CacheEntry, error) {
+	return c.getByHash(c.keyHash(key))
+}
+
+func (c *Cache) getByHash(hash string) (*CacheEntry, error) {
+	var entry *CacheEntry
+	err := c.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(entryPrefix + hash))
+		if err != nil {
+			return err
+		}
+		entry, err = decodeEntry(item)
+		if err != nil {
+			return err
+		}
+		entry.Hits++
+		entry.LastHitAt = time.Now()
+		return c.putEntry(txn, entry)
+	})
+	return entry, err
+}
+
+// Set stores entry under key. Key, CreatedAt and Size are filled in here.
+// a ttl of 0 keeps the entry forever
+func (c *Cache) Set(key string, entry CacheEntry, ttl time.Duration) error {
+	entry.Key = c.keyHash(key)
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	if ttl > 0 {
+		entry.ExpiresAt = entry.CreatedAt.Add(ttl)
+	}
+	entry.Size = len(entry.Prompt) + len(entry.Response)
+	return c.db.Update(func(txn *badger.Txn) error {
+		return c.putEntry(txn, &entry)
+	})
+}
+
+func (c *Cache) putEntry(txn *badger.Txn, entry *CacheEntry) error {
+	semantic := entry.Semantic
+	entry.Semantic = nil
+	value, err := encode(entry)
+	entry.Semantic = semantic
+	if err != nil {
+		return err
+	}
+	return txn.SetEntry(withExpiry(badger.NewEntry([]byte(entryPrefix+entry.Key), value), entry.ExpiresAt))
+}
+
+// badger drops expired keys by itself, so reads never see stale entries
+func withExpiry(e *badger.Entry, expiresAt time.Time) *badger.Entry {
+	if expiresAt.IsZero() {
+		return e
+	}
+	return e.WithTTL(time.Until(expiresAt))
+}
+
+// Entries calls fn for every cached entry, in key order. hits are
+// not recorded
+func (c *Cache) Entries(fn func(entry *CacheEntry) error) error {
+	return c.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(entryPrefix)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true, PrefetchSize: 100})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			entry, err := decodeEntry(it.Item())
+			if err != nil {
+				return err
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Find returns the entries whose (hashed) key starts with prefix, so
+// the short keys printed by `lm cache ls` can be used to refer to them
+func (c *Cache) Find(keyPrefix string) ([]*CacheEntry, error) {
+	found := make([]*CacheEntry, 0)
+	err := c.Entries(func(entry *CacheEntry) error {
+		if strings.HasPrefix(entry.Key, keyPrefix) {
+			found = append(found, entry)
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Delete removes an entry (by hashed key) and any semantic records
+// pointing at it
+func (c *Cache) Delete(hash string) error {
+	semanticKeys, err := c.semanticKeysFor(hash)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(txn *badger.Txn) error {
+		for _, key := range semanticKeys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return txn.Delete([]byte(entryPrefix + hash))
+	})
+}
+
+// Purge deletes every entry created more than olderThan ago
+func (c *Cache) Purge(olderThan time.Duration) (int, error) {
+	if olderThan <= 0 {
+		return 0, errors.New(fmt.Sprintf("Purge needs a positive age, not %v (use PurgeAll to empty the cache)", olderThan))
+	}
+	cutoff := time.Now().Add(-olderThan)
+	return c.purge(func(entry *CacheEntry) bool {
+		return entry.CreatedAt.Before(cutoff)
+	})
+}
+
+// PurgeAll deletes every entry
+func (c *Cache) PurgeAll() (int, error) {
+	return c.purge(func(entry *CacheEntry) bool {
+		return true
+	})
+}
+
+func (c *Cache) purge(stale func(entry *CacheEntry) bool) (int, error) {
+	keys := make([]string, 0)
+	err := c.Entries(func(entry *CacheEntry) error {
+		if stale(entry) {
+			keys = append(keys, entry.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, hash := range keys {
+		if err := c.Delete(hash); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+func (c *Cache) Stats() (*CacheStats, error) {
+	stats := &CacheStats{Models: make(map[string]int)}
+	err := c.Entries(func(entry *CacheEntry) error {
+		stats.Entries++
+		stats.Size += entry.Size
+		stats.Hits += entry.Hits
+		stats.Models[entry.Model]++
+		if stats.Oldest.IsZero() || entry.CreatedAt.Before(stats.Oldest) {
+			stats.Oldest = entry.CreatedAt
+		}
+		if entry.CreatedAt.After(stats.Newest) {
+			stats.Newest = entry.CreatedAt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = c.semanticEntries(func(key []byte, _ *semanticEntry) error {
+		stats.SemanticEntries++
+		return nil
+	})
+	return stats, err
+}
+
+// Export writes every entry as a line of JSON
+func (c *Cache) Export(w io.Writer) (int, error) {
+	records := make(map[string]*SemanticRecord)
+	err := c.semanticEntries(func(key []byte, entry *semanticEntry) error {
+		scope := strings.SplitN(strings.TrimPrefix(string(key), semanticPrefix), ":", 2)[0]
+		records[entry.Key] = &SemanticRecord{Scope: scope, Embedding: entry.Embedding}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	encoder := json.NewEncoder(w)
+	err = c.Entries(func(entry *CacheEntry) error {
+		entry.Semantic = records[entry.Key]
+		count++
+		return encoder.Encode(entry)
+	})
+	return count, err
+}
+
+// Import reads entries written by Export. existing entries with the
+// same key are overwritten
+func (c *Cache) Import(r io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 256*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry CacheEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return count, errors.New(fmt.Sprintf("Invalid cache entry on line %d: %v", count+1, err))
+		}
+		if entry.Key == "" {
+			return count, errors.New(fmt.Sprintf("Cache entry on line %d has no key", count+1))
+		}
+		if !entry.ExpiresAt.IsZero() && entry.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+		entry.Size = len(entry.Prompt) + len(entry.Response)
+		err := c.db.Update(func(txn *badger.Txn) error {
+			if err := c.putEntry(txn, &entry); err != nil {
+				return err
+			}
+			if entry.Semantic == nil {
+				return nil
+			}
+			value, err := encode(semanticEntry{Key: entry.Key, Embedding: entry.Semantic.Embedding})
+			if err != nil {
+				return err
+			}
+			return txn.SetEntry(withExpiry(badger.NewEntry([]byte(semanticPrefix+entry.Semantic.Scope+":"+entry.Key), value), entry.ExpiresAt))
+		})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+func (c *Cache) semanticKey(scope string, key string) []byte {
+	return []byte(semanticPrefix + c.keyHash(scope) + ":" + c.keyHash(key))
+}
+
+func (c *Cache) semanticEntries(fn func(key []byte, entry *semanticEntry) error) error {
+	return c.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(semanticPrefix)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true, PrefetchSize: 100})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var entry semanticEntry
+			err := it.Item().Value(func(val []byte) error {
+				return gob.NewDecoder(bytes.NewBuffer(val)).Decode(&entry)
+			})
+			if err != nil {
+				return err
+			}
+			if err := fn(it.Item().KeyCopy(nil), &entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *Cache) semanticKeysFor(hash string) ([][]byte, error) {
+	keys := make([][]byte, 0)
+	err := c.semanticEntries(func(key []byte, entry *semanticEntry) error {
+		if entry.Key == hash {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// SetSemantic records the embedding of the prompt cached under key so
+// that similar prompts in the same scope can find it. scope should
+// capture everything besides the prompt text that changes the answer
+// (model, parameters, images...). the ttl should match the entry's
+func (c *Cache) SetSemantic(scope string, key string, embedding []float64, ttl time.Duration) error {
+	return c.db.Update(func(txn *badger.Txn) error {
+		value, err := encode(semanticEntry{Key: c.keyHash(key), Embedding: embedding})
+		if err != nil {
+			return err
+		}
+		e := badger.NewEntry(c.semanticKey(scope, key), value)
+		if ttl > 0 {
+			e = e.WithTTL(ttl)
+		}
+		return txn.SetEntry(e)
+	})
+}
+
+// GetSemantic returns the cached entry whose prompt is most similar to
+// embedding, as long as the similarity is at least threshold
+func (c *Cache) GetSemantic(scope string, embedding []float64, threshold float64) (*SemanticMatch, error) {
+	var best *semanticEntry
+	bestScore := threshold
+	err := c.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(semanticPrefix + c.keyHash(scope) + ":")
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true, PrefetchSize: 100})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var entry semanticEntry
+			err := it.Item().Value(func(val []byte) error {
+				return gob.NewDecoder(bytes.NewBuffer(val)).Decode(&entry)
+			})
+			if err != nil {
+				return err
+			}
+			score := models.CosineSimilarity(embedding, entry.Embedding)
+			if score >= bestScore {
+				best = &entry
+				bestScore = score
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if best == nil {
+		return nil, badger.ErrKeyNotFound
+	}
+
+	entry, err := c.getByHash(best.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &SemanticMatch{Entry: entry, Score: bestScore}, nil
 }
@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+func TestSemanticCache(t *testing.T) {
+	cache, err := NewCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("Could not create cache: %v", err)
+	}
+	defer cache.Close()
+
+	prompt := "what is the capital of france?"
+	if err := cache.Set("key", CacheEntry{Prompt: prompt, Response: "Paris"}, 0); err != nil {
+		t.Fatalf("Could not write to cache: %v", err)
+	}
+	if err := cache.SetSemantic("scope-a", "key", []float64{1, 0, 0}, 0); err != nil {
+		t.Fatalf("Could not write semantic entry: %v", err)
+	}
+
+	match, err := cache.GetSemantic("scope-a", []float64{0.99, 0.05, 0}, 0.95)
+	if err != nil {
+		t.Fatalf("Expected a semantic hit: %v", err)
+	}
+	if match.Entry.Response != "Paris" || match.Entry.Prompt != prompt {
+		t.Errorf("Wrong semantic match: %+v", match.Entry)
+	}
+
+	if _, err := cache.GetSemantic("scope-a", []float64{0, 1, 0}, 0.95); err == nil {
+		t.Errorf("Dissimilar prompt should not have been a semantic hit")
+	}
+
+	if _, err := cache.GetSemantic("scope-b", []float64{1, 0, 0}, 0.95); err == nil {
+		t.Errorf("Semantic hits should not cross scopes")
+	}
+}
+
+func TestCacheVersion(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("Could not create cache: %v", err)
+	}
+	cache.Set("key", CacheEntry{Response: "value"}, 0)
+
+	// pretend the cache was written by an older lm
+	cache.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(versionKey, []byte("1"))
+	})
+	cache.Close()
+
+	cache, err = NewCache(dir)
+	if err != nil {
+		t.Fatalf("Could not reopen cache: %v", err)
+	}
+	defer cache.Close()
+	if _, err := cache.Get("key"); err == nil {
+		t.Errorf("Entries from an older cache format should have been dropped")
+	}
+
+	// a newer lm's cache is left alone
+	cache.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(versionKey, []byte(strconv.Itoa(CacheFormatVersion+1)))
+	})
+	cache.Close()
+	if _, err := NewCache(dir); err == nil || !strings.Contains(err.Error(), "newer lm") {
+		t.Errorf("Expected a cache from a newer lm to be refused, got %v", err)
+	}
+}
+
+func TestCacheForeignDatabase(t *testing.T) {
+	// version 1 caches have no version key, just sha256 keys
+	dir := t.TempDir()
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(fmt.Sprintf("%x", sha256.Sum256([]byte("key")))), []byte("value"))
+	})
+	db.Close()
+	cache, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("A version 1 cache should be upgraded, got %v", err)
+	}
+	cache.Close()
+
+	// anything else isn't ours to wipe
+	dir = t.TempDir()
+	db, err = badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("user:42"), []byte("someone else's data"))
+	})
+	db.Close()
+	if _, err := NewCache(dir); err == nil || !strings.Contains(err.Error(), "not an lm cache") {
+		t.Errorf("Expected a database without a version to be refused, got %v", err)
+	}
+	db, err = badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte("user:42"))
+		return err
+	}); err != nil {
+		t.Errorf("A refused database should be left as it was: %v", err)
+	}
+}
+
+func TestCacheManagement(t *testing.T) {
+	cache, err := NewCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("Could not create cache: %v", err)
+	}
+	defer cache.Close()
+
+	cache.Set("old", CacheEntry{Prompt: "old prompt", Model: "gpt-4o", Response: "old", CreatedAt: time.Now().Add(-48 * time.Hour)}, 0)
+	cache.Set("new", CacheEntry{Prompt: "new prompt", Model: "gpt-4o-mini", Response: "new"}, 0)
+	cache.SetSemantic("scope", "new", []float64{1, 0}, 0)
+
+	entry, err := cache.Get("new")
+	if err != nil || entry.Hits != 1 {
+		t.Errorf("Expected hit to be recorded, got %+v (%v)", entry, err)
+	}
+
+	stats, err := cache.Stats()
+	if err != nil {
+		t.Fatalf("Could not get stats: %v", err)
+	}
+	if stats.Entries != 2 || stats.SemanticEntries != 1 || stats.Hits != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	var exported bytes.Buffer
+	if count, err := cache.Export(&exported); err != nil || count != 2 {
+		t.Fatalf("Expected to export 2 entries, got %d (%v)", count, err)
+	}
+
+	purged, err := cache.Purge(24 * time.Hour)
+	if err != nil || purged != 1 {
+		t.Errorf("Expected to purge 1 entry, purged %d (%v)", purged, err)
+	}
+	if _, err := cache.Get("old"); err == nil {
+		t.Errorf("Old entry should have been purged")
+	}
+
+	if _, err := cache.Purge(0); err == nil {
+		t.Errorf("Purge with no age should be an error, not delete everything")
+	}
+	if purged, _ := cache.PurgeAll(); purged != 1 {
+		t.Errorf("PurgeAll should delete everything")
+	}
+	if stats, _ := cache.Stats(); stats.SemanticEntries != 0 {
+		t.Errorf("Deleting an entry should delete its semantic record")
+	}
+
+	if count, err := cache.Import(&exported); err != nil || count != 2 {
+		t.Fatalf("Expected to import 2 entries, got %d (%v)", count, err)
+	}
+	if _, err := cache.GetSemantic("scope", []float64{1, 0}, 0.9); err != nil {
+		t.Errorf("Semantic record should survive export/import: %v", err)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	cache, err := NewCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("Could not create cache: %v", err)
+	}
+	defer cache.Close()
+
+	cache.Set("short", CacheEntry{Response: "short"}, time.Second)
+	cache.SetSemantic("scope", "short", []float64{1, 0}, time.Second)
+	cache.Set("forever", CacheEntry{Response: "forever"}, 0)
+
+	entry, err := cache.Get("short")
+	if err != nil {
+		t.Fatalf("Entry should not have expired yet: %v", err)
+	}
+	if entry.ExpiresAt.IsZero() {
+		t.Errorf("Entry with a TTL should record when it expires")
+	}
+
+	// badger TTLs have one second granularity
+	time.Sleep(2100 * time.Millisecond)
+	if _, err := cache.Get("short"); err == nil {
+		t.Errorf("Entry should have expired")
+	}
+	if _, err := cache.GetSemantic("scope", []float64{1, 0}, 0.9); err == nil {
+		t.Errorf("Semantic record should have expired with its entry")
+	}
+	if _, err := cache.Get("forever"); err != nil {
+		t.Errorf("Entry without a TTL should not expire: %v", err)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	cases := map[string]time.Duration{"7d": 7 * 24 * time.Hour, "2w": 14 * 24 * time.Hour, "90m": 90 * time.Minute}
+	for input, expected := range cases {
+		duration, err := ParseDuration(input)
+		if err != nil || duration != expected {
+			t.Errorf("ParseDuration(%q) = %v, %v; expected %v", input, duration, err, expected)
+		}
+	}
+	if _, err := ParseDuration("soon"); err == nil {
+		t.Errorf("Should not have been able to parse 'soon'")
+	}
+}
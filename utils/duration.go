@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDuration is time.ParseDuration plus the units people actually
+// use for cache ages: d (days) and w (weeks), e.g. "7d" or "2w"
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number, ok := strings.CutSuffix(s, suffix); ok {
+			n, err := strconv.ParseFloat(number, 64)
+			if err != nil {
+				return 0, errors.New(fmt.Sprintf("Invalid duration %q", s))
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid duration %q (try something like 90m, 12h or 7d)", s))
+	}
+	return duration, nil
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// elements whose text is never useful to a model
+var skippedElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"head":     true,
+	"svg":      true,
+}
+
+// elements that should start on a new line when flattened to text
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"pre": true, "section": true, "article": true, "table": true, "ul": true, "ol": true,
+}
+
+var blankLines = regexp.MustCompile(`\n\s*\n+`)
+
+// so a server that never answers can't hang a template or an index run
+var fetchClient = &http.Client{Timeout: 30 * time.Second}
+
+// FetchURLText downloads a page and returns its readable text.
+// HTML is flattened (roughly what `lynx -dump` gives you), anything
+// else is returned as-is
+func FetchURLText(url string) (string, error) {
+	rep, err := fetchClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer rep.Body.Close()
+
+	if rep.StatusCode < 200 || rep.StatusCode >= 300 {
+		return "", errors.New(fmt.Sprintf("Could not fetch %s: %s", url, rep.Status))
+	}
+
+	contents, err := io.ReadAll(rep.Body)
+	if err != nil {
+		return "", err
+	}
+
+	contentType := rep.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(contents)
+	}
+	if !strings.Contains(contentType, "html") {
+		return string(contents), nil
+	}
+	return HTMLToText(string(contents))
+}
+
+// HTMLToText strips tags, scripts and styles from an HTML document
+func HTMLToText(document string) (string, error) {
+	root, err := html.Parse(strings.NewReader(document))
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode && skippedElements[node.Data] {
+			return
+		}
+		if node.Type == html.TextNode {
+			text := strings.TrimSpace(node.Data)
+			if text != "" {
+				sb.WriteString(text)
+				sb.WriteString(" ")
+			}
+		}
+		if node.Type == html.ElementNode && blockElements[node.Data] {
+			sb.WriteString("\n")
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+		if node.Type == html.ElementNode && blockElements[node.Data] {
+			sb.WriteString("\n")
+		}
+	}
+	walk(root)
+
+	lines := strings.Split(sb.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	text := blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(text), nil
+}
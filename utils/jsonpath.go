@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSONPath evaluates a small subset of jq paths against a decoded JSON
+// value (the kind json.Unmarshal gives you for an `any`):
+//
+//	.                 the whole value
+//	.name, ["name"]   object fields
+//	[0], [-1]         array elements, negative indexes count from the end
+//	[]                every element of an array (or value of an object)
+//
+// like jq, a path can produce several results, e.g. `.items[].name`
+func JSONPath(value any, path string) ([]any, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	results := []any{value}
+	for _, step := range steps {
+		next := make([]any, 0, len(results))
+		for _, result := range results {
+			values, err := step.apply(result)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: %v", path, err))
+			}
+			next = append(next, values...)
+		}
+		results = next
+	}
+	return results, nil
+}
+
+type jsonPathStep struct {
+	field   string
+	index   int
+	isIndex bool
+	iterate bool
+}
+
+func (s jsonPathStep) apply(value any) ([]any, error) {
+	if value == nil {
+		// jq gives null for fields of null; so do we
+		return []any{nil}, nil
+	}
+	switch {
+	case s.iterate:
+		switch v := value.(type) {
+		case []any:
+			return v, nil
+		case map[string]any:
+			// go maps don't keep the original order, so use key order
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			values := make([]any, 0, len(v))
+			for _, key := range keys {
+				values = append(values, v[key])
+			}
+			return values, nil
+		}
+		return nil, errors.New(fmt.Sprintf("cannot iterate over %s", jsonTypeName(value)))
+	case s.isIndex:
+		array, ok := value.([]any)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("cannot index %s with a number", jsonTypeName(value)))
+		}
+		index := s.index
+		if index < 0 {
+			index += len(array)
+		}
+		if index < 0 || index >= len(array) {
+			return []any{nil}, nil
+		}
+		return []any{array[index]}, nil
+	default:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("cannot get field %q of %s", s.field, jsonTypeName(value)))
+		}
+		return []any{object[s.field]}, nil
+	}
+}
+
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case nil:
+		return "null"
+	}
+	return "a number"
+}
+
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, ".") && !strings.HasPrefix(path, "[") {
+		return nil, errors.New(fmt.Sprintf("invalid path %q: paths start with . or [", path))
+	}
+
+	steps := make([]jsonPathStep, 0)
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+			end := i
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			if end > i {
+				steps = append(steps, jsonPathStep{field: path[i:end]})
+			}
+			i = end
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, errors.New(fmt.Sprintf("invalid path %q: unclosed [", path))
+			}
+			inside := strings.TrimSpace(path[i+1 : i+end])
+			i += end + 1
+			if inside == "" {
+				steps = append(steps, jsonPathStep{iterate: true})
+				continue
+			}
+			if unquoted, err := strconv.Unquote(inside); err == nil {
+				steps = append(steps, jsonPathStep{field: unquoted})
+				continue
+			}
+			index, err := strconv.Atoi(inside)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid path %q: [%s] should be a number or a quoted field", path, inside))
+			}
+			steps = append(steps, jsonPathStep{index: index, isIndex: true})
+		default:
+			return nil, errors.New(fmt.Sprintf("invalid path %q: unexpected %q", path, path[i]))
+		}
+	}
+	return steps, nil
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSONPath(t *testing.T) {
+	var document any
+	json.Unmarshal([]byte(`{"items": [{"name": "a", "tags": ["x"]}, {"name": "b", "tags": []}], "with space": 1, "empty": null}`), &document)
+
+	cases := map[string][]any{
+		".":               {document},
+		".items[0].name":  {"a"},
+		".items[-1]":      {map[string]any{"name": "b", "tags": []any{}}},
+		".items[].name":   {"a", "b"},
+		`.["with space"]`: {float64(1)},
+		".missing":        {nil},
+		".empty.field":    {nil},
+		".items[5]":       {nil},
+	}
+	for path, expected := range cases {
+		results, err := JSONPath(document, path)
+		if err != nil {
+			t.Errorf("JSONPath(%q) failed: %v", path, err)
+			continue
+		}
+		if !reflect.DeepEqual(results, expected) {
+			t.Errorf("JSONPath(%q) = %v, expected %v", path, results, expected)
+		}
+	}
+
+	for _, path := range []string{"items", ".items[", ".items[x]", ".items.name", ".items[0].name[]"} {
+		if _, err := JSONPath(document, path); err == nil {
+			t.Errorf("Expected an error for path %q", path)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// one request every 50ms
+	limiter := NewRateLimiter(1200)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := limiter.Wait(context.Background()); err != nil {
+				t.Errorf("Wait failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("4 requests at 1200/min should take at least 150ms, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := NewRateLimiter(1)
+	slow.Wait(context.Background())
+	if err := slow.Wait(ctx); err == nil {
+		t.Errorf("Wait should give up when the context is done")
+	}
+
+	var unlimited *RateLimiter = NewRateLimiter(0)
+	if unlimited != nil || unlimited.Wait(context.Background()) != nil {
+		t.Errorf("A limit of 0 should not limit anything")
+	}
+}
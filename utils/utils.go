@@ -10,6 +10,7 @@ import (
 	"mime"
 	"os"
 	"path/filepath"
+	"strings"
 
 	models "github.com/WillChangeThisLater/lm/models"
 	"github.com/kbinani/screenshot"
@@ -43,7 +44,39 @@ func GetImageContent(imagePath string) (*models.ImageContent, error) {
 		return nil, errors.New(fmt.Sprintf("Could not read file: %v\n", err))
 	}
 
-	ext := filepath.Ext(imagePath)
+	return ImageContentFromBytes(imagePath, fileData)
+}
+
+// LoadImages loads images given as http(s) URLs or file names. URLs are
+// left for the provider to download. files are read with readFile, or
+// os.ReadFile if it's nil
+func LoadImages(images []string, readFile func(name string) ([]byte, error)) ([]models.ImageContent, error) {
+	if readFile == nil {
+		readFile = os.ReadFile
+	}
+	contents := make([]models.ImageContent, 0, len(images))
+	for _, image := range images {
+		if strings.HasPrefix(image, "http://") || strings.HasPrefix(image, "https://") {
+			contents = append(contents, models.ImageFromURL(image))
+			continue
+		}
+		fileData, err := readFile(image)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not read image %s: %v", image, err))
+		}
+		content, err := ImageContentFromBytes(image, fileData)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, *content)
+	}
+	return contents, nil
+}
+
+// ImageContentFromBytes is GetImageContent for an image that's already
+// been read. the name is only used to work out the mime type
+func ImageContentFromBytes(name string, fileData []byte) (*models.ImageContent, error) {
+	ext := filepath.Ext(name)
 	mimeType := mime.TypeByExtension(ext)
 	if mimeType == "" {
 		log.Printf("Unsupported file format: %s\n", ext)
@@ -94,7 +127,7 @@ func SiteScreenshots(urls []string) ([]string, error) {
 	logger := slog.New(gowitnessLog.Logger)
 	driver, err := driver.NewChromedp(logger, *options)
 	if err != nil {
-		log.Printf("Failed to create chrome driver : %s\n", driver)
+		log.Printf("Failed to create chrome driver: %v\n", err)
 		return nil, err
 	}
 
@@ -128,7 +161,7 @@ func SiteScreenshots(urls []string) ([]string, error) {
 	// sometimes this will fail for one or more URLs
 	// don't freak out, just write a warning and soldier on
 	if len(urls) != len(paths) {
-		log.Printf("It looks like gowitness could not screenshot some URLs (expected %d screenshots, got %d)\n", err, len(urls), len(paths))
+		log.Printf("It looks like gowitness could not screenshot some URLs (expected %d screenshots, got %d)\n", len(urls), len(paths))
 		return nil, errors.New(fmt.Sprintf("One or more sites could not be screenshotted"))
 	}
 	return paths, nil
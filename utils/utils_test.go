@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLoadImages(t *testing.T) {
+	read := func(name string) ([]byte, error) {
+		if name == "cat.png" {
+			return []byte("png"), nil
+		}
+		return nil, errors.New("no such file")
+	}
+	images, err := LoadImages([]string{"https://example.com/dog.jpg", "cat.png"}, read)
+	if err != nil {
+		t.Fatalf("LoadImages failed: %v", err)
+	}
+	if len(images) != 2 || images[0].ImageURL.URL != "https://example.com/dog.jpg" || images[0].ImageContents != nil {
+		t.Errorf("URLs should be left for the provider, got %+v", images)
+	}
+	if len(images) == 2 && (images[1].ImageURL.URL != "data:image/png;base64,cG5n" || string(images[1].ImageContents) != "png") {
+		t.Errorf("Files should be read and encoded, got %+v", images[1])
+	}
+	if _, err := LoadImages([]string{"missing.png"}, read); err == nil {
+		t.Errorf("Expected an error for an image that can't be read")
+	}
+}